@@ -0,0 +1,81 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// 最後に転送が完了したバイナリログの位置
+type Position struct {
+	File    string `json:"file"`
+	Pos     uint32 `json:"pos"`
+	GTIDSet string `json:"gtid_set,omitempty"`
+}
+
+// ローカルファイルにチェックポイントを保存する
+type Store struct {
+	path string
+}
+
+func NewStore(path string) *Store {
+	return &Store{path}
+}
+
+func (s *Store) Path() string {
+	return s.path
+}
+
+// 保存されたチェックポイントを読み込む (未保存の場合は nil)
+func (s *Store) Load() (*Position, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	pos := &Position{}
+	err = json.Unmarshal(data, pos)
+	if err != nil {
+		return nil, err
+	}
+
+	return pos, nil
+}
+
+// チェックポイントを保存する
+// 一時ファイルに書き込んでから rename するので、途中でクラッシュしても壊れない
+func (s *Store) Save(pos Position) error {
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
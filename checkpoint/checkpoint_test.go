@@ -0,0 +1,72 @@
+package checkpoint
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bingo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewStore(filepath.Join(dir, "bingo.checkpoint"))
+
+	pos, err := s.Load()
+	if err != nil {
+		t.Errorf("load error: %v", err)
+	}
+	if pos != nil {
+		t.Errorf("invalid position.  expected:nil pos:%v", pos)
+	}
+
+	expecteds := []Position{
+		{"mysql-bin.000001", 4, ""},
+		{"mysql-bin.000001", 1234, ""},
+		{"mysql-bin.000002", 120, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5"},
+	}
+	for _, s1 := range expecteds {
+		err = s.Save(s1)
+		if err != nil {
+			t.Errorf("save error: %v", err)
+		}
+
+		pos, err = s.Load()
+		if err != nil {
+			t.Errorf("load error: %v", err)
+		}
+		if pos == nil || !reflect.DeepEqual(s1, *pos) {
+			t.Errorf("invalid position.  expected:%v pos:%v", s1, pos)
+		}
+	}
+
+	// 一時ファイルが残っていないこと
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("invalid files.  expected:1 files:%d", len(files))
+	}
+}
+
+func TestLoadBroken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bingo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bingo.checkpoint")
+	ioutil.WriteFile(path, []byte("{broken"), 0644)
+
+	_, err = NewStore(path).Load()
+	if err == nil {
+		t.Errorf("invalid pattern. broken checkpoint was loaded")
+	}
+}
@@ -3,34 +3,95 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/uwork/bingo/filter"
+	"github.com/uwork/bingo/mysql"
 	"io/ioutil"
+	"os"
 )
 
 type MysqlConfig struct {
-	User string `json:"user"`
-	Pass string `json:"pass"`
-	Host string `json:"host"`
-	Port int    `json:"port"`
+	User           string `json:"user"`
+	Pass           string `json:"pass"`
+	Host           string `json:"host"`
+	Port           int    `json:"port"`
+	VerifyChecksum bool   `json:"verify_checksum"`
+	GTID           bool   `json:"gtid"`
+	SSLMode        string `json:"ssl_mode"`
+	SSLCA          string `json:"ssl_ca"`
+	SSLCert        string `json:"ssl_cert"`
+	SSLKey         string `json:"ssl_key"`
+	MaxRetries     int    `json:"max_retries"`
+
+	// ハートビートの間隔 (秒, 0 の場合は無効) と、切断とみなすまでの間隔の倍数
+	HeartbeatPeriod   float64 `json:"heartbeat_period"`
+	HeartbeatMultiple float64 `json:"heartbeat_multiple"`
+
+	// レプリカとして登録する server_id と SHOW SLAVE HOSTS に表示するホスト名、ポート
+	// 複数の bingo を同じサーバーに接続する場合は server_id を重複させない
+	ServerId   uint32 `json:"server_id"`
+	Hostname   string `json:"hostname"`
+	ReportPort int    `json:"report_port"`
+}
+
+func (c MysqlConfig) SSLConfig() *mysql.SSLConfig {
+	return &mysql.SSLConfig{
+		Mode: c.SSLMode,
+		CA:   c.SSLCA,
+		Cert: c.SSLCert,
+		Key:  c.SSLKey,
+	}
 }
 
+// 転送先ごとのフィルタと設定 (options の内容は転送先の種類ごとに異なる)
+type DestConfig struct {
+	Dest    string              `json:"dest"`
+	Filter  filter.FilterConfig `json:"filter"`
+	Options json.RawMessage     `json:"options,omitempty"`
+}
+
+// Dests が空の場合は Dest に Filter を適用して転送する
 type Config struct {
-	Mysql  MysqlConfig         `json:"mysql"`
-	Dest   string              `json:"dest"`
-	Filter filter.FilterConfig `json:"filter"`
+	Mysql         MysqlConfig         `json:"mysql"`
+	Dest          string              `json:"dest"`
+	Dests         []DestConfig        `json:"dests,omitempty"`
+	Checkpoint    string              `json:"checkpoint"`
+	SchemaHistory string              `json:"schema_history"`
+	DeadLetter    string              `json:"dead_letter"`
+	Filter        filter.FilterConfig `json:"filter"`
+}
+
+// 転送先の一覧
+func (c Config) Destinations() []DestConfig {
+	if 0 < len(c.Dests) {
+		return c.Dests
+	}
+	return []DestConfig{{Dest: c.Dest, Filter: c.Filter}}
 }
 
 func LoadConfig(opts *CliOptions) (Config, error) {
+	hostname, _ := os.Hostname()
+
 	config := Config{}
 	config.Mysql = MysqlConfig{
-		*opts.user,
-		*opts.pass,
-		*opts.host,
-		*opts.port,
+		User:    *opts.user,
+		Pass:    *opts.pass,
+		Host:    *opts.host,
+		Port:    *opts.port,
+		SSLMode: *opts.sslMode,
+
+		ServerId: uint32(*opts.serverId),
+		Hostname: hostname,
+
+		HeartbeatPeriod:   30,
+		HeartbeatMultiple: mysql.DEFAULT_HEARTBEAT_MULTIPLE,
 	}
 	config.Dest = *opts.dest
+	config.Checkpoint = *opts.checkpoint
+	config.SchemaHistory = *opts.schema
+	config.DeadLetter = *opts.deadLetter
 	config.Filter = filter.FilterConfig{
-		[]filter.Filter{},
+		Filters: []filter.Filter{},
 	}
 
 	if 0 < len(*opts.conf) {
@@ -44,7 +105,22 @@ func LoadConfig(opts *CliOptions) (Config, error) {
 			return config, err
 		}
 	}
-	return config, nil
+
+	err := config.CompileFilters()
+	return config, err
+}
+
+// フィルタの誤りは起動時にエラーにする
+func (c *Config) CompileFilters() error {
+	if err := c.Filter.Compile(); err != nil {
+		return fmt.Errorf("invalid filter: %s", err)
+	}
+	for i := range c.Dests {
+		if err := c.Dests[i].Filter.Compile(); err != nil {
+			return fmt.Errorf("invalid filter: %s (%s)", c.Dests[i].Dest, err)
+		}
+	}
+	return nil
 }
 
 func DumpConfig(opts *CliOptions) (string, error) {
@@ -56,10 +132,10 @@ func DumpConfig(opts *CliOptions) (string, error) {
 	// filter sample
 	if 0 == len(config.Filter.Filters) {
 		filter := filter.Filter{
-			"dbname",
-			"tablename",
-			[]int{0, 1, 2},
-			filter.NewExpression("$$0", "=", "1"),
+			Database: "dbname",
+			Table:    "tablename",
+			Columns:  []interface{}{"id", "name", 2},
+			Where:    filter.NewExpression("$$id", "=", "1"),
 		}
 		config.Filter.Filters = append(config.Filter.Filters, filter)
 	}
@@ -0,0 +1,211 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/uwork/bingo/mysql/binlog"
+	"github.com/uwork/bingo/schema"
+	"os"
+	"sync"
+	"time"
+)
+
+// フィルタや転送に失敗したトランザクション
+// イベントはバイナリログのまま保存し、再送時にその時点の設定で解析し直す
+type Entry struct {
+	Id    int       `json:"id"`
+	Time  time.Time `json:"time"`
+	Dest  string    `json:"dest"`
+	Error string    `json:"error"`
+
+	// トランザクションを COMMIT した位置
+	File string `json:"file"`
+	Pos  uint32 `json:"pos"`
+	GTID string `json:"gtid,omitempty"`
+
+	// FORMAT_DESCRIPTION_EVENT と、トランザクションのイベント (GTID_EVENT から XID_EVENT まで)
+	Description []byte   `json:"description"`
+	Events      [][]byte `json:"events"`
+
+	// 再送が完了した時刻 (未完了の場合は nil)
+	Replayed *time.Time `json:"replayed,omitempty"`
+}
+
+// schema.Cache で実装される
+type TableMapper interface {
+	OnTableMap(tm *binlog.BinlogEventTableMap, pos schema.Position) error
+}
+
+// イベントを解析し直してトランザクションにする
+// TABLE_MAP_EVENT のカラム名は、そのイベントの位置で有効なテーブル定義から設定する
+func (e *Entry) Transaction(tables TableMapper) (*binlog.Transaction, error) {
+	parser := &binlog.BinlogParser{TableMaps: map[uint64]*binlog.BinlogEventTableMap{}}
+	if _, _, err := parser.ParseBinlogEvent(e.Description); err != nil {
+		return nil, fmt.Errorf("invalid format description: %s", err)
+	}
+
+	assembler := binlog.NewTransactionAssembler()
+	for _, data := range e.Events {
+		ev, _, err := parser.ParseBinlogEvent(data)
+		if err != nil {
+			return nil, err
+		}
+
+		if ev.TableMap != nil && tables != nil {
+			err = tables.OnTableMap(ev.TableMap, schema.Position{File: e.File, Pos: ev.Header.LogPos})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if tx := assembler.Add(ev); tx != nil {
+			return tx, nil
+		}
+	}
+	return nil, fmt.Errorf("incomplete transaction: %s:%d", e.File, e.Pos)
+}
+
+// FORMAT_DESCRIPTION_EVENT が無く、解析し直せないエントリ
+type InvalidEntryError struct {
+	Path string
+	Line int
+	Id   int
+}
+
+func (e *InvalidEntryError) Error() string {
+	return fmt.Sprintf("dead letter without format description: %s:%d (id: %d)", e.Path, e.Line, e.Id)
+}
+
+// 1 行に 1 エントリの JSON を追記する
+// 再送が完了した場合は {"id": n, "replayed": "..."} を追記する
+type Store struct {
+	path   string
+	mutex  sync.Mutex
+	nextId int
+}
+
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Id と Time を設定して追記する
+func (s *Store) Append(e *Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.nextId == 0 {
+		// 解析し直せないエントリがあっても追記はできる
+		entries, err := s.load()
+		if _, ok := err.(*InvalidEntryError); err != nil && !ok {
+			return err
+		}
+		s.nextId = 1
+		if 0 < len(entries) {
+			s.nextId = entries[len(entries)-1].Id + 1
+		}
+	}
+
+	e.Id = s.nextId
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	err := s.append(e)
+	if err != nil {
+		return err
+	}
+	s.nextId++
+	return nil
+}
+
+// 再送が完了したことを記録する
+func (s *Store) MarkReplayed(id int, t time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.append(&struct {
+		Id       int       `json:"id"`
+		Replayed time.Time `json:"replayed"`
+	}{id, t})
+}
+
+// 保存されたエントリを追記した順に返す (ファイルが無い場合は空)
+// FORMAT_DESCRIPTION_EVENT の無いエントリがある場合は InvalidEntryError を返す
+func (s *Store) Load() ([]*Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.load()
+}
+
+func (s *Store) load() ([]*Entry, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Entry{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []*Entry{}
+	ids := map[int]*Entry{}
+	var invalid error
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if len(data) == 0 && err != nil {
+			break
+		}
+
+		e := &Entry{}
+		if uerr := json.Unmarshal(data, e); uerr != nil {
+			// 書き込み途中で停止した最後の行は無視する
+			if err != nil {
+				break
+			}
+			return nil, fmt.Errorf("invalid dead letter: %s:%d (%s)", s.path, line, uerr)
+		}
+
+		if prev, ok := ids[e.Id]; ok {
+			prev.Replayed = e.Replayed
+			continue
+		}
+		// 再送の完了を記録した行
+		if e.Replayed != nil && e.Description == nil && e.Events == nil && len(e.Dest) == 0 {
+			continue
+		}
+
+		if e.Description == nil && invalid == nil {
+			invalid = &InvalidEntryError{s.path, line, e.Id}
+		}
+		entries = append(entries, e)
+		ids[e.Id] = e
+	}
+	return entries, invalid
+}
+
+func (s *Store) append(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
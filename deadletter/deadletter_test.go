@@ -0,0 +1,197 @@
+package deadletter
+
+import (
+	"github.com/uwork/bingo/mysql/binlog"
+	"github.com/uwork/bingo/schema"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func makeEvent(evType byte, logPos uint32, body []byte) []byte {
+	size := 19 + len(body)
+	data := []byte{
+		0, 0, 0, 0, // timestamp
+		evType,
+		1, 0, 0, 0, // server id
+		byte(size), byte(size >> 8), byte(size >> 16), byte(size >> 24),
+		byte(logPos), byte(logPos >> 8), byte(logPos >> 16), byte(logPos >> 24),
+		0, 0, // flags
+	}
+	return append(data, body...)
+}
+
+func formatDescriptionEvent() []byte {
+	body := []byte{4, 0}
+	version := make([]byte, 50)
+	copy(version, "5.7.14-log")
+	body = append(body, version...)
+	body = append(body, 0, 0, 0, 0, 19)
+	body = append(body, 0x38, 0xd, 0x0, 0x8, 0x0, 0x12, 0x0, 0x4, 0x4, 0x4, 0x4, 0x12, 0x0, 0x0, 0x5f, 0x0, 0x4, 0x1a, 0x8, 0x0,
+		0x0, 0x0, 0x8, 0x8, 0x8, 0x2, 0x0, 0x0, 0x0, 0xa, 0xa, 0xa, 0x2a, 0x2a, 0x0, 0x12, 0x34, 0x0)
+	body = append(body, binlog.BINLOG_CHECKSUM_ALG_OFF)
+	return makeEvent(binlog.BINLOG_EVENT_FORMAT_DESCRIPTION, 0, body)
+}
+
+// testdb.testtable (id int, value int) に (1, 10) を insert するトランザクション
+func transactionEvents() [][]byte {
+	tableMap := []byte{1, 0, 0, 0, 0, 0, 1, 0, 6}
+	tableMap = append(tableMap, []byte("testdb")...)
+	tableMap = append(tableMap, 0, 9)
+	tableMap = append(tableMap, []byte("testtable")...)
+	tableMap = append(tableMap, 0, 2, binlog.TYPE_LONG, binlog.TYPE_LONG, 0, 0)
+
+	rows := []byte{1, 0, 0, 0, 0, 0, 1, 0, 2, 0, 2, 0x03, 0, 1, 0, 0, 0, 10, 0, 0, 0}
+
+	return [][]byte{
+		makeEvent(binlog.BINLOG_EVENT_TABLE_MAP, 300, tableMap),
+		makeEvent(binlog.BINLOG_EVENT_WRITE_ROWSv2, 400, rows),
+		makeEvent(binlog.BINLOG_EVENT_XID, 500, []byte{0x2a, 0, 0, 0, 0, 0, 0, 0}),
+	}
+}
+
+type testTableMapper struct {
+	positions []schema.Position
+}
+
+func (m *testTableMapper) OnTableMap(tm *binlog.BinlogEventTableMap, pos schema.Position) error {
+	m.positions = append(m.positions, pos)
+	tm.ColumnNames = []string{"id", "value"}
+	return nil
+}
+
+func TestTransaction(t *testing.T) {
+	e := &Entry{File: "mysql-bin.000001", Pos: 500, Description: formatDescriptionEvent(), Events: transactionEvents()}
+
+	m := &testTableMapper{}
+	tx, err := e.Transaction(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Xid != 0x2a || tx.LogPos != 500 || len(tx.Events) != 1 {
+		t.Errorf("invalid transaction: %#v", tx)
+	}
+	if len(m.positions) != 1 || m.positions[0] != (schema.Position{File: "mysql-bin.000001", Pos: 300}) {
+		t.Errorf("invalid table map position: %v", m.positions)
+	}
+
+	row := tx.Events[0].Rows.Rows[0]
+	if row.ColumnIndex("value") != 1 || row.Columns[1].String() != "10" {
+		t.Errorf("invalid row: %#v", row)
+	}
+
+	// COMMIT が無い場合
+	e.Events = e.Events[:2]
+	if _, err := e.Transaction(m); err == nil {
+		t.Errorf("invalid pattern. incomplete transaction was accepted")
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bingo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bingo.deadletter")
+	s := NewStore(path)
+
+	entries, err := s.Load()
+	if err != nil || len(entries) != 0 {
+		t.Errorf("invalid entries: %v (%v)", entries, err)
+	}
+
+	expecteds := []struct {
+		dest  string
+		error string
+		pos   uint32
+	}{
+		{"http://localhost:8888/bingo.data", "invalid http response: 400", 500},
+		{"file:///tmp/bingo.json", "unknown column: 3", 800},
+	}
+	for _, e := range expecteds {
+		err = s.Append(&Entry{Dest: e.dest, Error: e.error, File: "mysql-bin.000001", Pos: e.pos, Description: formatDescriptionEvent(), Events: transactionEvents()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replayed := time.Date(2016, 9, 2, 1, 23, 0, 0, time.UTC)
+	if err := s.MarkReplayed(1, replayed); err != nil {
+		t.Fatal(err)
+	}
+
+	// 別の Store から追記しても id は続きから振る
+	s = NewStore(path)
+	if err := s.Append(&Entry{Dest: "fluent://localhost:24224", File: "mysql-bin.000002", Pos: 4, Description: formatDescriptionEvent()}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err = s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("invalid entries: %v", entries)
+	}
+	for i, e := range expecteds {
+		entry := entries[i]
+		if entry.Id != i+1 || entry.Dest != e.dest || entry.Error != e.error || entry.Pos != e.pos || len(entry.Events) != 3 || entry.Time.IsZero() {
+			t.Errorf("invalid entry.  expected:%v entry:%v", e, entry)
+		}
+	}
+	if entries[0].Replayed == nil || !entries[0].Replayed.Equal(replayed) || entries[1].Replayed != nil {
+		t.Errorf("invalid replayed: %v %v", entries[0].Replayed, entries[1].Replayed)
+	}
+	if entries[2].Id != 3 {
+		t.Errorf("invalid id.  expected:3 id:%d", entries[2].Id)
+	}
+
+	// 書き込み途中の最後の行は無視する
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id": 4, "dest": "ht`)
+	f.Close()
+
+	entries, err = s.Load()
+	if err != nil || len(entries) != 3 {
+		t.Errorf("invalid entries: %v (%v)", entries, err)
+	}
+}
+
+// FORMAT_DESCRIPTION_EVENT の無いエントリは読み飛ばさずにエラーにする
+func TestStoreInvalidEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bingo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewStore(filepath.Join(dir, "bingo.deadletter"))
+	if err := s.Append(&Entry{Dest: "http://localhost:8888/bingo.data", File: "mysql-bin.000001", Pos: 500, Events: transactionEvents()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MarkReplayed(1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 解析し直せないエントリがあっても追記はできる
+	s = NewStore(s.path)
+	if err := s.Append(&Entry{Dest: "http://localhost:8888/bingo.data", File: "mysql-bin.000001", Pos: 800, Description: formatDescriptionEvent()}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := s.Load()
+	ierr, ok := err.(*InvalidEntryError)
+	if !ok || ierr.Line != 1 || ierr.Id != 1 {
+		t.Fatalf("invalid error: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Replayed == nil || entries[1].Id != 2 {
+		t.Errorf("invalid entries: %v", entries)
+	}
+}
@@ -0,0 +1,700 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/uwork/bingo/mysql/binlog"
+	"strconv"
+	"strings"
+)
+
+// 比較に使う値の種類
+const (
+	VALUE_NULL = iota
+	VALUE_INT
+	VALUE_FLOAT
+	VALUE_STRING
+)
+
+// 比較に使う値 (NULL と binlog に含まれないカラムは VALUE_NULL)
+// 整数型のカラムは VALUE_INT、浮動小数点型と DECIMAL は VALUE_FLOAT、それ以外のカラムは VALUE_STRING にする
+type value struct {
+	kind int
+	i    int64
+	f    float64
+	s    string
+
+	// リテラルの文字列を数値に変換した結果 (コンパイル時に変換しておく)
+	num     number
+	numeric bool
+}
+
+func columnScalar(c binlog.Column) value {
+	if c.IsNull || !c.IsPresent {
+		return value{}
+	}
+	switch c.Type {
+	case binlog.TYPE_LONG, binlog.TYPE_LONGLONG,
+		binlog.TYPE_INT24, binlog.TYPE_TINY, binlog.TYPE_SHORT, binlog.TYPE_YEAR:
+		return value{kind: VALUE_INT, i: int64(c.Int())}
+	case binlog.TYPE_FLOAT, binlog.TYPE_DOUBLE:
+		return value{kind: VALUE_FLOAT, f: c.Double()}
+	case binlog.TYPE_NEWDECIMAL:
+		if f, err := strconv.ParseFloat(c.String(), 64); err == nil {
+			return value{kind: VALUE_FLOAT, f: f}
+		}
+	case binlog.TYPE_JSON:
+		// JSON カラムの値が文字列か整数の場合は、その値で比較する
+		var v interface{}
+		if err := json.Unmarshal([]byte(c.String()), &v); err == nil {
+			switch v := v.(type) {
+			case string:
+				return value{kind: VALUE_STRING, s: v}
+			case float64:
+				if v == float64(int(v)) {
+					return value{kind: VALUE_INT, i: int64(v)}
+				}
+			}
+		}
+	}
+	return value{kind: VALUE_STRING, s: c.String()}
+}
+
+// 設定に書かれた値 (整数、小数、文字列、null のみ)
+func literalScalar(v interface{}) (value, bool) {
+	switch v := v.(type) {
+	case nil:
+		return value{}, true
+	case int:
+		return value{kind: VALUE_INT, i: int64(v)}, true
+	case int64:
+		return value{kind: VALUE_INT, i: v}, true
+	case float64:
+		return value{kind: VALUE_FLOAT, f: v}, true
+	case string:
+		n, ok := toNumber(v)
+		return value{kind: VALUE_STRING, s: v, num: n, numeric: ok}, true
+	}
+	return value{}, false
+}
+
+func (v value) String() string {
+	switch v.kind {
+	case VALUE_INT:
+		return strconv.FormatInt(v.i, 10)
+	case VALUE_FLOAT:
+		return strconv.FormatFloat(v.f, 'f', -1, 64)
+	}
+	return v.s
+}
+
+func (v value) number() (number, bool) {
+	switch v.kind {
+	case VALUE_INT:
+		return number{v.i, float64(v.i), true}, true
+	case VALUE_FLOAT:
+		return number{f: v.f}, true
+	case VALUE_STRING:
+		if v.numeric {
+			return v.num, true
+		}
+		return toNumber(v.s)
+	}
+	return number{}, false
+}
+
+// 数値 (整数の場合は isInt)
+type number struct {
+	i     int64
+	f     float64
+	isInt bool
+}
+
+func toNumber(s string) (number, bool) {
+	s = strings.TrimSpace(s)
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return number{i, float64(i), true}, true
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return number{f: f}, true
+	}
+	return number{}, false
+}
+
+func (n number) compare(n2 number) int {
+	if n.isInt && n2.isInt {
+		switch {
+		case n.i < n2.i:
+			return -1
+		case n.i > n2.i:
+			return 1
+		}
+		return 0
+	}
+	switch {
+	case n.f < n2.f:
+		return -1
+	case n.f > n2.f:
+		return 1
+	}
+	return 0
+}
+
+// left と right を比較して -1, 0, 1 を返す (どちらかが NULL の場合は ok が false)
+// どちらかが数値の場合は数値で比較し、数値に変換できない文字列との比較や文字列同士は文字列で比較する
+func compareValues(left value, right value) (int, bool) {
+	if left.kind == VALUE_NULL || right.kind == VALUE_NULL {
+		return 0, false
+	}
+
+	if left.kind != VALUE_STRING || right.kind != VALUE_STRING {
+		ln, lok := left.number()
+		rn, rok := right.number()
+		if lok && rok {
+			return ln.compare(rn), true
+		}
+	}
+	return strings.Compare(left.String(), right.String()), true
+}
+
+// $$0 (カラムの位置) または $$name (カラム名) で指定されたカラム
+// old. を付けた場合は before image を参照する (before image の無い insert, delete では new. と同じ行)
+type columnRef struct {
+	ref  string
+	old  bool
+	name string // カラムの位置で指定した場合は空
+
+	// カラムの位置 (カラム名で指定した場合は最後に見つかった位置)
+	index int
+}
+
+func newColumnRef(ref string) (*columnRef, error) {
+	c := &columnRef{ref: ref, index: -1}
+	if strings.HasPrefix(ref, COLUMN_OLD+".") {
+		c.old = true
+		ref = ref[len(COLUMN_OLD)+1:]
+	} else if strings.HasPrefix(ref, COLUMN_NEW+".") {
+		ref = ref[len(COLUMN_NEW)+1:]
+	}
+
+	if i, err := strconv.Atoi(ref); err == nil {
+		if i < 0 {
+			return nil, fmt.Errorf("invalid column index: %s", c.ref)
+		}
+		c.index = i
+	} else if len(ref) == 0 {
+		return nil, fmt.Errorf("invalid column: %s", c.ref)
+	} else {
+		c.name = ref
+	}
+	return c, nil
+}
+
+func (c *columnRef) column(row binlog.Row) (binlog.Column, error) {
+	if c.old && row.BeforeRow != nil {
+		row = *row.BeforeRow
+	}
+	index, err := c.position(row)
+	if err != nil {
+		return binlog.Column{}, err
+	}
+	return row.Columns[index], nil
+}
+
+func (c *columnRef) position(row binlog.Row) (int, error) {
+	index := c.index
+	if 0 < len(c.name) && (index < 0 || len(row.ColumnNames) <= index || row.ColumnNames[index] != c.name) {
+		index = row.ColumnIndex(c.name)
+		if index < 0 {
+			return -1, fmt.Errorf("unknown column: %s", c.ref)
+		}
+		c.index = index
+	}
+	if len(row.Columns) <= index {
+		return -1, fmt.Errorf("invalid column index: %s", c.ref)
+	}
+	return index, nil
+}
+
+func (c *columnRef) get(row binlog.Row) (value, error) {
+	col, err := c.column(row)
+	if err != nil {
+		return value{}, err
+	}
+	return columnScalar(col), nil
+}
+
+// カラムまたはリテラルの値
+type operand interface {
+	get(row binlog.Row) (value, error)
+}
+
+type literal struct {
+	v value
+}
+
+func (l *literal) get(row binlog.Row) (value, error) {
+	return l.v, nil
+}
+
+// 評価結果 (SQL の 3 値論理)
+// NULL との比較は UNKNOWN になり、NOT を付けても UNKNOWN のまま (TRUE の場合だけ条件に一致する)
+type truth int
+
+const (
+	TRUTH_FALSE truth = iota
+	TRUTH_TRUE
+	TRUTH_UNKNOWN
+)
+
+func truthOf(b bool) truth {
+	if b {
+		return TRUTH_TRUE
+	}
+	return TRUTH_FALSE
+}
+
+func (t truth) not() truth {
+	switch t {
+	case TRUTH_TRUE:
+		return TRUTH_FALSE
+	case TRUTH_FALSE:
+		return TRUTH_TRUE
+	}
+	return TRUTH_UNKNOWN
+}
+
+func (t truth) and(t2 truth) truth {
+	switch {
+	case t == TRUTH_FALSE || t2 == TRUTH_FALSE:
+		return TRUTH_FALSE
+	case t == TRUTH_UNKNOWN || t2 == TRUTH_UNKNOWN:
+		return TRUTH_UNKNOWN
+	}
+	return TRUTH_TRUE
+}
+
+func (t truth) or(t2 truth) truth {
+	switch {
+	case t == TRUTH_TRUE || t2 == TRUTH_TRUE:
+		return TRUTH_TRUE
+	case t == TRUTH_UNKNOWN || t2 == TRUTH_UNKNOWN:
+		return TRUTH_UNKNOWN
+	}
+	return TRUTH_FALSE
+}
+
+// Expression をコンパイルした評価器
+type evaluator interface {
+	eval(row binlog.Row) (truth, error)
+}
+
+// 演算子と値の型を検証して評価器を作る
+func compileExpression(exp Expression) (evaluator, error) {
+	switch exp.Op {
+	case OP_EQ, OP_NE, OP_LE, OP_LT, OP_GE, OP_GT:
+		left, err := compileOperand(exp.Op, exp.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := compileOperand(exp.Op, exp.Right)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkLiterals(exp.Op, left, right); err != nil {
+			return nil, err
+		}
+		return &compareEval{compareTests[exp.Op], left, right}, nil
+
+	case OP_OR, OP_AND:
+		left, err := compileSubExpression(exp.Op, exp.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := compileSubExpression(exp.Op, exp.Right)
+		if err != nil {
+			return nil, err
+		}
+		if exp.Op == OP_AND {
+			return &andEval{left, right}, nil
+		}
+		return &orEval{left, right}, nil
+
+	case OP_NOT:
+		if exp.Right != nil {
+			return nil, fmt.Errorf("%s does not take right: %v", exp.Op, exp.Right)
+		}
+		e, err := compileSubExpression(exp.Op, exp.Left)
+		if err != nil {
+			return nil, err
+		}
+		return &notEval{e}, nil
+
+	case OP_IS_NULL, OP_IS_NOT_NULL:
+		if exp.Right != nil {
+			return nil, fmt.Errorf("%s does not take right: %v", exp.Op, exp.Right)
+		}
+		left, err := compileOperand(exp.Op, exp.Left)
+		if err != nil {
+			return nil, err
+		}
+		return &isNullEval{left, exp.Op == OP_IS_NULL}, nil
+
+	case OP_IN, OP_NOT_IN, OP_BETWEEN, OP_NOT_BETWEEN:
+		return compileList(exp)
+
+	case OP_LIKE, OP_NOT_LIKE, OP_REGEXP, OP_NOT_REGEXP:
+		return compileMatch(exp)
+
+	case OP_CHANGED:
+		ref, ok := exp.Left.(string)
+		if !ok || !strings.HasPrefix(ref, "$$") || strings.Contains(ref, ".") || exp.Right != nil {
+			return nil, fmt.Errorf("%s requires a column: %v", exp.Op, exp.Left)
+		}
+		c, err := newColumnRef(ref[2:])
+		if err != nil {
+			return nil, err
+		}
+		return &changedEval{c}, nil
+	}
+	return nil, fmt.Errorf("invalid operator: %s", exp.Op)
+}
+
+func compileSubExpression(op string, v interface{}) (evaluator, error) {
+	exp, ok := v.(Expression)
+	if !ok {
+		return nil, fmt.Errorf("%s requires expressions: %#v", op, v)
+	}
+	return compileExpression(exp)
+}
+
+// $$ で始まる文字列はカラム、それ以外は値
+func compileOperand(op string, v interface{}) (operand, error) {
+	if s, ok := v.(string); ok && strings.HasPrefix(s, "$$") {
+		return newColumnRef(s[2:])
+	}
+	l, ok := literalScalar(v)
+	if !ok {
+		return nil, fmt.Errorf("%s requires a column or value: %#v", op, v)
+	}
+	return &literal{l}, nil
+}
+
+// 数値のリテラルと数値に変換できない文字列のリテラルを比較する条件はエラーにする
+// カラムの型はテーブルごとに異なるため、カラムとの比較は評価時に判定する
+func checkLiterals(op string, operands ...operand) error {
+	var num, str *literal
+	for _, o := range operands {
+		l, ok := o.(*literal)
+		if !ok {
+			continue
+		}
+		switch {
+		case l.v.kind == VALUE_INT || l.v.kind == VALUE_FLOAT:
+			num = l
+		case l.v.kind == VALUE_STRING && !l.v.numeric:
+			str = l
+		}
+	}
+	if num != nil && str != nil {
+		return fmt.Errorf("%s compares a number with a non-numeric string: %s, %q", op, num.v, str.v.s)
+	}
+	return nil
+}
+
+func compileList(exp Expression) (evaluator, error) {
+	values, ok := exp.Right.([]interface{})
+	if !ok || len(values) == 0 {
+		return nil, fmt.Errorf("%s requires a list: %#v", exp.Op, exp.Right)
+	}
+	if (exp.Op == OP_BETWEEN || exp.Op == OP_NOT_BETWEEN) && len(values) != 2 {
+		return nil, fmt.Errorf("between requires 2 values: %#v", exp.Right)
+	}
+
+	left, err := compileOperand(exp.Op, exp.Left)
+	if err != nil {
+		return nil, err
+	}
+	operands := []operand{}
+	for _, v := range values {
+		o, err := compileOperand(exp.Op, v)
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, o)
+	}
+	if err := checkLiterals(exp.Op, append([]operand{left}, operands...)...); err != nil {
+		return nil, err
+	}
+
+	if exp.Op == OP_BETWEEN || exp.Op == OP_NOT_BETWEEN {
+		return &betweenEval{left, operands[0], operands[1], exp.Op == OP_BETWEEN}, nil
+	}
+	return &inEval{left, operands, exp.Op == OP_IN}, nil
+}
+
+func compileMatch(exp Expression) (evaluator, error) {
+	left, err := compileOperand(exp.Op, exp.Left)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &matchEval{op: exp.Op, value: left, positive: exp.Op == OP_LIKE || exp.Op == OP_REGEXP}
+	switch right := exp.Right.(type) {
+	case *Pattern:
+		e.pattern = right
+	case string:
+		if strings.HasPrefix(right, "$$") {
+			// カラムの値をパターンにする場合は、その都度コンパイルする
+			if e.source, err = newColumnRef(right[2:]); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if e.pattern, err = NewPattern(exp.Op, right); err != nil {
+			return nil, err
+		}
+	case int, int64, float64:
+		l, _ := literalScalar(right)
+		if e.pattern, err = NewPattern(exp.Op, l.String()); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%s requires a pattern: %#v", exp.Op, exp.Right)
+	}
+	return e, nil
+}
+
+var compareTests = map[string]func(int) bool{
+	OP_EQ: func(c int) bool { return c == 0 },
+	OP_NE: func(c int) bool { return c != 0 },
+	OP_GE: func(c int) bool { return c >= 0 },
+	OP_GT: func(c int) bool { return c > 0 },
+	OP_LE: func(c int) bool { return c <= 0 },
+	OP_LT: func(c int) bool { return c < 0 },
+}
+
+// NULL との比較は UNKNOWN
+func compareTruth(left value, right value, test func(int) bool) truth {
+	c, ok := compareValues(left, right)
+	if !ok {
+		return TRUTH_UNKNOWN
+	}
+	return truthOf(test(c))
+}
+
+type compareEval struct {
+	test  func(int) bool
+	left  operand
+	right operand
+}
+
+func (e *compareEval) eval(row binlog.Row) (truth, error) {
+	left, err := e.left.get(row)
+	if err != nil {
+		return TRUTH_FALSE, err
+	}
+	right, err := e.right.get(row)
+	if err != nil {
+		return TRUTH_FALSE, err
+	}
+	return compareTruth(left, right, e.test), nil
+}
+
+// AND, OR は左辺で結果が決まる場合は右辺を評価しない
+type andEval struct {
+	left  evaluator
+	right evaluator
+}
+
+func (e *andEval) eval(row binlog.Row) (truth, error) {
+	left, err := e.left.eval(row)
+	if err != nil || left == TRUTH_FALSE {
+		return TRUTH_FALSE, err
+	}
+	right, err := e.right.eval(row)
+	if err != nil {
+		return TRUTH_FALSE, err
+	}
+	return left.and(right), nil
+}
+
+type orEval struct {
+	left  evaluator
+	right evaluator
+}
+
+func (e *orEval) eval(row binlog.Row) (truth, error) {
+	left, err := e.left.eval(row)
+	if err != nil || left == TRUTH_TRUE {
+		return left, err
+	}
+	right, err := e.right.eval(row)
+	if err != nil {
+		return TRUTH_FALSE, err
+	}
+	return left.or(right), nil
+}
+
+type notEval struct {
+	exp evaluator
+}
+
+func (e *notEval) eval(row binlog.Row) (truth, error) {
+	rs, err := e.exp.eval(row)
+	if err != nil {
+		return TRUTH_FALSE, err
+	}
+	return rs.not(), nil
+}
+
+type isNullEval struct {
+	value operand
+	null  bool
+}
+
+func (e *isNullEval) eval(row binlog.Row) (truth, error) {
+	v, err := e.value.get(row)
+	if err != nil {
+		return TRUTH_FALSE, err
+	}
+	return truthOf((v.kind == VALUE_NULL) == e.null), nil
+}
+
+// 一致する値が無く、リストに NULL が含まれる場合は UNKNOWN
+type inEval struct {
+	value  operand
+	values []operand
+	in     bool
+}
+
+func (e *inEval) eval(row binlog.Row) (truth, error) {
+	left, err := e.value.get(row)
+	if err != nil {
+		return TRUTH_FALSE, err
+	}
+
+	in := TRUTH_FALSE
+	for _, o := range e.values {
+		right, err := o.get(row)
+		if err != nil {
+			return TRUTH_FALSE, err
+		}
+		in = in.or(compareTruth(left, right, compareTests[OP_EQ]))
+	}
+	if !e.in {
+		return in.not(), nil
+	}
+	return in, nil
+}
+
+// value >= low AND value <= high と同じ
+type betweenEval struct {
+	value   operand
+	low     operand
+	high    operand
+	between bool
+}
+
+func (e *betweenEval) eval(row binlog.Row) (truth, error) {
+	v, err := e.value.get(row)
+	if err != nil {
+		return TRUTH_FALSE, err
+	}
+	low, err := e.low.get(row)
+	if err != nil {
+		return TRUTH_FALSE, err
+	}
+	high, err := e.high.get(row)
+	if err != nil {
+		return TRUTH_FALSE, err
+	}
+
+	between := compareTruth(v, low, compareTests[OP_GE]).and(compareTruth(v, high, compareTests[OP_LE]))
+	if !e.between {
+		return between.not(), nil
+	}
+	return between, nil
+}
+
+type matchEval struct {
+	op       string
+	value    operand
+	pattern  *Pattern
+	source   *columnRef
+	positive bool
+}
+
+func (e *matchEval) eval(row binlog.Row) (truth, error) {
+	pattern := e.pattern
+	if pattern == nil {
+		source, err := e.source.get(row)
+		if err != nil {
+			return TRUTH_FALSE, err
+		}
+		if source.kind == VALUE_NULL {
+			return TRUTH_UNKNOWN, nil
+		}
+		if pattern, err = NewPattern(e.op, source.String()); err != nil {
+			return TRUTH_FALSE, err
+		}
+	}
+
+	v, err := e.value.get(row)
+	if err != nil {
+		return TRUTH_FALSE, err
+	}
+	if v.kind == VALUE_NULL {
+		return TRUTH_UNKNOWN, nil
+	}
+	return truthOf(pattern.MatchString(v.String()) == e.positive), nil
+}
+
+// insert, delete では常に偽
+// binlog_row_image=minimal の場合、after image に含まれないカラムは変更されていない
+type changedEval struct {
+	column *columnRef
+}
+
+func (e *changedEval) eval(row binlog.Row) (truth, error) {
+	after, err := e.column.column(row)
+	if err != nil {
+		return TRUTH_FALSE, err
+	}
+	if row.BeforeRow == nil || !after.IsPresent {
+		return TRUTH_FALSE, nil
+	}
+
+	before, err := e.column.column(*row.BeforeRow)
+	if err != nil {
+		return TRUTH_FALSE, err
+	}
+	if !before.IsPresent {
+		return TRUTH_TRUE, nil
+	}
+	return truthOf(!columnEquals(before, after)), nil
+}
+
+// binlog の値が同じかどうか (binlog.Column.Equals は DECIMAL, ENUM, SET, BIT などを比較できない)
+// 数値と日時以外は、解析した文字列とエンコードされた値の両方を比較する
+// (DECIMAL, VARCHAR は文字列とエンコードされた値、CHAR は文字列、ENUM, SET, BIT, BLOB, DATETIME (v1) はエンコードされた値を持つ)
+func columnEquals(c binlog.Column, c2 binlog.Column) bool {
+	if c.IsNull || c2.IsNull {
+		return c.IsNull == c2.IsNull
+	}
+	if c.Type != c2.Type {
+		return false
+	}
+
+	switch c.Type {
+	case binlog.TYPE_LONG, binlog.TYPE_LONGLONG, binlog.TYPE_INT24, binlog.TYPE_TINY, binlog.TYPE_SHORT, binlog.TYPE_YEAR,
+		binlog.TYPE_TIME, binlog.TYPE_TIMESTAMP:
+		return c.Int() == c2.Int()
+	case binlog.TYPE_FLOAT, binlog.TYPE_DOUBLE:
+		return c.Double() == c2.Double()
+	case binlog.TYPE_DATE, binlog.TYPE_TIME2, binlog.TYPE_DATETIME2, binlog.TYPE_TIMESTAMP2:
+		return c.Time().Equal(c2.Time())
+	}
+	return c.String() == c2.String() && bytes.Equal(c.Bytes(), c2.Bytes())
+}
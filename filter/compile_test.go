@@ -0,0 +1,161 @@
+package filter
+
+import (
+	"github.com/uwork/bingo/mysql/binlog"
+	"testing"
+)
+
+func TestCompileExpression(t *testing.T) {
+	invalids := []Expression{
+		{"$$id", "==", 1},
+		{"$$id", "", nil},
+		{"$$-1", OP_EQ, 1},
+		{"$$old.-1", OP_EQ, 1},
+		{"$$", OP_EQ, 1},
+		{Expression{"$$id", OP_EQ, 1}, OP_EQ, 1},
+		{"$$id", OP_EQ, []interface{}{1}},
+		{"$$id", OP_EQ, true},
+		{"$$id", OP_AND, Expression{"$$id", OP_EQ, 1}},
+		{Expression{"$$id", OP_EQ, 1}, OP_OR, Expression{"$$id", "~", 1}},
+		{Expression{"$$id", OP_EQ, 1}, OP_NOT, 1},
+		{"$$id", OP_IN, []interface{}{}},
+		{"$$id", OP_IN, []interface{}{1, Expression{}}},
+		{"$$id", OP_NOT_BETWEEN, []interface{}{1, 2, 3}},
+		{"$$id", OP_LIKE, nil},
+		{"$$id", OP_NOT_REGEXP, []interface{}{"a"}},
+		{"$$id", OP_IS_NULL, 1},
+		{"$$old.id", OP_CHANGED, nil},
+		{1, OP_CHANGED, nil},
+
+		// 数値と、数値に変換できない文字列のリテラルの比較
+		{10, OP_EQ, "ten"},
+		{"abc", OP_LT, 1.5},
+		{"$$id", OP_IN, []interface{}{1, "paid"}},
+		{"$$id", OP_BETWEEN, []interface{}{"abc", 10}},
+		{"x", OP_NOT_BETWEEN, []interface{}{1, "$$id"}},
+	}
+	for _, exp := range invalids {
+		if _, err := compileExpression(exp); err == nil {
+			t.Errorf("invalid expression was compiled: %#v", exp)
+		}
+	}
+
+	// カラムとの比較はカラムの型によるため、評価時に判定する
+	valids := []Expression{
+		{"$$id", OP_EQ, "ten"},
+		{"9", OP_GE, 10},
+		{"$$id", OP_IN, []interface{}{1, "2", nil}},
+		{"$$id", OP_BETWEEN, []interface{}{"1", 10.5}},
+		{"$$status", OP_IN, []interface{}{"paid", "$$1"}},
+		{"$$99", OP_EQ, 1},
+	}
+	for _, exp := range valids {
+		if _, err := compileExpression(exp); err != nil {
+			t.Errorf("valid expression was not compiled: %#v (%s)", exp, err)
+		}
+	}
+}
+
+func TestCompileFilter(t *testing.T) {
+	invalids := []Filter{
+		{Database: "shop_["},
+		{Table: "/(/"},
+		{Operations: []string{"insert", "replace"}},
+		{Columns: []interface{}{-1}},
+		{Columns: []interface{}{1.5}},
+		{Columns: []interface{}{"id", ""}},
+		{Columns: []interface{}{true}},
+		{Where: Expression{"$$id", "=>", 1}},
+	}
+	for _, f := range invalids {
+		conf := FilterConfig{Filters: []Filter{f}}
+		if err := conf.Compile(); err == nil {
+			t.Errorf("invalid filter was compiled: %#v", f)
+		}
+	}
+
+	conf := FilterConfig{Excludes: []Exclude{{Database: "test_*"}}, Filters: []Filter{{Operations: []string{"Insert"}, Columns: []interface{}{float64(1), "2", "id"}}}}
+	if err := conf.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	c := conf.compiled.filters[0]
+	if !c.matchOperation(OPERATION_INSERT) || c.matchOperation(OPERATION_DELETE) {
+		t.Errorf("invalid operations: %v", c.operations)
+	}
+	if c.columns[0].index != 1 || c.columns[1].index != 2 || c.columns[2].name != "id" {
+		t.Errorf("invalid columns: %v %v %v", c.columns[0], c.columns[1], c.columns[2])
+	}
+}
+
+// カラム名で指定したカラムの位置は、テーブル定義が変わった場合は探し直す
+func TestCompiledColumnName(t *testing.T) {
+	c, err := Expression{"$$id", OP_EQ, 10}.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row := newRow(10, 20)
+	row.ColumnNames = []string{"id", "value"}
+	moved := newRow(20, 10)
+	moved.ColumnNames = []string{"value", "id"}
+	dropped := newRow(20)
+	dropped.ColumnNames = []string{"value"}
+
+	expecteds := []struct {
+		row    binlog.Row
+		result bool
+		err    bool
+	}{
+		{row, true, false},
+		{moved, true, false},
+		{row, true, false},
+		{dropped, false, true},
+	}
+	for i, s := range expecteds {
+		result, err := c.Evaluate(s.row)
+		if result != s.result || (err != nil) != s.err {
+			t.Errorf("invalid result.  index:%d expected:%v result:%v err:%v", i, s.result, result, err)
+		}
+	}
+}
+
+func benchmarkEvaluate(b *testing.B, src string, compiled bool) {
+	exp, err := ParseExpression(src)
+	if err != nil {
+		b.Fatal(err)
+	}
+	c, err := exp.Compile()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	row := newNamedRow(10, 60, 300)
+	row.Columns = append(row.Columns, binlog.NewColumn(binlog.TYPE_VARCHAR, "paid_10"))
+	row.ColumnNames = append(row.ColumnNames, "status")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if compiled {
+			_, err = c.Evaluate(row)
+		} else {
+			_, err = exp.Evaluate(row)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEvaluateColumnIndex(b *testing.B) {
+	benchmarkEvaluate(b, "$$1 >= 50 AND $$2 = 300", true)
+}
+
+func BenchmarkEvaluateColumnName(b *testing.B) {
+	benchmarkEvaluate(b, "value >= 50 AND status LIKE 'paid\\_1%' AND id NOT IN (1, 2, 3)", true)
+}
+
+// 評価のたびにコンパイルする場合 (Expression.Evaluate)
+func BenchmarkEvaluateUncompiled(b *testing.B) {
+	benchmarkEvaluate(b, "value >= 50 AND status LIKE 'paid\\_1%' AND id NOT IN (1, 2, 3)", false)
+}
@@ -1,8 +1,11 @@
 package filter
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/uwork/bingo/mysql/binlog"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -16,6 +19,32 @@ const (
 	OP_GT  = ">"
 	OP_OR  = "or"
 	OP_AND = "and"
+
+	// Left に Expression を指定する
+	OP_NOT = "not"
+
+	// Right に値の配列を指定する (BETWEEN は [下限, 上限])
+	OP_IN          = "in"
+	OP_NOT_IN      = "not in"
+	OP_BETWEEN     = "between"
+	OP_NOT_BETWEEN = "not between"
+
+	// Right にパターンを指定する (LIKE は % と _、REGEXP は Go の正規表現)
+	OP_LIKE       = "like"
+	OP_NOT_LIKE   = "not like"
+	OP_REGEXP     = "regexp"
+	OP_NOT_REGEXP = "not regexp"
+
+	// Right は使用しない
+	OP_IS_NULL     = "is null"
+	OP_IS_NOT_NULL = "is not null"
+
+	// Left にカラムを指定し、update でそのカラムの値が変更された場合に真になる
+	OP_CHANGED = "changed"
+
+	// $$old.name は update の before image、$$new.name は after image のカラムを参照する
+	COLUMN_OLD = "old"
+	COLUMN_NEW = "new"
 )
 
 type Expression struct {
@@ -28,165 +57,166 @@ func NewExpression(left interface{}, op string, right interface{}) Expression {
 	return Expression{left, op, right}
 }
 
-func (exp Expression) Evaluate(row binlog.Row) (bool, error) {
-	var result bool
-	switch exp.Op {
-	case OP_EQ, OP_NE, OP_LE, OP_LT, OP_GE, OP_GT:
-		return exp.doCompare(row)
+// 文字列 (ParseExpression) か left, op, right のオブジェクトを読み込む
+// ネストしたオブジェクトは Expression に、整数は int に、LIKE と REGEXP のパターンは Pattern に変換する
+func (exp *Expression) UnmarshalJSON(data []byte) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return err
+	}
 
-	case OP_OR, OP_AND:
+	e, err := toExpression(v)
+	if err != nil {
+		return err
+	}
+	*exp = e
+	return nil
+}
 
-		exp1, ok := exp.Left.(Expression)
-		if !ok {
-			return false, fmt.Errorf("left is not valid expression: %#v", exp.Left)
+func toExpression(v interface{}) (Expression, error) {
+	switch v := v.(type) {
+	case nil:
+		return Expression{}, nil
+	case string:
+		if len(strings.TrimSpace(v)) == 0 {
+			return Expression{}, nil
 		}
-		exp2, ok := exp.Right.(Expression)
-		if !ok {
-			return false, fmt.Errorf("right is not valid expression: %#v", exp.Right)
+		return ParseExpression(v)
+	case map[string]interface{}:
+		op, ok := v["op"].(string)
+		if !ok && v["op"] != nil {
+			return Expression{}, fmt.Errorf("invalid operator: %v", v["op"])
 		}
-
-		rs1, err := exp1.Evaluate(row)
+		left, err := toOperand(v["left"])
 		if err != nil {
-			return false, err
+			return Expression{}, err
 		}
-		rs2, err := exp2.Evaluate(row)
+		right, err := toOperand(v["right"])
 		if err != nil {
-			return false, err
+			return Expression{}, err
 		}
-
-		if exp.Op == OP_AND {
-			return rs1 && rs2, nil
-		} else {
-			return rs1 || rs2, nil
-		}
-	default:
-		return false, fmt.Errorf("invalid operator: %#v", exp)
-	}
-
-	return result, nil
-}
-
-func (exp Expression) convertVars(row binlog.Row) (interface{}, interface{}, error) {
-	left := exp.Left
-	right := exp.Right
-	if v, ok := exp.Left.(string); ok {
-		if strings.HasPrefix(v, "$$") {
-			colIndex, err := strconv.Atoi(v[2:])
-			if err != nil {
-				return nil, nil, fmt.Errorf("invalid column index: %s (%#v)", v, err)
+		if s, ok := right.(string); ok && !strings.HasPrefix(s, "$$") && isPatternOp(op) {
+			if right, err = NewPattern(op, s); err != nil {
+				return Expression{}, err
 			}
-			left = row.Columns[colIndex]
-		}
-	}
-	if v, ok := exp.Right.(string); ok {
-		if strings.HasPrefix(v, "$$") {
-			colIndex, err := strconv.Atoi(v[2:])
-			if err != nil {
-				return nil, nil, fmt.Errorf("invalid column index: %s (%#v)", v, err)
-			}
-			right = row.Columns[colIndex]
 		}
+		return Expression{left, op, right}, nil
 	}
+	return Expression{}, fmt.Errorf("invalid expression: %v", v)
+}
 
-	// right data type convert to int
-	if _, ok := left.(int); ok {
-		if _, ok := right.(int); ok {
-			// int == int
-		} else if sright, ok := right.(string); ok {
-			iright, err := strconv.Atoi(sright)
+func toOperand(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return toExpression(v)
+	case []interface{}:
+		values := []interface{}{}
+		for _, e := range v {
+			value, err := toOperand(e)
 			if err != nil {
-				return nil, nil, err
+				return nil, err
 			}
-			right = iright
-		} else if cright, ok := right.(binlog.Column); ok {
-			iright := cright.Int()
-			right = iright
-		}
-	} else if _, ok := left.(string); ok {
-		// right data type convert to string
-		if iright, ok := right.(int); ok {
-			sright := strconv.Itoa(iright)
-			right = sright
-		} else if _, ok := right.(string); ok {
-			// string == string
-		} else if cright, ok := right.(binlog.Column); ok {
-			sright := cright.String()
-			right = sright
+			values = append(values, value)
 		}
-	} else if cleft, ok := left.(binlog.Column); ok {
-		if _, ok := right.(int); ok {
-			// left data type convert to int (right data type)
-			left = cleft.Int()
-		} else if _, ok := right.(string); ok {
-			// left data type convert to string (right data type)
-			left = cleft.String()
-		} else if _, ok := right.(binlog.Column); ok {
-			// Column == Column
+		return values, nil
+	case json.Number:
+		if i, err := strconv.Atoi(string(v)); err == nil {
+			return i, nil
 		}
+		return string(v), nil
 	}
+	return v, nil
+}
 
-	return left, right, nil
+// LIKE, REGEXP のパターン (読み込み時にコンパイルしておく)
+type Pattern struct {
+	Source string
+	re     *regexp.Regexp
 }
 
-func (exp Expression) doCompare(row binlog.Row) (bool, error) {
-	left, right, err := exp.convertVars(row)
+// LIKE, REGEXP とも大文字小文字を区別する (MySQL の既定の照合順序とは異なる)
+func NewPattern(op string, source string) (*Pattern, error) {
+	expr := source
+	if op == OP_LIKE || op == OP_NOT_LIKE {
+		expr = likeToRegexp(source)
+	}
+	re, err := regexp.Compile(expr)
 	if err != nil {
-		return false, err
+		return nil, fmt.Errorf("invalid pattern: %s (%s)", source, err)
 	}
+	return &Pattern{source, re}, nil
+}
 
-	switch exp.Op {
-	case OP_EQ:
-		return isEqValues(left, right)
-	case OP_NE:
-		b, err := isEqValues(left, right)
-		return !b, err
-	case OP_GE:
-		return isGeValues(left, right)
-	case OP_GT:
-		return isGtValues(left, right)
-	case OP_LE:
-		b, err := isGtValues(left, right)
-		return !b, err
-	case OP_LT:
-		b, err := isGeValues(left, right)
-		return !b, err
-	}
+func (p *Pattern) MatchString(s string) bool {
+	return p.re.MatchString(s)
+}
 
-	return false, nil
+func (p *Pattern) String() string {
+	return p.Source
 }
 
-func isEqValues(left interface{}, right interface{}) (bool, error) {
-	if cleft, ok := left.(binlog.Column); ok {
-		cright, _ := right.(binlog.Column)
-		return cleft.Equals(cright), nil
+func (p *Pattern) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.Source)
+}
+
+// % は任意の文字列、_ は任意の 1 文字、\ はエスケープ (大文字小文字は区別する)
+func likeToRegexp(pattern string) string {
+	buf := bytes.NewBufferString("(?s)^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			buf.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			buf.WriteString(".*")
+		case r == '_':
+			buf.WriteString(".")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(r)))
+		}
 	}
-	return left == right, nil
-}
-
-func isGeValues(left interface{}, right interface{}) (bool, error) {
-	if cleft, ok := left.(binlog.Column); ok {
-		cright, _ := right.(binlog.Column)
-		return cleft.GreaterEquals(cright), nil
-	} else if ileft, ok := left.(int); ok {
-		iright, _ := right.(int)
-		return ileft >= iright, nil
-	} else if sleft, ok := left.(string); ok {
-		sright, _ := right.(string)
-		return sleft >= sright, nil
+	if escaped {
+		buf.WriteString(`\\`)
+	}
+	buf.WriteString("$")
+	return buf.String()
+}
+
+func isPatternOp(op string) bool {
+	return op == OP_LIKE || op == OP_NOT_LIKE || op == OP_REGEXP || op == OP_NOT_REGEXP
+}
+
+// 演算子と値を検証してコンパイルした条件式
+type CompiledExpression struct {
+	e evaluator
+}
+
+func (exp Expression) Compile() (*CompiledExpression, error) {
+	e, err := compileExpression(exp)
+	if err != nil {
+		return nil, err
 	}
-	return false, fmt.Errorf("unsupported type. left: %#v, right: %#v", left, right)
-}
-
-func isGtValues(left interface{}, right interface{}) (bool, error) {
-	if cleft, ok := left.(binlog.Column); ok {
-		cright, _ := right.(binlog.Column)
-		return cleft.GreaterThan(cright), nil
-	} else if ileft, ok := left.(int); ok {
-		iright, _ := right.(int)
-		return ileft > iright, nil
-	} else if sleft, ok := left.(string); ok {
-		sright, _ := right.(string)
-		return sleft > sright, nil
+	return &CompiledExpression{e}, nil
+}
+
+// NULL との比較 (=, IN, LIKE など) は NOT を付けた演算子や NOT (...) でも偽になる
+func (c *CompiledExpression) Evaluate(row binlog.Row) (bool, error) {
+	rs, err := c.e.eval(row)
+	return rs == TRUTH_TRUE, err
+}
+
+// 評価のたびにコンパイルする
+//
+// Deprecated: Expression.Compile でコンパイルした CompiledExpression.Evaluate を使用してください
+func (exp Expression) Evaluate(row binlog.Row) (bool, error) {
+	c, err := exp.Compile()
+	if err != nil {
+		return false, err
 	}
-	return false, fmt.Errorf("unsupported type. left: %#v, right: %#v", left, right)
+	return c.Evaluate(row)
 }
@@ -62,3 +62,142 @@ func TestEvalExpression(t *testing.T) {
 	checkResult(t, Expression{"$$0", OP_EQ, "$$0"}, row, true)
 	checkResult(t, Expression{"$$0", OP_EQ, "$$1"}, row, true)
 }
+
+func TestEvalExpressionColumnName(t *testing.T) {
+	row := binlog.Row{}
+	row.Columns = []binlog.Column{binlog.NewColumn(binlog.TYPE_LONG, 10), binlog.NewColumn(binlog.TYPE_STRING, "hello")}
+	row.ColumnNames = []string{"id", "name"}
+
+	checkResult(t, Expression{"$$id", OP_EQ, 10}, row, true)
+	checkResult(t, Expression{"$$name", OP_EQ, "hello"}, row, true)
+	checkResult(t, Expression{"$$name", OP_EQ, "$$1"}, row, true)
+	checkResult(t, Expression{"$$id", OP_GT, 10}, row, false)
+
+	expecteds := []Expression{
+		{"$$unknown", OP_EQ, 10},
+		{"$$2", OP_EQ, 10},
+		{10, OP_EQ, "$$-1"},
+	}
+	for _, exp := range expecteds {
+		if _, err := exp.Evaluate(row); err == nil {
+			t.Errorf("invalid column reference was accepted: %#v", exp)
+		}
+	}
+}
+
+func TestEvalExpressionJSON(t *testing.T) {
+	row := binlog.Row{}
+	row.Columns = []binlog.Column{
+		binlog.NewColumn(binlog.TYPE_JSON, `"hello"`),
+		binlog.NewColumn(binlog.TYPE_JSON, `10`),
+		binlog.NewColumn(binlog.TYPE_JSON, `{"a": 1}`),
+	}
+
+	checkResult(t, Expression{"$$0", OP_EQ, "hello"}, row, true)
+	checkResult(t, Expression{"$$1", OP_EQ, 10}, row, true)
+	checkResult(t, Expression{"$$1", OP_GT, 5}, row, true)
+	checkResult(t, Expression{"$$2", OP_EQ, `{"a": 1}`}, row, true)
+	checkResult(t, Expression{"$$2", OP_EQ, "$$2"}, row, true)
+	checkResult(t, Expression{"$$0", OP_EQ, "$$2"}, row, false)
+}
+
+func TestEvalExpressionOperators(t *testing.T) {
+	row := binlog.Row{}
+	null := binlog.NewColumn(binlog.TYPE_VARCHAR, "")
+	null.IsNull = true
+	row.Columns = []binlog.Column{
+		binlog.NewColumn(binlog.TYPE_LONG, 10),
+		binlog.NewColumn(binlog.TYPE_VARCHAR, "paid_100%"),
+		null,
+		binlog.NewColumn(binlog.TYPE_DOUBLE, 1.5),
+		binlog.NewColumn(binlog.TYPE_VARCHAR, "Tokyo\nJapan"),
+	}
+	row.ColumnNames = []string{"id", "status", "note", "rate", "address"}
+
+	like := func(pattern string) *Pattern {
+		p, err := NewPattern(OP_LIKE, pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	expecteds := []struct {
+		exp    Expression
+		result bool
+	}{
+		{Expression{"$$id", OP_IN, []interface{}{1, "10", 100}}, true},
+		{Expression{"$$id", OP_IN, []interface{}{1, 2}}, false},
+		{Expression{"$$id", OP_NOT_IN, []interface{}{1, 2}}, true},
+		{Expression{"$$status", OP_IN, []interface{}{"paid", "$$1"}}, true},
+		{Expression{"$$note", OP_IN, []interface{}{"a"}}, false},
+		{Expression{"$$note", OP_NOT_IN, []interface{}{"a"}}, false},
+
+		{Expression{"$$id", OP_BETWEEN, []interface{}{10, 20}}, true},
+		{Expression{"$$id", OP_BETWEEN, []interface{}{"1", "9"}}, false},
+		{Expression{"$$id", OP_NOT_BETWEEN, []interface{}{11, 20}}, true},
+		{Expression{"$$rate", OP_BETWEEN, []interface{}{1, "1.5"}}, true},
+		{Expression{"$$note", OP_NOT_BETWEEN, []interface{}{1, 2}}, false},
+
+		{Expression{"$$status", OP_LIKE, like("paid%")}, true},
+		{Expression{"$$status", OP_LIKE, like("PAID%")}, false},
+		{Expression{"$$status", OP_LIKE, like("pai__100\\%")}, true},
+		{Expression{"$$status", OP_LIKE, like("paid\\_1%0")}, false},
+		{Expression{"$$status", OP_NOT_LIKE, like("%100")}, true},
+		{Expression{"$$address", OP_LIKE, like("Tokyo%")}, true},
+		{Expression{"$$id", OP_LIKE, "1_"}, true},
+		{Expression{"$$note", OP_NOT_LIKE, "%"}, false},
+		{Expression{"$$status", OP_REGEXP, "^paid_[0-9]+%$"}, true},
+		{Expression{"$$status", OP_NOT_REGEXP, "unpaid"}, true},
+		{Expression{"$$status", OP_REGEXP, "^PAID"}, false},
+		{Expression{"$$status", OP_REGEXP, "(?i)^PAID"}, true},
+		{Expression{"$$status", OP_LIKE, "$$status"}, true},
+
+		{Expression{"$$note", OP_IS_NULL, nil}, true},
+		{Expression{"$$id", OP_IS_NULL, nil}, false},
+		{Expression{"$$id", OP_IS_NOT_NULL, nil}, true},
+
+		// NULL との比較は NOT を付けても偽 (UNKNOWN)
+		{Expression{"$$note", OP_EQ, ""}, false},
+		{Expression{"$$note", OP_NE, ""}, false},
+		{Expression{Expression{"$$note", OP_EQ, ""}, OP_NOT, nil}, false},
+		{Expression{Expression{Expression{"$$note", OP_LIKE, "%"}, OP_NOT, nil}, OP_NOT, nil}, false},
+		{Expression{Expression{"$$id", OP_EQ, 10}, OP_NOT, nil}, false},
+		{Expression{Expression{"$$note", OP_EQ, ""}, OP_OR, Expression{"$$id", OP_EQ, 10}}, true},
+		{Expression{Expression{Expression{"$$note", OP_EQ, ""}, OP_AND, Expression{"$$id", OP_EQ, 1}}, OP_NOT, nil}, true},
+		{Expression{Expression{Expression{"$$note", OP_EQ, ""}, OP_OR, Expression{"$$id", OP_EQ, 1}}, OP_NOT, nil}, false},
+		{Expression{"$$id", OP_IN, []interface{}{10, nil}}, true},
+		{Expression{"$$id", OP_NOT_IN, []interface{}{1, nil}}, false},
+		{Expression{"$$id", OP_NOT_BETWEEN, []interface{}{nil, 5}}, true},
+
+		// 数値と文字列
+		{Expression{"$$rate", OP_EQ, "1.50"}, true},
+		{Expression{"$$rate", OP_GT, 1}, true},
+		{Expression{"$$id", OP_GT, "9"}, true},
+		{Expression{"$$id", OP_EQ, "ten"}, false},
+		{Expression{"$$status", OP_GT, 100}, true},
+	}
+
+	for _, s := range expecteds {
+		result, err := s.exp.Evaluate(row)
+		if err != nil {
+			t.Errorf("evaluate error.  exp:%v error:%v", s.exp, err)
+			continue
+		}
+		if result != s.result {
+			t.Errorf("invalid result.  exp:%v expected:%v result:%v", s.exp, s.result, result)
+		}
+	}
+
+	invalids := []Expression{
+		{"$$id", OP_IN, 10},
+		{"$$id", OP_BETWEEN, []interface{}{1}},
+		{"$$id", OP_REGEXP, "("},
+		{10, OP_NOT, nil},
+	}
+	for _, exp := range invalids {
+		if _, err := exp.Evaluate(row); err == nil {
+			t.Errorf("invalid expression was accepted: %#v", exp)
+		}
+	}
+}
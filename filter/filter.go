@@ -2,91 +2,352 @@ package filter
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/uwork/bingo/mysql/binlog"
+	"strconv"
+	"strings"
 )
 
+const (
+	OPERATION_INSERT = "insert"
+	OPERATION_UPDATE = "update"
+	OPERATION_DELETE = "delete"
+)
+
+// Columns にはカラムの位置 (0, 1, ...) かカラム名を指定する
+// Operations には insert, update, delete を指定する (空の場合は全ての操作)
 type Filter struct {
-	Database string     `json:"database"`
-	Table    string     `json:"table"`
-	Columns  []int      `json:"columns"`
-	Where    Expression `json:"where"`
+	Database   string        `json:"database"`
+	Table      string        `json:"table"`
+	Operations []string      `json:"operations,omitempty"`
+	Columns    []interface{} `json:"columns"`
+	Where      Expression    `json:"where"`
+}
+
+// 設定を検証して、イベントごとに評価しやすい形にしたもの
+type compiledFilter struct {
+	tables     tablePattern
+	operations map[string]bool // 空の場合は全ての操作
+	columns    []*columnRef    // 空の場合は全てのカラム
+	where      evaluator       // nil の場合は全ての行
+}
+
+func compileFilter(f Filter) (*compiledFilter, error) {
+	tables, err := newTablePattern(f.Database, f.Table)
+	if err != nil {
+		return nil, err
+	}
+	c := &compiledFilter{tables: tables, operations: map[string]bool{}, columns: []*columnRef{}}
+
+	for _, o := range f.Operations {
+		op := strings.ToLower(o)
+		switch op {
+		case OPERATION_INSERT, OPERATION_UPDATE, OPERATION_DELETE:
+			c.operations[op] = true
+		default:
+			return nil, fmt.Errorf("unknown operation: %s", o)
+		}
+	}
+
+	for _, col := range f.Columns {
+		ref := &columnRef{ref: fmt.Sprint(col), index: -1}
+		switch v := col.(type) {
+		case int:
+			ref.index = v
+		case float64:
+			if v == float64(int(v)) {
+				ref.index = int(v)
+			}
+		case string:
+			if i, err := strconv.Atoi(v); err == nil {
+				ref.index = i
+			} else if 0 < len(v) {
+				ref.name = v
+			}
+		}
+		if ref.index < 0 && len(ref.name) == 0 {
+			return nil, fmt.Errorf("invalid column: %#v", col)
+		}
+		c.columns = append(c.columns, ref)
+	}
+
+	if f.Where.Op != "" {
+		if c.where, err = compileExpression(f.Where); err != nil {
+			return nil, fmt.Errorf("invalid where: %s", err)
+		}
+	}
+	return c, nil
+}
+
+func (c *compiledFilter) matchOperation(op string) bool {
+	return len(c.operations) == 0 || c.operations[op]
+}
+
+// 指定したカラムだけを取り出す (before image も同じカラムを取り出す)
+func (c *compiledFilter) project(row binlog.Row) (binlog.Row, error) {
+	if len(c.columns) == 0 {
+		return row, nil
+	}
+
+	indexes := make([]int, len(c.columns))
+	for i, ref := range c.columns {
+		index, err := ref.position(row)
+		if err != nil {
+			return row, err
+		}
+		indexes[i] = index
+	}
+	return projectRow(row, indexes), nil
 }
 
+// insert, update では after image を Columns に、update, delete では before image を Before に出力する
+// カラム名が分からない場合はカラムの位置をキーにする
 type FilteredRow struct {
-	Database string   `json:"database"`
-	Table    string   `json:"table"`
-	Columns  []string `json:"columns"`
+	Database  string                 `json:"database"`
+	Table     string                 `json:"table"`
+	Type      string                 `json:"type"`
+	Columns   map[string]interface{} `json:"columns,omitempty"`
+	Before    map[string]interface{} `json:"before,omitempty"`
+	Timestamp uint32                 `json:"timestamp"`
+	LogPos    uint32                 `json:"log_pos"`
+	ServerId  uint32                 `json:"server_id"`
+
+	// トランザクション単位で出力する場合のみ
+	Xid             uint64 `json:"xid,omitempty"`
+	GTID            string `json:"gtid,omitempty"`
+	CommitTimestamp uint32 `json:"commit_timestamp,omitempty"`
+}
+
+// JSON と同じキーの map に変換する (JSON 以外の形式で出力する場合に使う)
+func (fr FilteredRow) Map() map[string]interface{} {
+	m := map[string]interface{}{
+		"database":  fr.Database,
+		"table":     fr.Table,
+		"type":      fr.Type,
+		"timestamp": fr.Timestamp,
+		"log_pos":   fr.LogPos,
+		"server_id": fr.ServerId,
+	}
+	if 0 < len(fr.Columns) {
+		m["columns"] = fr.Columns
+	}
+	if 0 < len(fr.Before) {
+		m["before"] = fr.Before
+	}
+	if fr.Xid != 0 {
+		m["xid"] = fr.Xid
+	}
+	if 0 < len(fr.GTID) {
+		m["gtid"] = fr.GTID
+	}
+	if fr.CommitTimestamp != 0 {
+		m["commit_timestamp"] = fr.CommitTimestamp
+	}
+	return m
 }
 
-func NewFilteredRow(row binlog.Row) FilteredRow {
+func NewFilteredRow(ev *binlog.BinlogEvent, row binlog.Row) FilteredRow {
 	fr := FilteredRow{}
-	fr.Columns = []string{}
-	for _, c := range row.Columns {
-		fr.Columns = append(fr.Columns, c.String())
+	fr.Database = ev.Rows.Schema
+	fr.Table = ev.Rows.Table
+	fr.Type = Operation(ev.Header)
+	fr.Timestamp = ev.Header.Timestamp
+	fr.LogPos = ev.Header.LogPos
+	fr.ServerId = ev.Header.ServerId
+
+	switch fr.Type {
+	case OPERATION_UPDATE:
+		fr.Columns = columnValues(row)
+		if row.BeforeRow != nil {
+			fr.Before = columnValues(*row.BeforeRow)
+		}
+	case OPERATION_DELETE:
+		fr.Before = columnValues(row)
+	default:
+		fr.Columns = columnValues(row)
 	}
 	return fr
 }
 
+// カラム名と値の組 (NULL は nil, JSON カラムは JSON のまま, binlog に含まれないカラムは出力しない)
+func columnValues(row binlog.Row) map[string]interface{} {
+	values := map[string]interface{}{}
+	for i, c := range row.Columns {
+		if !c.IsPresent {
+			continue
+		}
+		if c.IsNull {
+			values[columnName(row, i)] = nil
+		} else if c.Type == binlog.TYPE_JSON {
+			values[columnName(row, i)] = json.RawMessage(c.String())
+		} else {
+			values[columnName(row, i)] = c.String()
+		}
+	}
+	return values
+}
+
+func columnName(row binlog.Row, i int) string {
+	if i < len(row.ColumnNames) {
+		return row.ColumnNames[i]
+	}
+	return strconv.Itoa(i)
+}
+
+// ROWS_EVENT の操作種別
+func Operation(h *binlog.BinlogEventHeader) string {
+	if h.IsRowsUpdateEvent() {
+		return OPERATION_UPDATE
+	} else if h.IsRowsDeleteEvent() {
+		return OPERATION_DELETE
+	}
+	return OPERATION_INSERT
+}
+
+// Filters のいずれかに一致した行を出力する (Excludes に一致したテーブルは出力しない)
+// テーブルの判定をキャッシュするので、複数の goroutine から同時に使用しないこと
 type FilterConfig struct {
-	Filters []Filter `json:"filters"`
+	Filters  []Filter  `json:"filters"`
+	Excludes []Exclude `json:"excludes,omitempty"`
+
+	compiled *compiledConfig
+	tables   map[uint64]*tableMatch
+}
+
+type compiledConfig struct {
+	filters  []*compiledFilter
+	excludes []tablePattern
+}
+
+// 演算子やカラムの指定、パターンを検証してコンパイルする
+// 設定の読み込み時に呼び出す (呼び出していない場合は最初のイベントを処理する時にコンパイルする)
+func (f *FilterConfig) Compile() error {
+	compiled := &compiledConfig{[]*compiledFilter{}, []tablePattern{}}
+	for i, filter := range f.Filters {
+		c, err := compileFilter(filter)
+		if err != nil {
+			return fmt.Errorf("filters[%d]: %s", i, err)
+		}
+		compiled.filters = append(compiled.filters, c)
+	}
+	for i, ex := range f.Excludes {
+		p, err := newTablePattern(ex.Database, ex.Table)
+		if err != nil {
+			return fmt.Errorf("excludes[%d]: %s", i, err)
+		}
+		compiled.excludes = append(compiled.excludes, p)
+	}
+
+	f.compiled = compiled
+	f.tables = nil
+	return nil
 }
 
 func (f *FilterConfig) FilterEvent(ev *binlog.BinlogEvent) ([]byte, error) {
+	frows, err := f.filterRows(ev)
+	if err != nil {
+		return nil, err
+	}
+	return marshalRows(frows)
+}
+
+// トランザクション内の全ての行を一つの配列にまとめる
+func (f *FilterConfig) FilterTransaction(tx *binlog.Transaction) ([]byte, error) {
+	frows, err := f.FilterTransactionRows(tx)
+	if err != nil {
+		return nil, err
+	}
+	return marshalRows(frows)
+}
+
+func (f *FilterConfig) FilterTransactionRows(tx *binlog.Transaction) ([]FilteredRow, error) {
+	frows := []FilteredRow{}
+	for _, ev := range tx.Events {
+		rows, err := f.filterRows(ev)
+		if err != nil {
+			return nil, err
+		}
+		for _, fr := range rows {
+			fr.Xid = tx.Xid
+			fr.GTID = tx.GTIDString()
+			fr.CommitTimestamp = tx.Timestamp
+			frows = append(frows, fr)
+		}
+	}
+	return frows, nil
+}
+
+func marshalRows(frows []FilteredRow) ([]byte, error) {
+	if 0 == len(frows) {
+		return nil, nil
+	}
+
+	bin, err := json.Marshal(frows)
+	if err != nil {
+		return nil, err
+	}
+	return bin, nil
+}
+
+func (f *FilterConfig) filterRows(ev *binlog.BinlogEvent) ([]FilteredRow, error) {
+	if f.compiled == nil {
+		if err := f.Compile(); err != nil {
+			return nil, err
+		}
+	}
+	tables := f.matchTables(ev.Rows)
+
 	rows := []binlog.Row{}
-	if 0 == len(f.Filters) {
+	if tables.all {
 		for _, row := range ev.Rows.Rows {
 			rows = append(rows, row)
 		}
 	} else {
 		// filter condition
-		for _, filter := range f.Filters {
-			if 0 < len(filter.Database) && ev.Rows.Schema != filter.Database {
-				continue
-			}
-			if 0 < len(filter.Table) && ev.Rows.Table != filter.Table {
+		op := Operation(ev.Header)
+		for _, filter := range tables.filters {
+			if !filter.matchOperation(op) {
 				continue
 			}
 
 			for _, row := range ev.Rows.Rows {
-				match := true
-				if filter.Where.Op != "" {
-					if _match, err := filter.Where.Evaluate(row); err != nil {
+				if filter.where != nil {
+					if match, err := filter.where.eval(row); err != nil {
 						return nil, err
-					} else {
-						match = _match
+					} else if match != TRUTH_TRUE {
+						continue
 					}
 				}
 
-				if match {
-					if 0 == len(filter.Columns) {
-						rows = append(rows, row)
-					} else {
-						newRow := row
-						newRow.Columns = []binlog.Column{}
-						for _, col := range filter.Columns {
-							newRow.Columns = append(newRow.Columns, row.Columns[col])
-						}
-						rows = append(rows, newRow)
-					}
+				row, err := filter.project(row)
+				if err != nil {
+					return nil, err
 				}
+				rows = append(rows, row)
 			}
 		}
 	}
 
-	if 0 < len(rows) {
-		frows := []FilteredRow{}
-		for _, row := range rows {
-			frow := NewFilteredRow(row)
-			frow.Database = ev.Rows.Schema
-			frow.Table = ev.Rows.Table
-			frows = append(frows, frow)
-		}
+	frows := []FilteredRow{}
+	for _, row := range rows {
+		frows = append(frows, NewFilteredRow(ev, row))
+	}
+	return frows, nil
+}
 
-		bin, err := json.Marshal(frows)
-		if err != nil {
-			return nil, err
-		}
-		return bin, nil
+// 指定したカラムだけを取り出す (before image も同じカラムを取り出す)
+func projectRow(row binlog.Row, columns []int) binlog.Row {
+	newRow := row
+	newRow.Columns = []binlog.Column{}
+	newRow.ColumnNames = []string{}
+	for _, col := range columns {
+		newRow.Columns = append(newRow.Columns, row.Columns[col])
+		newRow.ColumnNames = append(newRow.ColumnNames, columnName(row, col))
+	}
+
+	if row.BeforeRow != nil {
+		before := projectRow(*row.BeforeRow, columns)
+		newRow.BeforeRow = &before
 	}
-	return nil, nil
+	return newRow
 }
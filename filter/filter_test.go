@@ -0,0 +1,474 @@
+package filter
+
+import (
+	"encoding/json"
+	"github.com/uwork/bingo/mysql/binlog"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func newRow(values ...int) binlog.Row {
+	row := binlog.Row{}
+	for _, v := range values {
+		row.Columns = append(row.Columns, binlog.NewColumn(binlog.TYPE_LONG, v))
+	}
+	return row
+}
+
+func newNamedRow(values ...int) binlog.Row {
+	row := newRow(values...)
+	row.ColumnNames = []string{"id", "value", "count"}
+	return row
+}
+
+func newRowsEvent(eventType uint8, rows ...binlog.Row) *binlog.BinlogEvent {
+	ev := &binlog.BinlogEvent{}
+	ev.Header = &binlog.BinlogEventHeader{Timestamp: 1473000000, EventType: eventType, ServerId: 1, LogPos: 1234}
+	ev.Rows = &binlog.BinlogEventRows{Schema: "testdb", Table: "testtable", Rows: rows}
+	return ev
+}
+
+func TestFilterEventOperation(t *testing.T) {
+	update := newRow(1, 20, 300)
+	before := newRow(1, 10, 300)
+	update.BeforeRow = &before
+
+	namedUpdate := newNamedRow(1, 20, 300)
+	namedBefore := newNamedRow(1, 10, 300)
+	namedUpdate.BeforeRow = &namedBefore
+
+	nullRow := newNamedRow(1, 0, 300)
+	nullRow.Columns[1].IsNull = true
+	nullRow.Columns[2].IsPresent = false
+
+	jsonRow := newNamedRow(1)
+	jsonRow.Columns = append(jsonRow.Columns, binlog.NewColumn(binlog.TYPE_JSON, `{"a": [1, "x"]}`))
+
+	expecteds := []struct {
+		ev      *binlog.BinlogEvent
+		columns []interface{}
+		result  FilteredRow
+	}{
+		{newRowsEvent(binlog.BINLOG_EVENT_WRITE_ROWSv2, newRow(1, 10, 300)), nil,
+			FilteredRow{"testdb", "testtable", OPERATION_INSERT, map[string]interface{}{"0": "1", "1": "10", "2": "300"}, nil, 1473000000, 1234, 1, 0, "", 0}},
+		{newRowsEvent(binlog.BINLOG_EVENT_UPDATE_ROWSv2, update), nil,
+			FilteredRow{"testdb", "testtable", OPERATION_UPDATE, map[string]interface{}{"0": "1", "1": "20", "2": "300"}, map[string]interface{}{"0": "1", "1": "10", "2": "300"}, 1473000000, 1234, 1, 0, "", 0}},
+		{newRowsEvent(binlog.BINLOG_EVENT_UPDATE_ROWSv1, update), []interface{}{0, 1},
+			FilteredRow{"testdb", "testtable", OPERATION_UPDATE, map[string]interface{}{"0": "1", "1": "20"}, map[string]interface{}{"0": "1", "1": "10"}, 1473000000, 1234, 1, 0, "", 0}},
+		{newRowsEvent(binlog.BINLOG_EVENT_DELETE_ROWSv2, newRow(1, 20, 300)), []interface{}{float64(2)},
+			FilteredRow{"testdb", "testtable", OPERATION_DELETE, nil, map[string]interface{}{"2": "300"}, 1473000000, 1234, 1, 0, "", 0}},
+		{newRowsEvent(binlog.BINLOG_EVENT_UPDATE_ROWSv2, namedUpdate), []interface{}{"id", "value"},
+			FilteredRow{"testdb", "testtable", OPERATION_UPDATE, map[string]interface{}{"id": "1", "value": "20"}, map[string]interface{}{"id": "1", "value": "10"}, 1473000000, 1234, 1, 0, "", 0}},
+		{newRowsEvent(binlog.BINLOG_EVENT_WRITE_ROWSv2, jsonRow), nil,
+			FilteredRow{"testdb", "testtable", OPERATION_INSERT, map[string]interface{}{"id": "1", "value": map[string]interface{}{"a": []interface{}{float64(1), "x"}}}, nil, 1473000000, 1234, 1, 0, "", 0}},
+		{newRowsEvent(binlog.BINLOG_EVENT_WRITE_ROWSv2, nullRow), nil,
+			FilteredRow{"testdb", "testtable", OPERATION_INSERT, map[string]interface{}{"id": "1", "value": nil}, nil, 1473000000, 1234, 1, 0, "", 0}},
+	}
+
+	for _, s := range expecteds {
+		conf := FilterConfig{}
+		if s.columns != nil {
+			conf.Filters = []Filter{{Database: "testdb", Columns: s.columns}}
+		}
+
+		data, err := conf.FilterEvent(s.ev)
+		if err != nil {
+			t.Errorf("filter error: %v", err)
+			continue
+		}
+
+		frows := []FilteredRow{}
+		if err := json.Unmarshal(data, &frows); err != nil {
+			t.Errorf("invalid json: %v", err)
+			continue
+		}
+		if len(frows) != 1 || !reflect.DeepEqual(s.result, frows[0]) {
+			t.Errorf("invalid filtered row.  expected:%#v rows:%#v", s.result, frows)
+		}
+	}
+}
+
+func TestFilterEventColumnName(t *testing.T) {
+	ev := newRowsEvent(binlog.BINLOG_EVENT_WRITE_ROWSv2, newNamedRow(1, 10, 300), newNamedRow(2, 20, 300))
+
+	expecteds := []struct {
+		filter Filter
+		ids    []string
+		err    bool
+	}{
+		{Filter{Database: "testdb", Where: NewExpression("$$value", OP_GT, 10)}, []string{"2"}, false},
+		{Filter{Database: "testdb", Columns: []interface{}{"id"}, Where: NewExpression("$$count", OP_EQ, 300)}, []string{"1", "2"}, false},
+		{Filter{Database: "testdb", Columns: []interface{}{"unknown"}}, nil, true},
+		{Filter{Database: "testdb", Where: NewExpression("$$unknown", OP_EQ, 1)}, nil, true},
+	}
+
+	for _, s := range expecteds {
+		conf := FilterConfig{Filters: []Filter{s.filter}}
+		data, err := conf.FilterEvent(ev)
+		if (err != nil) != s.err {
+			t.Errorf("invalid error.  expected:%v err:%v", s.err, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		frows := []FilteredRow{}
+		if err := json.Unmarshal(data, &frows); err != nil {
+			t.Errorf("invalid json: %v", err)
+			continue
+		}
+		ids := []string{}
+		for _, fr := range frows {
+			ids = append(ids, fr.Columns["id"].(string))
+		}
+		if !reflect.DeepEqual(s.ids, ids) {
+			t.Errorf("invalid filtered rows.  expected:%v ids:%v", s.ids, ids)
+		}
+	}
+}
+
+func TestFilterEventUpdate(t *testing.T) {
+	// value だけを変更した update と、count だけを変更した update
+	valueUpdate := newNamedRow(1, 20, 300)
+	valueBefore := newNamedRow(1, 10, 300)
+	valueUpdate.BeforeRow = &valueBefore
+
+	countUpdate := newNamedRow(2, 20, 400)
+	countBefore := newNamedRow(2, 20, 300)
+	countUpdate.BeforeRow = &countBefore
+
+	// binlog_row_image=minimal (after image には変更したカラムのみ)
+	minimalUpdate := newNamedRow(3, 0, 500)
+	minimalUpdate.Columns[1].IsPresent = false
+	minimalBefore := newNamedRow(3, 0, 0)
+	minimalBefore.Columns[1].IsPresent = false
+	minimalBefore.Columns[2].IsPresent = false
+	minimalUpdate.BeforeRow = &minimalBefore
+
+	events := []*binlog.BinlogEvent{
+		newRowsEvent(binlog.BINLOG_EVENT_WRITE_ROWSv2, newNamedRow(4, 10, 300)),
+		newRowsEvent(binlog.BINLOG_EVENT_UPDATE_ROWSv2, valueUpdate, countUpdate, minimalUpdate),
+		newRowsEvent(binlog.BINLOG_EVENT_DELETE_ROWSv2, newNamedRow(5, 10, 300)),
+	}
+
+	where := func(src string) Expression {
+		exp, err := ParseExpression(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exp
+	}
+
+	expecteds := []struct {
+		filter Filter
+		ids    []string
+	}{
+		{Filter{Operations: []string{OPERATION_DELETE}}, []string{"5"}},
+		{Filter{Operations: []string{"INSERT", OPERATION_UPDATE}}, []string{"4", "1", "2", "3"}},
+		{Filter{Where: where("changed(value)")}, []string{"1"}},
+		{Filter{Where: where("changed(count)")}, []string{"2", "3"}},
+		{Filter{Where: where("NOT changed($$1)")}, []string{"4", "2", "3", "5"}},
+		{Filter{Where: where("old.value != new.value")}, []string{"1"}},
+		{Filter{Where: where("old.count < $$new.count AND new.count <= 400")}, []string{"2"}},
+		{Filter{Where: where("old.count = 300")}, []string{"4", "1", "2", "5"}},
+		{Filter{Operations: []string{OPERATION_UPDATE}, Where: where("old.`value` = 10 or changed(`count`)")}, []string{"1", "2", "3"}},
+	}
+
+	for _, s := range expecteds {
+		conf := FilterConfig{Filters: []Filter{s.filter}}
+		ids := []string{}
+		for _, ev := range events {
+			frows, err := conf.filterRows(ev)
+			if err != nil {
+				t.Errorf("filter error.  filter:%v error:%v", s.filter, err)
+				continue
+			}
+			for _, fr := range frows {
+				if fr.Type == OPERATION_DELETE {
+					ids = append(ids, fr.Before["id"].(string))
+				} else {
+					ids = append(ids, fr.Columns["id"].(string))
+				}
+			}
+		}
+		if !reflect.DeepEqual(s.ids, ids) {
+			t.Errorf("invalid filtered rows.  filter:%v expected:%v ids:%v", s.filter, s.ids, ids)
+		}
+	}
+
+	conf := FilterConfig{Filters: []Filter{{Operations: []string{"upsert"}}}}
+	if _, err := conf.filterRows(events[0]); err == nil {
+		t.Errorf("invalid pattern. unknown operation was accepted")
+	}
+}
+
+func makeEvent(evType byte, body []byte) []byte {
+	size := 19 + len(body)
+	data := []byte{
+		0, 0, 0, 0, // timestamp
+		evType,
+		1, 0, 0, 0, // server id
+		byte(size), byte(size >> 8), byte(size >> 16), byte(size >> 24),
+		0, 0, 0, 0, // log pos
+		0, 0, // flags
+	}
+	return append(data, body...)
+}
+
+// testdb.items (id int, amount decimal(10,2), status enum, flags bit(8), updated datetime (5.5 形式)) の update を解析する
+// rows は before, after の順に (id, amount の整数部, status, flags, updated)
+func parseUpdateRows(t *testing.T, rows ...[]int) *binlog.BinlogEvent {
+	p := &binlog.BinlogParser{TableMaps: map[uint64]*binlog.BinlogEventTableMap{}}
+
+	fd := []byte{4, 0}
+	fd = append(fd, make([]byte, 50)...)
+	fd = append(fd, 0, 0, 0, 0, 19)
+	fd = append(fd, 0x38, 0xd, 0x0, 0x8, 0x0, 0x12, 0x0, 0x4, 0x4, 0x4, 0x4, 0x12, 0x0, 0x0, 0x5f, 0x0, 0x4, 0x1a, 0x8, 0x0,
+		0x0, 0x0, 0x8, 0x8, 0x8, 0x2, 0x0, 0x0, 0x0, 0xa, 0xa, 0xa, 0x2a, 0x2a, 0x0, 0x12, 0x34, 0x0)
+	fd = append(fd, binlog.BINLOG_CHECKSUM_ALG_OFF)
+
+	tableMap := []byte{1, 0, 0, 0, 0, 0, 1, 0, 6}
+	tableMap = append(tableMap, []byte("testdb")...)
+	tableMap = append(tableMap, 0, 5)
+	tableMap = append(tableMap, []byte("items")...)
+	tableMap = append(tableMap, 0, 5, binlog.TYPE_LONG, binlog.TYPE_NEWDECIMAL, binlog.TYPE_STRING, binlog.TYPE_BIT, binlog.TYPE_DATETIME)
+	tableMap = append(tableMap, 6, 10, 2, binlog.TYPE_ENUM, 1, 0, 1, 0)
+
+	body := []byte{1, 0, 0, 0, 0, 0, 1, 0, 2, 0, 5, 0x1f, 0x1f}
+	for _, row := range rows {
+		body = append(body, 0)
+		body = append(body, byte(row[0]), byte(row[0]>>8), byte(row[0]>>16), byte(row[0]>>24))
+		body = append(body, 0x80, 0, 0, byte(row[1]), 0)
+		body = append(body, byte(row[2]), byte(row[3]))
+		body = append(body, byte(row[4]), 0, 0, 0, 0, 0, 0, 0)
+	}
+
+	var ev *binlog.BinlogEvent
+	for _, data := range [][]byte{
+		makeEvent(binlog.BINLOG_EVENT_FORMAT_DESCRIPTION, fd),
+		makeEvent(binlog.BINLOG_EVENT_TABLE_MAP, tableMap),
+		makeEvent(binlog.BINLOG_EVENT_UPDATE_ROWSv2, body),
+	} {
+		var err error
+		if ev, _, err = p.ParseBinlogEvent(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range ev.Rows.Rows {
+		ev.Rows.Rows[i].ColumnNames = []string{"id", "amount", "status", "flags", "updated"}
+		ev.Rows.Rows[i].BeforeRow.ColumnNames = ev.Rows.Rows[i].ColumnNames
+	}
+	return ev
+}
+
+// changed() は DECIMAL, ENUM, BIT, DATETIME (5.5 形式) のカラムも値で比較する
+func TestFilterEventChangedTypes(t *testing.T) {
+	ev := parseUpdateRows(t,
+		[]int{1, 1, 1, 1, 1}, []int{1, 2, 1, 1, 1},
+		[]int{2, 1, 1, 1, 1}, []int{2, 1, 2, 1, 1},
+		[]int{3, 1, 1, 1, 1}, []int{3, 1, 1, 3, 1},
+		[]int{4, 1, 1, 1, 1}, []int{4, 1, 1, 1, 2},
+		[]int{5, 1, 1, 1, 1}, []int{5, 1, 1, 1, 1},
+	)
+
+	expecteds := []struct {
+		column string
+		ids    []string
+	}{
+		{"amount", []string{"1"}},
+		{"status", []string{"2"}},
+		{"flags", []string{"3"}},
+		{"updated", []string{"4"}},
+	}
+	for _, s := range expecteds {
+		where, err := ParseExpression("changed(" + s.column + ")")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf := FilterConfig{Filters: []Filter{{Where: where}}}
+		frows, err := conf.filterRows(ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids := []string{}
+		for _, fr := range frows {
+			ids = append(ids, fr.Columns["id"].(string))
+		}
+		if !reflect.DeepEqual(s.ids, ids) {
+			t.Errorf("invalid changed rows.  column:%v expected:%v ids:%v", s.column, s.ids, ids)
+		}
+	}
+}
+
+func TestFilterEventTable(t *testing.T) {
+	newTableEvent := func(tableId uint64, schema string, table string) *binlog.BinlogEvent {
+		ev := newRowsEvent(binlog.BINLOG_EVENT_WRITE_ROWSv2, newNamedRow(1, 10, 300))
+		ev.Rows.TableId = tableId
+		ev.Rows.Schema = schema
+		ev.Rows.Table = table
+		return ev
+	}
+	events := []*binlog.BinlogEvent{
+		newTableEvent(1, "shop_001", "orders_201609"),
+		newTableEvent(2, "shop_002", "orders_201610"),
+		newTableEvent(3, "shop_256", "orders_tmp"),
+		newTableEvent(4, "shop_master", "orders"),
+		newTableEvent(5, "testdb", "testtable"),
+	}
+
+	expecteds := []struct {
+		conf   FilterConfig
+		tables []string
+	}{
+		{FilterConfig{Filters: []Filter{{Database: "shop_*"}}}, []string{"orders_201609", "orders_201610", "orders_tmp", "orders"}},
+		{FilterConfig{Filters: []Filter{{Database: "shop_???", Table: "orders_[0-9]*"}}}, []string{"orders_201609", "orders_201610"}},
+		{FilterConfig{Filters: []Filter{{Database: `/shop_\d+/`, Table: "orders_2016(09|10)"}}}, []string{}},
+		{FilterConfig{Filters: []Filter{{Database: `/shop_\d+/`, Table: "/orders_2016(09|10)/"}}}, []string{"orders_201609", "orders_201610"}},
+		{FilterConfig{Filters: []Filter{{Table: "/orders/"}}}, []string{"orders"}},
+		{FilterConfig{Filters: []Filter{{Database: "shop_*"}}, Excludes: []Exclude{{Table: "*_tmp"}, {Database: "shop_master"}}}, []string{"orders_201609", "orders_201610"}},
+		{FilterConfig{Excludes: []Exclude{{Database: "/shop_.*/"}}}, []string{"testtable"}},
+		{FilterConfig{Filters: []Filter{{Database: "testdb"}}, Excludes: []Exclude{{Database: "testdb", Table: "testtable"}}}, []string{}},
+	}
+
+	for _, s := range expecteds {
+		tables := []string{}
+		for _, ev := range events {
+			frows, err := s.conf.filterRows(ev)
+			if err != nil {
+				t.Errorf("filter error.  conf:%v error:%v", s.conf, err)
+				continue
+			}
+			for _, fr := range frows {
+				tables = append(tables, fr.Table)
+			}
+		}
+		if !reflect.DeepEqual(s.tables, tables) {
+			t.Errorf("invalid filtered tables.  conf:%v expected:%v tables:%v", s.conf, s.tables, tables)
+		}
+	}
+
+	// テーブルの判定は TableId ごとにキャッシュし、TableId が別のテーブルに割り当てられた場合は判定し直す
+	conf := FilterConfig{Filters: []Filter{{Database: "shop_*"}, {Database: "testdb"}}}
+	conf.filterRows(events[0])
+	cached := conf.tables[1]
+	if frows, _ := conf.filterRows(events[0]); len(frows) != 1 || conf.tables[1] != cached {
+		t.Errorf("invalid cached match: %v", frows)
+	}
+	if frows, _ := conf.filterRows(newTableEvent(1, "testdb", "testtable")); len(frows) != 1 || conf.tables[1] == cached || conf.tables[1].filters[0] != conf.compiled.filters[1] {
+		t.Errorf("invalid reassigned table id: %v", frows)
+	}
+
+	// パターンの誤り
+	for _, pattern := range []string{"shop_[", "/shop_(/"} {
+		conf := FilterConfig{Filters: []Filter{{Database: pattern}}}
+		if _, err := conf.filterRows(events[0]); err == nil {
+			t.Errorf("invalid pattern. %s was accepted", pattern)
+		}
+		conf = FilterConfig{Excludes: []Exclude{{Table: pattern}}}
+		if _, err := conf.filterRows(events[0]); err == nil {
+			t.Errorf("invalid pattern. %s was accepted", pattern)
+		}
+	}
+}
+
+func TestFilterTransaction(t *testing.T) {
+	tx := &binlog.Transaction{
+		GTID:      &binlog.BinlogEventGTID{SID: "3e11fa47-71ca-11e1-9e33-c80aa9429562", GNO: 23},
+		Xid:       100,
+		Timestamp: 1473000010,
+		Events: []*binlog.BinlogEvent{
+			newRowsEvent(binlog.BINLOG_EVENT_WRITE_ROWSv2, newNamedRow(1, 10, 300), newNamedRow(2, 20, 300)),
+			newRowsEvent(binlog.BINLOG_EVENT_DELETE_ROWSv2, newNamedRow(3, 30, 300)),
+		},
+	}
+
+	conf := FilterConfig{Filters: []Filter{{Database: "testdb", Columns: []interface{}{"id"}, Where: NewExpression("$$id", OP_NE, 2)}}}
+	data, err := conf.FilterTransaction(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frows := []FilteredRow{}
+	if err := json.Unmarshal(data, &frows); err != nil {
+		t.Fatal(err)
+	}
+	expecteds := []FilteredRow{
+		{"testdb", "testtable", OPERATION_INSERT, map[string]interface{}{"id": "1"}, nil, 1473000000, 1234, 1, 100, "3e11fa47-71ca-11e1-9e33-c80aa9429562:23", 1473000010},
+		{"testdb", "testtable", OPERATION_DELETE, nil, map[string]interface{}{"id": "3"}, 1473000000, 1234, 1, 100, "3e11fa47-71ca-11e1-9e33-c80aa9429562:23", 1473000010},
+	}
+	if !reflect.DeepEqual(expecteds, frows) {
+		t.Errorf("invalid filtered rows.  expected:%#v rows:%#v", expecteds, frows)
+	}
+
+	// 全ての行がフィルタされた場合は出力しない
+	conf = FilterConfig{Filters: []Filter{{Database: "otherdb"}}}
+	if data, err := conf.FilterTransaction(tx); data != nil || err != nil {
+		t.Errorf("invalid filtered data: %s %v", data, err)
+	}
+}
+
+func TestFilteredRowMap(t *testing.T) {
+	expecteds := []FilteredRow{
+		{"testdb", "testtable", OPERATION_INSERT, map[string]interface{}{"id": "1"}, nil, 1473000000, 1234, 1, 0, "", 0},
+		{"testdb", "testtable", OPERATION_UPDATE, map[string]interface{}{"id": "1"}, map[string]interface{}{"id": "2"}, 1473000000, 1234, 1, 100, "3e11fa47-71ca-11e1-9e33-c80aa9429562:23", 1473000010},
+	}
+
+	for _, fr := range expecteds {
+		data, err := json.Marshal(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]interface{}{}
+		if err := json.Unmarshal(data, &expected); err != nil {
+			t.Fatal(err)
+		}
+
+		m := fr.Map()
+		if len(expected) != len(m) {
+			t.Errorf("invalid map.  expected:%v map:%v", expected, m)
+		}
+		for k := range expected {
+			if _, ok := m[k]; !ok {
+				t.Errorf("invalid map.  expected key:%v map:%v", k, m)
+			}
+		}
+	}
+}
+
+// 1 イベントに 1000 行を含む、大量の行イベントのストリーム
+func benchmarkFilterEvent(b *testing.B, conf FilterConfig) {
+	rows := []binlog.Row{}
+	for i := 0; i < 1000; i++ {
+		row := newRow(i, i%100, 300)
+		row.Columns = append(row.Columns, binlog.NewColumn(binlog.TYPE_VARCHAR, "paid_"+strconv.Itoa(i)))
+		row.ColumnNames = []string{"id", "value", "count", "status"}
+		rows = append(rows, row)
+	}
+	ev := newRowsEvent(binlog.BINLOG_EVENT_WRITE_ROWSv2, rows...)
+	ev.Rows.Schema = "shop_001"
+	ev.Rows.Table = "orders"
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += len(rows) {
+		if _, err := conf.filterRows(ev); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFilterEvent(b *testing.B) {
+	benchmarkFilterEvent(b, FilterConfig{Filters: []Filter{{Database: "shop_*", Table: "orders"}}})
+}
+
+func BenchmarkFilterEventColumnIndex(b *testing.B) {
+	where, _ := ParseExpression("$$1 >= 50 AND $$2 = 300")
+	benchmarkFilterEvent(b, FilterConfig{Filters: []Filter{{Database: "shop_*", Table: "orders", Where: where}}})
+}
+
+func BenchmarkFilterEventColumnName(b *testing.B) {
+	where, _ := ParseExpression("value >= 50 AND status LIKE 'paid\\_1%' AND id NOT IN (1, 2, 3)")
+	benchmarkFilterEvent(b, FilterConfig{Filters: []Filter{{Database: "shop_*", Table: "orders", Columns: []interface{}{"id", "status"}, Where: where}}})
+}
@@ -0,0 +1,570 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// 文字列の条件式の構文エラー (行、列は 1 から数える)
+type SyntaxError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// SQL の WHERE 句のような文字列を Expression に変換する (例: id > 10 AND (status = 'paid' OR amount >= 100))
+// カラムはカラム名 (`name` も可) か $$0, $$name で指定し、文字列は '...' か "..." で囲む
+// NOT, AND, OR の順に優先し、整数以外の数値は文字列として扱う
+// 比較演算子の他に IN, BETWEEN, LIKE, REGEXP (RLIKE), IS NULL と、それぞれの NOT を使える
+func ParseExpression(src string) (Expression, error) {
+	p := &parser{lexer: &lexer{src: []rune(src), line: 1, column: 1}}
+	if err := p.advance(); err != nil {
+		return Expression{}, err
+	}
+
+	exp, err := p.parseOr()
+	if err != nil {
+		return Expression{}, err
+	}
+	if p.tok.typ != tokenEOF {
+		return Expression{}, p.errorf("unexpected %s", p.tok)
+	}
+	return exp, nil
+}
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdent
+	tokenColumn
+	tokenString
+	tokenNumber
+	tokenOp
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+type token struct {
+	typ    tokenType
+	value  string
+	line   int
+	column int
+}
+
+func (t token) String() string {
+	switch t.typ {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(t.value)
+	}
+	return fmt.Sprintf("%q", t.value)
+}
+
+// 比較演算子 (<> は != と同じ)
+var comparisonOps = map[string]string{
+	"=":  OP_EQ,
+	"!=": OP_NE,
+	"<>": OP_NE,
+	"<":  OP_LT,
+	"<=": OP_LE,
+	">":  OP_GT,
+	">=": OP_GE,
+}
+
+// カラム名として使う場合は `...` で囲む
+var keywords = map[string]bool{
+	"and":     true,
+	"or":      true,
+	"not":     true,
+	"in":      true,
+	"between": true,
+	"like":    true,
+	"regexp":  true,
+	"rlike":   true,
+	"is":      true,
+	"null":    true,
+}
+
+type lexer struct {
+	src    []rune
+	pos    int
+	line   int
+	column int
+}
+
+func (l *lexer) peek(n int) rune {
+	if len(l.src) <= l.pos+n {
+		return 0
+	}
+	return l.src[l.pos+n]
+}
+
+func (l *lexer) read() rune {
+	r := l.src[l.pos]
+	l.pos++
+	if r == '\n' {
+		l.line++
+		l.column = 1
+	} else {
+		l.column++
+	}
+	return r
+}
+
+func (l *lexer) errorf(line int, column int, format string, args ...interface{}) error {
+	return &SyntaxError{line, column, fmt.Sprintf(format, args...)}
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) && unicode.IsSpace(l.peek(0)) {
+		l.read()
+	}
+
+	tok := token{line: l.line, column: l.column}
+	if len(l.src) <= l.pos {
+		tok.typ = tokenEOF
+		return tok, nil
+	}
+
+	r := l.peek(0)
+	switch {
+	case r == '(':
+		l.read()
+		tok.typ, tok.value = tokenLParen, "("
+	case r == ')':
+		l.read()
+		tok.typ, tok.value = tokenRParen, ")"
+	case r == ',':
+		l.read()
+		tok.typ, tok.value = tokenComma, ","
+
+	case r == '\'' || r == '"':
+		value, err := l.readQuoted(r)
+		if err != nil {
+			return tok, err
+		}
+		tok.typ, tok.value = tokenString, value
+
+	case r == '`':
+		value, err := l.readQuoted(r)
+		if err != nil {
+			return tok, err
+		}
+		tok.typ, tok.value = tokenColumn, value
+
+	case r == '$' && l.peek(1) == '$':
+		l.read()
+		l.read()
+		tok.typ, tok.value = tokenColumn, l.readWhile(isIdentRune)
+		if len(tok.value) == 0 {
+			return tok, l.errorf(tok.line, tok.column, "column name or index is required after $$")
+		}
+		if err := l.readImageColumn(&tok); err != nil {
+			return tok, err
+		}
+
+	case unicode.IsDigit(r) || (r == '-' && unicode.IsDigit(l.peek(1))):
+		l.read()
+		tok.typ, tok.value = tokenNumber, string(r)+l.readWhile(func(r rune) bool {
+			return unicode.IsDigit(r) || r == '.'
+		})
+
+	case isIdentRune(r):
+		tok.typ, tok.value = tokenIdent, l.readWhile(isIdentRune)
+		if err := l.readImageColumn(&tok); err != nil {
+			return tok, err
+		}
+
+	case strings.ContainsRune("=!<>", r):
+		op := string(l.read())
+		if two := op + string(l.peek(0)); comparisonOps[two] != "" {
+			l.read()
+			op = two
+		}
+		if comparisonOps[op] == "" {
+			return tok, l.errorf(tok.line, tok.column, "invalid operator %q", op)
+		}
+		tok.typ, tok.value = tokenOp, op
+
+	default:
+		return tok, l.errorf(tok.line, tok.column, "unexpected character %q", r)
+	}
+	return tok, nil
+}
+
+// old.name, new.name (`name`, $$old.name も可) を一つのカラムとして読み込む
+func (l *lexer) readImageColumn(tok *token) error {
+	image := strings.ToLower(tok.value)
+	if (image != COLUMN_OLD && image != COLUMN_NEW) || l.peek(0) != '.' {
+		return nil
+	}
+	l.read()
+
+	name := ""
+	if l.peek(0) == '`' {
+		var err error
+		if name, err = l.readQuoted('`'); err != nil {
+			return err
+		}
+	} else {
+		name = l.readWhile(isIdentRune)
+	}
+	if len(name) == 0 {
+		return l.errorf(l.line, l.column, "column name is required after %s.", tok.value)
+	}
+
+	tok.typ, tok.value = tokenColumn, image+"."+name
+	return nil
+}
+
+// 囲み文字を 2 つ続けるか \ でエスケープする
+func (l *lexer) readQuoted(quote rune) (string, error) {
+	line, column := l.line, l.column
+	l.read()
+
+	value := []rune{}
+	for l.pos < len(l.src) {
+		r := l.read()
+		switch {
+		case r == quote && l.peek(0) == quote:
+			l.read()
+		case r == quote:
+			return string(value), nil
+		case r == '\\' && quote != '`' && l.pos < len(l.src):
+			r = l.read()
+			switch r {
+			case 'n':
+				r = '\n'
+			case 't':
+				r = '\t'
+			case '%', '_':
+				// MySQL と同様に \% \_ は \ を残し、LIKE のパターンではエスケープとして扱う
+				value = append(value, '\\')
+			}
+		}
+		value = append(value, r)
+	}
+	return "", l.errorf(line, column, "unterminated quoted string")
+}
+
+func (l *lexer) readWhile(f func(rune) bool) string {
+	start := l.pos
+	for l.pos < len(l.src) && f(l.peek(0)) {
+		l.read()
+	}
+	return string(l.src[start:l.pos])
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// or := and (OR and)*
+// and := primary (AND primary)*
+// primary := NOT primary | '(' or ')' | CHANGED '(' column ')' | operand predicate
+// predicate := op operand | IS [NOT] NULL | [NOT] IN '(' operand, ... ')'
+// predicate := [NOT] BETWEEN operand AND operand | [NOT] LIKE operand | [NOT] REGEXP operand
+type parser struct {
+	lexer *lexer
+	tok   token
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{p.tok.line, p.tok.column, fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) isKeyword(keyword string) bool {
+	return p.tok.typ == tokenIdent && strings.EqualFold(p.tok.value, keyword)
+}
+
+func (p *parser) parseOr() (Expression, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return Expression{}, err
+	}
+	for p.isKeyword(OP_OR) {
+		if err := p.advance(); err != nil {
+			return Expression{}, err
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return Expression{}, err
+		}
+		left = Expression{left, OP_OR, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Expression, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return Expression{}, err
+	}
+	for p.isKeyword(OP_AND) {
+		if err := p.advance(); err != nil {
+			return Expression{}, err
+		}
+		right, err := p.parsePrimary()
+		if err != nil {
+			return Expression{}, err
+		}
+		left = Expression{left, OP_AND, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parsePrimary() (Expression, error) {
+	if p.isKeyword(OP_NOT) {
+		if err := p.advance(); err != nil {
+			return Expression{}, err
+		}
+		exp, err := p.parsePrimary()
+		if err != nil {
+			return Expression{}, err
+		}
+		return Expression{exp, OP_NOT, nil}, nil
+	}
+
+	if p.tok.typ == tokenLParen {
+		if err := p.advance(); err != nil {
+			return Expression{}, err
+		}
+		exp, err := p.parseOr()
+		if err != nil {
+			return Expression{}, err
+		}
+		if p.tok.typ != tokenRParen {
+			return Expression{}, p.errorf("unexpected %s, expected \")\"", p.tok)
+		}
+		return exp, p.advance()
+	}
+
+	// changed 以外に changed という名前のカラムも使える
+	var left interface{}
+	if p.isKeyword(OP_CHANGED) {
+		tok := p.tok
+		if err := p.advance(); err != nil {
+			return Expression{}, err
+		}
+		if p.tok.typ == tokenLParen {
+			return p.parseChanged()
+		}
+		left = "$$" + tok.value
+	} else {
+		var err error
+		if left, err = p.parseOperand(); err != nil {
+			return Expression{}, err
+		}
+	}
+	return p.parsePredicate(left)
+}
+
+func (p *parser) parseChanged() (Expression, error) {
+	if err := p.advance(); err != nil {
+		return Expression{}, err
+	}
+
+	tok := p.tok
+	column, err := p.parseOperand()
+	if err != nil {
+		return Expression{}, err
+	}
+	// old., new. は付けられない
+	name, ok := column.(string)
+	if !ok || tok.typ == tokenString || strings.Contains(name, ".") {
+		return Expression{}, &SyntaxError{tok.line, tok.column, fmt.Sprintf("unexpected %s, expected column", tok)}
+	}
+
+	if p.tok.typ != tokenRParen {
+		return Expression{}, p.errorf("unexpected %s, expected \")\"", p.tok)
+	}
+	return Expression{column, OP_CHANGED, nil}, p.advance()
+}
+
+func (p *parser) parsePredicate(left interface{}) (Expression, error) {
+	if p.tok.typ == tokenOp {
+		op := comparisonOps[p.tok.value]
+		if err := p.advance(); err != nil {
+			return Expression{}, err
+		}
+
+		right, err := p.parseOperand()
+		if err != nil {
+			return Expression{}, err
+		}
+		return Expression{left, op, right}, nil
+	}
+
+	if p.isKeyword("is") {
+		return p.parseIsNull(left)
+	}
+
+	not := p.isKeyword(OP_NOT)
+	if not {
+		if err := p.advance(); err != nil {
+			return Expression{}, err
+		}
+	}
+
+	var exp Expression
+	var err error
+	switch {
+	case p.isKeyword(OP_IN):
+		exp, err = p.parseIn(left)
+	case p.isKeyword(OP_BETWEEN):
+		exp, err = p.parseBetween(left)
+	case p.isKeyword(OP_LIKE), p.isKeyword(OP_REGEXP), p.isKeyword("rlike"):
+		exp, err = p.parseMatch(left)
+	default:
+		return Expression{}, p.errorf("unexpected %s, expected comparison operator", p.tok)
+	}
+	if err != nil {
+		return Expression{}, err
+	}
+
+	if not {
+		exp.Op = "not " + exp.Op
+	}
+	return exp, nil
+}
+
+func (p *parser) parseIsNull(left interface{}) (Expression, error) {
+	if err := p.advance(); err != nil {
+		return Expression{}, err
+	}
+	op := OP_IS_NULL
+	if p.isKeyword(OP_NOT) {
+		op = OP_IS_NOT_NULL
+		if err := p.advance(); err != nil {
+			return Expression{}, err
+		}
+	}
+	if !p.isKeyword("null") {
+		return Expression{}, p.errorf("unexpected %s, expected NULL", p.tok)
+	}
+	return Expression{left, op, nil}, p.advance()
+}
+
+func (p *parser) parseIn(left interface{}) (Expression, error) {
+	if err := p.advance(); err != nil {
+		return Expression{}, err
+	}
+	if p.tok.typ != tokenLParen {
+		return Expression{}, p.errorf("unexpected %s, expected \"(\"", p.tok)
+	}
+
+	values := []interface{}{}
+	for {
+		if err := p.advance(); err != nil {
+			return Expression{}, err
+		}
+		value, err := p.parseOperand()
+		if err != nil {
+			return Expression{}, err
+		}
+		values = append(values, value)
+
+		if p.tok.typ == tokenRParen {
+			break
+		}
+		if p.tok.typ != tokenComma {
+			return Expression{}, p.errorf("unexpected %s, expected \",\" or \")\"", p.tok)
+		}
+	}
+	return Expression{left, OP_IN, values}, p.advance()
+}
+
+func (p *parser) parseBetween(left interface{}) (Expression, error) {
+	if err := p.advance(); err != nil {
+		return Expression{}, err
+	}
+	low, err := p.parseOperand()
+	if err != nil {
+		return Expression{}, err
+	}
+	if !p.isKeyword(OP_AND) {
+		return Expression{}, p.errorf("unexpected %s, expected AND", p.tok)
+	}
+	if err := p.advance(); err != nil {
+		return Expression{}, err
+	}
+	high, err := p.parseOperand()
+	if err != nil {
+		return Expression{}, err
+	}
+	return Expression{left, OP_BETWEEN, []interface{}{low, high}}, nil
+}
+
+// パターンが文字列の場合はここでコンパイルする
+func (p *parser) parseMatch(left interface{}) (Expression, error) {
+	op := OP_LIKE
+	if !p.isKeyword(OP_LIKE) {
+		op = OP_REGEXP
+	}
+	if err := p.advance(); err != nil {
+		return Expression{}, err
+	}
+
+	tok := p.tok
+	right, err := p.parseOperand()
+	if err != nil {
+		return Expression{}, err
+	}
+	if tok.typ == tokenString {
+		pattern, err := NewPattern(op, tok.value)
+		if err != nil {
+			return Expression{}, &SyntaxError{tok.line, tok.column, err.Error()}
+		}
+		right = pattern
+	}
+	return Expression{left, op, right}, nil
+}
+
+// カラムは "$$name" に、整数は int に、NULL は nil に変換する
+func (p *parser) parseOperand() (interface{}, error) {
+	tok := p.tok
+	var value interface{}
+	switch tok.typ {
+	case tokenIdent:
+		if strings.EqualFold(tok.value, "null") {
+			break
+		}
+		if keywords[strings.ToLower(tok.value)] {
+			return nil, p.errorf("unexpected %s, expected column or value", tok)
+		}
+		value = "$$" + tok.value
+	case tokenColumn:
+		value = "$$" + tok.value
+	case tokenString:
+		value = tok.value
+	case tokenNumber:
+		if i, err := strconv.Atoi(tok.value); err == nil {
+			value = i
+		} else if _, err := strconv.ParseFloat(tok.value, 64); err == nil {
+			value = tok.value
+		} else {
+			return nil, p.errorf("invalid number %s", tok)
+		}
+	default:
+		return nil, p.errorf("unexpected %s, expected column or value", tok)
+	}
+	return value, p.advance()
+}
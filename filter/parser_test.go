@@ -0,0 +1,218 @@
+package filter
+
+import (
+	"encoding/json"
+	"github.com/uwork/bingo/mysql/binlog"
+	"reflect"
+	"testing"
+)
+
+func TestParseExpression(t *testing.T) {
+	expecteds := []struct {
+		src    string
+		result Expression
+	}{
+		{"id = 1", Expression{"$$id", OP_EQ, 1}},
+		{"$$0 != 'a''b'", Expression{"$$0", OP_NE, "a'b"}},
+		{`name <> "say \"hi\""`, Expression{"$$name", OP_NE, `say "hi"`}},
+		{"`order` >= -10", Expression{"$$order", OP_GE, -10}},
+		{"amount < 1.5", Expression{"$$amount", OP_LT, "1.5"}},
+		{"10 <= $$count", Expression{10, OP_LE, "$$count"}},
+		{"a = 1 or b = 2 and c > 3", Expression{
+			Expression{"$$a", OP_EQ, 1},
+			OP_OR,
+			Expression{Expression{"$$b", OP_EQ, 2}, OP_AND, Expression{"$$c", OP_GT, 3}},
+		}},
+		{"id > 10 AND (status = 'paid' OR amount >= 100)", Expression{
+			Expression{"$$id", OP_GT, 10},
+			OP_AND,
+			Expression{Expression{"$$status", OP_EQ, "paid"}, OP_OR, Expression{"$$amount", OP_GE, 100}},
+		}},
+		{"((a = 1))\n  AND\tb = 'x y'", Expression{Expression{"$$a", OP_EQ, 1}, OP_AND, Expression{"$$b", OP_EQ, "x y"}}},
+		{"status IN ('paid', 'shipped', 3)", Expression{"$$status", OP_IN, []interface{}{"paid", "shipped", 3}}},
+		{"id not in (1)", Expression{"$$id", OP_NOT_IN, []interface{}{1}}},
+		{"id BETWEEN 1 AND 5 AND b = 1", Expression{
+			Expression{"$$id", OP_BETWEEN, []interface{}{1, 5}},
+			OP_AND,
+			Expression{"$$b", OP_EQ, 1},
+		}},
+		{"id NOT BETWEEN $$low AND 5", Expression{"$$id", OP_NOT_BETWEEN, []interface{}{"$$low", 5}}},
+		{"note IS NULL", Expression{"$$note", OP_IS_NULL, nil}},
+		{"note is not null", Expression{"$$note", OP_IS_NOT_NULL, nil}},
+		{"note = NULL", Expression{"$$note", OP_EQ, nil}},
+		{"id IN (1, null)", Expression{"$$id", OP_IN, []interface{}{1, nil}}},
+		{"NULL != id", Expression{nil, OP_NE, "$$id"}},
+		{"NOT a = 1 OR b = 2", Expression{Expression{Expression{"$$a", OP_EQ, 1}, OP_NOT, nil}, OP_OR, Expression{"$$b", OP_EQ, 2}}},
+		{"not (a = 1 or b = 2)", Expression{Expression{Expression{"$$a", OP_EQ, 1}, OP_OR, Expression{"$$b", OP_EQ, 2}}, OP_NOT, nil}},
+		{"name LIKE $$pattern", Expression{"$$name", OP_LIKE, "$$pattern"}},
+		{"`not` = 1", Expression{"$$not", OP_EQ, 1}},
+		{"changed(status) AND changed = 1", Expression{Expression{"$$status", OP_CHANGED, nil}, OP_AND, Expression{"$$changed", OP_EQ, 1}}},
+		{"CHANGED(`order`) or changed($$2)", Expression{Expression{"$$order", OP_CHANGED, nil}, OP_OR, Expression{"$$2", OP_CHANGED, nil}}},
+		{"OLD.status != new.`status`", Expression{"$$old.status", OP_NE, "$$new.status"}},
+		{"$$old.0 = $$new.0", Expression{"$$old.0", OP_EQ, "$$new.0"}},
+		{"old = 1", Expression{"$$old", OP_EQ, 1}},
+	}
+
+	for _, s := range expecteds {
+		result, err := ParseExpression(s.src)
+		if err != nil {
+			t.Errorf("parse error.  src:%v error:%v", s.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(s.result, result) {
+			t.Errorf("invalid expression.  src:%v expected:%v result:%v", s.src, s.result, result)
+		}
+	}
+
+	// LIKE, REGEXP のパターンはコンパイルしておく
+	patterns := []struct {
+		src     string
+		op      string
+		pattern string
+	}{
+		{"name LIKE 'a%'", OP_LIKE, "a%"},
+		{"name not like 'a_'", OP_NOT_LIKE, "a_"},
+		{"name REGEXP '^a+$'", OP_REGEXP, "^a+$"},
+		{"name NOT RLIKE 'b'", OP_NOT_REGEXP, "b"},
+		{`name LIKE 'a\_b\%\\'`, OP_LIKE, `a\_b\%\`},
+	}
+	for _, s := range patterns {
+		result, err := ParseExpression(s.src)
+		if err != nil {
+			t.Errorf("parse error.  src:%v error:%v", s.src, err)
+			continue
+		}
+		p, ok := result.Right.(*Pattern)
+		if result.Op != s.op || !ok || p.Source != s.pattern {
+			t.Errorf("invalid expression.  src:%v result:%#v", s.src, result)
+		}
+	}
+}
+
+// 文字列の \% \_ は LIKE のパターンでは通常の文字になる
+func TestParseExpressionEscape(t *testing.T) {
+	expecteds := []struct {
+		src    string
+		value  string
+		result bool
+	}{
+		{`name LIKE 'a\_b'`, "a_b", true},
+		{`name LIKE 'a\_b'`, "aXb", false},
+		{`name LIKE 'a_b'`, "aXb", true},
+		{`name LIKE '100\%'`, "100%", true},
+		{`name LIKE '100\%'`, "1000", false},
+		{`name = 'a\_b'`, `a\_b`, true},
+		{`name = 'a\nb'`, "a\nb", true},
+		{`name = NULL OR name IN ('x', NULL)`, "x", true},
+		{`NOT (name = NULL) OR name NOT IN ('y', NULL) OR NULL BETWEEN 'a' AND 'z'`, "x", false},
+	}
+	for _, s := range expecteds {
+		exp, err := ParseExpression(s.src)
+		if err != nil {
+			t.Errorf("parse error.  src:%v error:%v", s.src, err)
+			continue
+		}
+
+		row := binlog.Row{Columns: []binlog.Column{binlog.NewColumn(binlog.TYPE_VARCHAR, s.value)}, ColumnNames: []string{"name"}}
+		result, err := exp.Evaluate(row)
+		if err != nil || result != s.result {
+			t.Errorf("invalid result.  src:%v value:%v expected:%v result:%v err:%v", s.src, s.value, s.result, result, err)
+		}
+	}
+}
+
+func TestParseExpressionError(t *testing.T) {
+	expecteds := []struct {
+		src    string
+		line   int
+		column int
+	}{
+		{"", 1, 1},
+		{"id", 1, 3},
+		{"id = ", 1, 6},
+		{"id == 1", 1, 5},
+		{"id = 1 and", 1, 11},
+		{"(id = 1", 1, 8},
+		{"id = 1)", 1, 7},
+		{"id = 'abc", 1, 6},
+		{"id = 1\nand name ~ 'x'", 2, 10},
+		{"a = 1 and or = 2", 1, 11},
+		{"$$ = 1", 1, 1},
+		{"id = 1.2.3", 1, 6},
+		{"id in 1", 1, 7},
+		{"id in (1, 2", 1, 12},
+		{"id in ()", 1, 8},
+		{"id between 1 or 2", 1, 14},
+		{"note is nul", 1, 9},
+		{"id not = 1", 1, 8},
+		{"name regexp '('", 1, 13},
+		{"not = 1", 1, 5},
+		{"in = 1", 1, 1},
+		{"changed(old.status)", 1, 9},
+		{"changed('status')", 1, 9},
+		{"changed(status", 1, 15},
+		{"old. = 1", 1, 5},
+	}
+
+	for _, s := range expecteds {
+		_, err := ParseExpression(s.src)
+		serr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("invalid error.  src:%q error:%v", s.src, err)
+			continue
+		}
+		if serr.Line != s.line || serr.Column != s.column {
+			t.Errorf("invalid error position.  src:%q expected:%d:%d error:%v", s.src, s.line, s.column, serr)
+		}
+	}
+}
+
+func TestUnmarshalExpression(t *testing.T) {
+	row := binlog.Row{}
+	row.Columns = []binlog.Column{binlog.NewColumn(binlog.TYPE_LONG, 10), binlog.NewColumn(binlog.TYPE_STRING, "paid")}
+	row.ColumnNames = []string{"id", "status"}
+
+	expecteds := []struct {
+		data   string
+		result bool
+	}{
+		{`{"where": "id = 10 and status = 'paid'"}`, true},
+		{`{"where": "id > 10 or status != 'paid'"}`, false},
+		{`{"where": {"left": {"left": "$$0", "op": "=", "right": 10}, "op": "and", "right": {"left": "$$status", "op": "=", "right": "paid"}}}`, true},
+		{`{"where": {"left": "$$id", "op": ">=", "right": 11}}`, false},
+		{`{"where": {"left": "$$id", "op": "in", "right": [1, 10]}}`, true},
+		{`{"where": {"left": "$$status", "op": "like", "right": "pa%"}}`, true},
+		{`{"where": {"left": {"left": "$$status", "op": "is null"}, "op": "not"}}`, true},
+		{`{"where": "status NOT LIKE 'pa%' OR id NOT BETWEEN 1 AND 10"}`, false},
+	}
+
+	for _, s := range expecteds {
+		f := Filter{}
+		if err := json.Unmarshal([]byte(s.data), &f); err != nil {
+			t.Errorf("unmarshal error.  data:%v error:%v", s.data, err)
+			continue
+		}
+		checkResult(t, f.Where, row, s.result)
+	}
+
+	// where が無い場合
+	f := Filter{}
+	if err := json.Unmarshal([]byte(`{"database": "testdb", "where": ""}`), &f); err != nil || f.Where.Op != "" {
+		t.Errorf("invalid empty where: %v (%v)", f.Where, err)
+	}
+
+	if err := json.Unmarshal([]byte(`{"where": "id = "}`), &f); err == nil {
+		t.Errorf("invalid pattern. syntax error was ignored")
+	}
+	if err := json.Unmarshal([]byte(`{"where": {"left": "$$status", "op": "regexp", "right": "("}}`), &f); err == nil {
+		t.Errorf("invalid pattern. regexp error was ignored")
+	}
+
+	// パターンは文字列に戻す
+	f = Filter{}
+	json.Unmarshal([]byte(`{"where": "status LIKE 'pa%'"}`), &f)
+	data, err := json.Marshal(f.Where)
+	if err != nil || string(data) != `{"left":"$$status","op":"like","right":"pa%"}` {
+		t.Errorf("invalid marshal: %s (%v)", data, err)
+	}
+}
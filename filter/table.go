@@ -0,0 +1,118 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/uwork/bingo/mysql/binlog"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// テーブル判定をキャッシュするテーブル数の上限 (超えた場合はキャッシュを捨てる)
+const MAX_TABLE_CACHE = 4096
+
+// 除外するデータベース、テーブル (Filters より先に評価する)
+type Exclude struct {
+	Database string `json:"database"`
+	Table    string `json:"table"`
+}
+
+// TableId ごとのテーブル判定の結果
+// TableId は TABLE_MAP_EVENT ごとに割り当てられるので、テーブル名が変わった場合は判定し直す
+type tableMatch struct {
+	schema  string
+	table   string
+	all     bool // Filters が空で、除外もされていない
+	filters []*compiledFilter
+}
+
+// データベース名、テーブル名のパターン
+// /.../ は正規表現 (全体に一致)、* ? [...] を含む場合は glob、それ以外は完全一致 (空の場合は全てに一致)
+type namePattern struct {
+	source string
+	re     *regexp.Regexp
+	glob   bool
+}
+
+func newNamePattern(pattern string) (*namePattern, error) {
+	p := &namePattern{source: pattern}
+	if 2 <= len(pattern) && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile("^(?:" + pattern[1:len(pattern)-1] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid name pattern: %s (%s)", pattern, err)
+		}
+		p.re = re
+	} else if strings.ContainsAny(pattern, "*?[") {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid name pattern: %s (%s)", pattern, err)
+		}
+		p.glob = true
+	}
+	return p, nil
+}
+
+func (p *namePattern) match(name string) bool {
+	switch {
+	case len(p.source) == 0:
+		return true
+	case p.re != nil:
+		return p.re.MatchString(name)
+	case p.glob:
+		match, _ := path.Match(p.source, name)
+		return match
+	}
+	return p.source == name
+}
+
+type tablePattern struct {
+	database *namePattern
+	table    *namePattern
+}
+
+func newTablePattern(database string, table string) (tablePattern, error) {
+	d, err := newNamePattern(database)
+	if err != nil {
+		return tablePattern{}, err
+	}
+	t, err := newNamePattern(table)
+	if err != nil {
+		return tablePattern{}, err
+	}
+	return tablePattern{d, t}, nil
+}
+
+func (p tablePattern) match(rows *binlog.BinlogEventRows) bool {
+	return p.database.match(rows.Schema) && p.table.match(rows.Table)
+}
+
+// 行イベントのテーブルに適用するフィルタを返す
+// パターンの判定は TableId ごとに一度だけ行う
+func (f *FilterConfig) matchTables(rows *binlog.BinlogEventRows) *tableMatch {
+	if m, ok := f.tables[rows.TableId]; ok && m.schema == rows.Schema && m.table == rows.Table {
+		return m
+	}
+
+	m := &tableMatch{schema: rows.Schema, table: rows.Table, filters: []*compiledFilter{}}
+	excluded := false
+	for _, ex := range f.compiled.excludes {
+		if ex.match(rows) {
+			excluded = true
+			break
+		}
+	}
+
+	if !excluded {
+		m.all = len(f.compiled.filters) == 0
+		for _, filter := range f.compiled.filters {
+			if filter.tables.match(rows) {
+				m.filters = append(m.filters, filter)
+			}
+		}
+	}
+
+	if f.tables == nil || MAX_TABLE_CACHE <= len(f.tables) {
+		f.tables = map[uint64]*tableMatch{}
+	}
+	f.tables[rows.TableId] = m
+	return m
+}
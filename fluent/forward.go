@@ -0,0 +1,357 @@
+package fluent
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1
+const (
+	MODE_MESSAGE        = "message"
+	MODE_FORWARD        = "forward"
+	MODE_PACKED_FORWARD = "packed"
+
+	DEFAULT_PORT        = 24224
+	DEFAULT_TAG_PREFIX  = "bingo"
+	DEFAULT_TIMEOUT     = 10 * time.Second
+	DEFAULT_MAX_RETRIES = 3
+)
+
+type Config struct {
+	// host:port
+	Address string
+
+	// タグは TagPrefix.database.table
+	TagPrefix string
+
+	// message, forward, packed (デフォルト)
+	Mode string
+
+	// chunk を付けて送り、ack が返ってくるまで待つ
+	RequireAck bool
+
+	// secure_forward の認証 (SharedKey が空の場合は認証しない)
+	SharedKey string
+	Hostname  string
+	Username  string
+	Password  string
+
+	Timeout    time.Duration
+	MaxRetries int
+}
+
+// fluent://[username:password@]host[:port]?tag=bingo&mode=packed&ack=true&shared_key=xxx&hostname=xxx&timeout=10&retries=3
+func ParseURL(dest string) (Config, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return Config{}, err
+	}
+	if u.Scheme != "fluent" {
+		return Config{}, fmt.Errorf("invalid fluent url: %s", dest)
+	}
+
+	conf := Config{
+		Address:    u.Host,
+		TagPrefix:  DEFAULT_TAG_PREFIX,
+		Mode:       MODE_PACKED_FORWARD,
+		Timeout:    DEFAULT_TIMEOUT,
+		MaxRetries: DEFAULT_MAX_RETRIES,
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		conf.Address = net.JoinHostPort(u.Host, strconv.Itoa(DEFAULT_PORT))
+	}
+	if u.User != nil {
+		conf.Username = u.User.Username()
+		conf.Password, _ = u.User.Password()
+	}
+
+	q := u.Query()
+	if tag := q.Get("tag"); 0 < len(tag) {
+		conf.TagPrefix = tag
+	}
+	if mode := q.Get("mode"); 0 < len(mode) {
+		if mode != MODE_MESSAGE && mode != MODE_FORWARD && mode != MODE_PACKED_FORWARD {
+			return Config{}, fmt.Errorf("invalid fluent mode: %s", mode)
+		}
+		conf.Mode = mode
+	}
+	if ack := q.Get("ack"); 0 < len(ack) {
+		if conf.RequireAck, err = strconv.ParseBool(ack); err != nil {
+			return Config{}, fmt.Errorf("invalid fluent ack: %s", ack)
+		}
+	}
+	conf.SharedKey = q.Get("shared_key")
+	conf.Hostname = q.Get("hostname")
+	if timeout := q.Get("timeout"); 0 < len(timeout) {
+		sec, err := strconv.ParseFloat(timeout, 64)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid fluent timeout: %s", timeout)
+		}
+		conf.Timeout = time.Duration(sec * float64(time.Second))
+	}
+	if retries := q.Get("retries"); 0 < len(retries) {
+		if conf.MaxRetries, err = strconv.Atoi(retries); err != nil {
+			return Config{}, fmt.Errorf("invalid fluent retries: %s", retries)
+		}
+	}
+	return conf, nil
+}
+
+type Entry struct {
+	Time   uint32
+	Record map[string]interface{}
+}
+
+// forward protocol で fluentd に送る
+// 送信に失敗した場合は接続し直して MaxRetries 回まで送り直す (ack が無い場合は重複する可能性がある)
+type Client struct {
+	conf Config
+	conn net.Conn
+	buf  []byte
+}
+
+func NewClient(conf Config) *Client {
+	if len(conf.Hostname) == 0 {
+		conf.Hostname, _ = os.Hostname()
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = DEFAULT_TIMEOUT
+	}
+	return &Client{conf: conf}
+}
+
+func (c *Client) Tag(database string, table string) string {
+	return c.conf.TagPrefix + "." + database + "." + table
+}
+
+func (c *Client) Post(tag string, entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var err error
+	for i := 0; i <= c.conf.MaxRetries; i++ {
+		err = c.post(tag, entries)
+		if err == nil {
+			return nil
+		}
+		c.Close()
+	}
+	return err
+}
+
+func (c *Client) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	c.buf = nil
+	return err
+}
+
+func (c *Client) post(tag string, entries []Entry) error {
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return err
+		}
+	}
+
+	switch c.conf.Mode {
+	case MODE_MESSAGE:
+		for _, e := range entries {
+			if err := c.send([]interface{}{tag, e.Time, e.Record}, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case MODE_FORWARD:
+		values := []interface{}{}
+		for _, e := range entries {
+			values = append(values, []interface{}{e.Time, e.Record})
+		}
+		return c.send([]interface{}{tag, values}, nil)
+	}
+
+	// PackedForward: [time, record] を連結した MessagePack を bin で送る
+	packed := []byte{}
+	for _, e := range entries {
+		var err error
+		packed, err = appendValue(packed, []interface{}{e.Time, e.Record})
+		if err != nil {
+			return err
+		}
+	}
+	return c.send([]interface{}{tag, packed}, map[string]interface{}{"size": len(entries)})
+}
+
+// option を付けて送り、RequireAck の場合は ack を待つ
+func (c *Client) send(message []interface{}, option map[string]interface{}) error {
+	if option == nil {
+		option = map[string]interface{}{}
+	}
+
+	chunk := ""
+	if c.conf.RequireAck {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		chunk = base64.StdEncoding.EncodeToString(id)
+		option["chunk"] = chunk
+	}
+	if 0 < len(option) {
+		message = append(message, option)
+	}
+
+	data, err := Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.conf.Timeout))
+	if _, err := c.conn.Write(data); err != nil {
+		return err
+	}
+
+	if !c.conf.RequireAck {
+		return nil
+	}
+
+	res, err := c.read()
+	if err != nil {
+		return fmt.Errorf("fluent ack read failure: %s", err)
+	}
+	if m, ok := res.(map[string]interface{}); !ok || string(toBytes(m["ack"])) != chunk {
+		return fmt.Errorf("invalid fluent ack: %v (chunk: %s)", res, chunk)
+	}
+	return nil
+}
+
+func (c *Client) connect() error {
+	conn, err := net.DialTimeout("tcp", c.conf.Address, c.conf.Timeout)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.buf = nil
+
+	if 0 < len(c.conf.SharedKey) {
+		if err := c.handshake(); err != nil {
+			c.Close()
+			return fmt.Errorf("fluent handshake failure: %s", err)
+		}
+	}
+	return nil
+}
+
+// HELO を受け取り、PING を送って PONG を確認する
+func (c *Client) handshake() error {
+	res, err := c.read()
+	if err != nil {
+		return err
+	}
+	helo, ok := res.([]interface{})
+	if !ok || len(helo) < 2 || helo[0] != "HELO" {
+		return fmt.Errorf("invalid HELO: %v", res)
+	}
+	options, _ := helo[1].(map[string]interface{})
+	nonce := toBytes(options["nonce"])
+	authSalt := toBytes(options["auth"])
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	sharedKeySalt := hex.EncodeToString(salt)
+
+	username, password := "", ""
+	if 0 < len(authSalt) {
+		username = c.conf.Username
+		password = digest(string(authSalt), username, c.conf.Password)
+	}
+	ping := []interface{}{
+		"PING",
+		c.conf.Hostname,
+		sharedKeySalt,
+		digest(sharedKeySalt, c.conf.Hostname, string(nonce), c.conf.SharedKey),
+		username,
+		password,
+	}
+	data, err := Marshal(ping)
+	if err != nil {
+		return err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.conf.Timeout))
+	if _, err := c.conn.Write(data); err != nil {
+		return err
+	}
+
+	res, err = c.read()
+	if err != nil {
+		return err
+	}
+	pong, ok := res.([]interface{})
+	if !ok || len(pong) < 5 || pong[0] != "PONG" {
+		return fmt.Errorf("invalid PONG: %v", res)
+	}
+	if authenticated, _ := pong[1].(bool); !authenticated {
+		return fmt.Errorf("authentication failed: %v", pong[2])
+	}
+	serverHostname, _ := pong[3].(string)
+	if string(toBytes(pong[4])) != digest(sharedKeySalt, serverHostname, string(nonce), c.conf.SharedKey) {
+		return fmt.Errorf("shared key mismatch: %s", serverHostname)
+	}
+	return nil
+}
+
+// MessagePack を一つ読み込む
+func (c *Client) read() (interface{}, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.conf.Timeout))
+	for {
+		if 0 < len(c.buf) {
+			v, n, err := Unmarshal(c.buf)
+			if err == nil {
+				c.buf = c.buf[n:]
+				return v, nil
+			}
+			if err != errShortData {
+				return nil, err
+			}
+		}
+
+		data := make([]byte, 4096)
+		n, err := c.conn.Read(data)
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, data[:n]...)
+	}
+}
+
+func digest(values ...string) string {
+	h := sha512.New()
+	for _, v := range values {
+		h.Write([]byte(v))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func toBytes(v interface{}) []byte {
+	switch v := v.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+package fluent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// MessagePack に変換する
+// forward protocol で使う型 (nil, bool, 数値, 文字列, []byte, スライス, map) のみ対応する
+// json.RawMessage は JSON として解釈した値を変換する
+func Marshal(v interface{}) ([]byte, error) {
+	return appendValue(nil, v)
+}
+
+func appendValue(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+
+	case int:
+		return appendInt(b, int64(v)), nil
+	case int8:
+		return appendInt(b, int64(v)), nil
+	case int16:
+		return appendInt(b, int64(v)), nil
+	case int32:
+		return appendInt(b, int64(v)), nil
+	case int64:
+		return appendInt(b, v), nil
+	case uint:
+		return appendUint(b, uint64(v)), nil
+	case uint8:
+		return appendUint(b, uint64(v)), nil
+	case uint16:
+		return appendUint(b, uint64(v)), nil
+	case uint32:
+		return appendUint(b, uint64(v)), nil
+	case uint64:
+		return appendUint(b, v), nil
+	case float32:
+		b = append(b, 0xca)
+		return appendBigEndian(b, uint64(math.Float32bits(v)), 4), nil
+	case float64:
+		b = append(b, 0xcb)
+		return appendBigEndian(b, math.Float64bits(v), 8), nil
+
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return appendInt(b, i), nil
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return appendUint(b, u), nil
+		}
+		f, err := strconv.ParseFloat(string(v), 64)
+		if err != nil {
+			return nil, err
+		}
+		return appendValue(b, f)
+
+	case json.RawMessage:
+		d := json.NewDecoder(bytes.NewReader(v))
+		d.UseNumber()
+		var value interface{}
+		if err := d.Decode(&value); err != nil {
+			return nil, err
+		}
+		return appendValue(b, value)
+
+	case string:
+		return appendString(b, v), nil
+	case []byte:
+		return appendBinary(b, v), nil
+
+	case []interface{}:
+		b = appendArrayHeader(b, len(v))
+		for _, e := range v {
+			var err error
+			if b, err = appendValue(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+
+	case map[string]interface{}:
+		b = appendMapHeader(b, len(v))
+
+		// 出力を一定にするためキーの順に並べる
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b = appendString(b, k)
+			var err error
+			if b, err = appendValue(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("msgpack: unsupported type %T", v)
+}
+
+func appendInt(b []byte, v int64) []byte {
+	switch {
+	case 0 <= v:
+		return appendUint(b, uint64(v))
+	case -32 <= v:
+		return append(b, byte(v))
+	case math.MinInt8 <= v:
+		return append(b, 0xd0, byte(v))
+	case math.MinInt16 <= v:
+		return appendBigEndian(append(b, 0xd1), uint64(v), 2)
+	case math.MinInt32 <= v:
+		return appendBigEndian(append(b, 0xd2), uint64(v), 4)
+	}
+	return appendBigEndian(append(b, 0xd3), uint64(v), 8)
+}
+
+func appendUint(b []byte, v uint64) []byte {
+	switch {
+	case v <= 0x7f:
+		return append(b, byte(v))
+	case v <= math.MaxUint8:
+		return append(b, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		return appendBigEndian(append(b, 0xcd), v, 2)
+	case v <= math.MaxUint32:
+		return appendBigEndian(append(b, 0xce), v, 4)
+	}
+	return appendBigEndian(append(b, 0xcf), v, 8)
+}
+
+func appendString(b []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n <= 31:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = appendBigEndian(append(b, 0xda), uint64(n), 2)
+	default:
+		b = appendBigEndian(append(b, 0xdb), uint64(n), 4)
+	}
+	return append(b, s...)
+}
+
+func appendBinary(b []byte, data []byte) []byte {
+	n := len(data)
+	switch {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = appendBigEndian(append(b, 0xc5), uint64(n), 2)
+	default:
+		b = appendBigEndian(append(b, 0xc6), uint64(n), 4)
+	}
+	return append(b, data...)
+}
+
+func appendArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return appendBigEndian(append(b, 0xdc), uint64(n), 2)
+	}
+	return appendBigEndian(append(b, 0xdd), uint64(n), 4)
+}
+
+func appendMapHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return appendBigEndian(append(b, 0xde), uint64(n), 2)
+	}
+	return appendBigEndian(append(b, 0xdf), uint64(n), 4)
+}
+
+func appendBigEndian(b []byte, v uint64, size int) []byte {
+	for i := size - 1; 0 <= i; i-- {
+		b = append(b, byte(v>>uint(8*i)))
+	}
+	return b
+}
+
+// MessagePack を読み込み、値と読み込んだバイト数を返す
+// 整数は int64 (負の数) か uint64、map のキーは文字列に変換する
+func Unmarshal(data []byte) (interface{}, int, error) {
+	d := &decoder{data: data}
+	v, err := d.value()
+	if err != nil {
+		return nil, 0, err
+	}
+	return v, d.pos, nil
+}
+
+// データが途中で終わっている (続きを読み込む必要がある)
+var errShortData = errors.New("msgpack: unexpected end of data")
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if len(d.data) < d.pos+n {
+		return nil, errShortData
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	v := uint64(0)
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *decoder) value() (interface{}, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	t := b[0]
+
+	switch {
+	case t <= 0x7f:
+		return uint64(t), nil
+	case 0xe0 <= t:
+		return int64(int8(t)), nil
+	case t&0xf0 == 0x80:
+		return d.mapValue(int(t & 0x0f))
+	case t&0xf0 == 0x90:
+		return d.array(int(t & 0x0f))
+	case t&0xe0 == 0xa0:
+		return d.str(int(t & 0x1f))
+	}
+
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (t - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		data, err := d.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, data...), nil
+
+	case 0xca:
+		v, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.uint(8)
+		return math.Float64frombits(v), err
+
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(1 << (t - 0xcc))
+
+	case 0xd0:
+		v, err := d.uint(1)
+		return int64(int8(v)), err
+	case 0xd1:
+		v, err := d.uint(2)
+		return int64(int16(v)), err
+	case 0xd2:
+		v, err := d.uint(4)
+		return int64(int32(v)), err
+	case 0xd3:
+		v, err := d.uint(8)
+		return int64(v), err
+
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (t - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n))
+
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapValue(int(n))
+	}
+
+	return nil, fmt.Errorf("msgpack: unsupported format %#x", t)
+}
+
+func (d *decoder) str(n int) (interface{}, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *decoder) array(n int) (interface{}, error) {
+	values := []interface{}{}
+	for i := 0; i < n; i++ {
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func (d *decoder) mapValue(n int) (interface{}, error) {
+	values := map[string]interface{}{}
+	for i := 0; i < n; i++ {
+		k, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		values[fmt.Sprint(k)] = v
+	}
+	return values, nil
+}
@@ -0,0 +1,84 @@
+package fluent
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	expecteds := []struct {
+		input  interface{}
+		result []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{false, []byte{0xc2}},
+		{1, []byte{0x01}},
+		{-1, []byte{0xff}},
+		{-33, []byte{0xd0, 0xdf}},
+		{200, []byte{0xcc, 0xc8}},
+		{uint32(1473000000), []byte{0xce, 0x57, 0xcc, 0x32, 0x40}},
+		{int64(-70000), []byte{0xd2, 0xff, 0xfe, 0xee, 0x90}},
+		{1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"abc", []byte{0xa3, 'a', 'b', 'c'}},
+		{[]byte{1, 2}, []byte{0xc4, 2, 1, 2}},
+		{[]interface{}{1, "a"}, []byte{0x92, 0x01, 0xa1, 'a'}},
+		{map[string]interface{}{"b": 2, "a": nil}, []byte{0x82, 0xa1, 'a', 0xc0, 0xa1, 'b', 0x02}},
+		{json.Number("12"), []byte{0x0c}},
+		{json.RawMessage(`{"a": [1, true]}`), []byte{0x81, 0xa1, 'a', 0x92, 0x01, 0xc3}},
+	}
+
+	for _, s := range expecteds {
+		result, err := Marshal(s.input)
+		if err != nil {
+			t.Errorf("marshal error: %v (%v)", err, s.input)
+			continue
+		}
+		if !reflect.DeepEqual(s.result, result) {
+			t.Errorf("invalid marshal.  input:%v expected:%x result:%x", s.input, s.result, result)
+		}
+	}
+
+	if _, err := Marshal(struct{}{}); err == nil {
+		t.Errorf("invalid pattern. unsupported type was marshaled")
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	expecteds := []interface{}{
+		nil,
+		true,
+		uint64(1),
+		int64(-1),
+		int64(-70000),
+		uint64(1473000000),
+		1.5,
+		"abc",
+		[]byte{1, 2},
+		[]interface{}{uint64(1), "a"},
+		map[string]interface{}{"ack": "chunk", "size": uint64(3)},
+	}
+
+	for _, s := range expecteds {
+		data, err := Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 後ろに続くデータは読み込まない
+		result, n, err := Unmarshal(append(data, 0xc0))
+		if err != nil {
+			t.Errorf("unmarshal error: %v (%v)", err, s)
+			continue
+		}
+		if !reflect.DeepEqual(s, result) || n != len(data) {
+			t.Errorf("invalid unmarshal.  expected:%#v result:%#v size:%v", s, result, n)
+		}
+
+		if 1 < len(data) {
+			if _, _, err := Unmarshal(data[:len(data)-1]); err != errShortData {
+				t.Errorf("invalid pattern. short data was unmarshaled: %v", s)
+			}
+		}
+	}
+}
@@ -3,25 +3,48 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/uwork/bingo/checkpoint"
+	"github.com/uwork/bingo/deadletter"
+	"github.com/uwork/bingo/filter"
 	"github.com/uwork/bingo/mysql"
 	"github.com/uwork/bingo/mysql/binlog"
+	"github.com/uwork/bingo/schema"
+	"github.com/uwork/bingo/sink"
+	"io"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 var version = "1.0.0"
 
 type CliOptions struct {
-	user    *string
-	pass    *string
-	host    *string
-	port    *int
-	dest    *string
-	conf    *string
-	genconf *bool
-	version *bool
+	user          *string
+	pass          *string
+	host          *string
+	port          *int
+	sslMode       *string
+	serverId      *int
+	dest          *string
+	conf          *string
+	checkpoint    *string
+	schema        *string
+	deadLetter    *string
+	binlogFile    *string
+	binlogPos     *int
+	local         *string
+	stopFile      *string
+	stopPos       *int
+	startDatetime *string
+	stopDatetime  *string
+	gtidSet       *string
+	resume        *bool
+	listDead      *bool
+	replayDead    *string
+	genconf       *bool
+	version       *bool
 }
 
 func main() {
@@ -30,8 +53,24 @@ func main() {
 		flag.String("p", "", "mysql password"),
 		flag.String("h", "127.0.0.1", "mysql server ip address"),
 		flag.Int("P", 3306, "mysql server port"),
+		flag.String("ssl-mode", mysql.SSL_MODE_PREFERRED, "ssl mode. (disabled, preferred, required, verify-ca, verify-identity)"),
+		flag.Int("server-id", mysql.DEFAULT_SERVER_ID, "server_id to register as a replica. (must be unique)"),
 		flag.String("d", "http://localhost:8888/bingo.data", "destinate for binlog data."),
 		flag.String("c", "", "config file path"),
+		flag.String("checkpoint", "bingo.checkpoint", "checkpoint file path. (empty to disable)"),
+		flag.String("schema-history", "bingo.schema", "schema history file path. (empty to disable)"),
+		flag.String("dead-letter", "bingo.deadletter", "dead letter file path to save undeliverable transactions. (empty to disable)"),
+		flag.String("file", "", "binlog file to start reading. (overrides checkpoint)"),
+		flag.Int("pos", 4, "binlog position to start reading. (with -file or -local)"),
+		flag.String("local", "", "local binlog file to read instead of mysql server. (follows rotate in the same directory)"),
+		flag.String("stop-file", "", "binlog file to stop reading. (with -local, default is the first file)"),
+		flag.Int("stop-pos", 0, "binlog position to stop reading. (with -local)"),
+		flag.String("start-datetime", "", "read events at or after \"YYYY-MM-DD hh:mm:ss\". (with -local)"),
+		flag.String("stop-datetime", "", "stop reading at the event at or after \"YYYY-MM-DD hh:mm:ss\". (with -local)"),
+		flag.String("gtid", "", "executed gtid set to start reading. (overrides checkpoint)"),
+		flag.Bool("resume", true, "resume from checkpoint."),
+		flag.Bool("list-dead-letters", false, "show dead letters."),
+		flag.String("replay-dead-letters", "", "replay dead letters. (comma separated ids or \"all\")"),
 		flag.Bool("genconf", false, "generate config."),
 		flag.Bool("v", false, "show version"),
 	}
@@ -42,6 +81,12 @@ func main() {
 		result = doVersion()
 	} else if *opts.genconf {
 		result = doDumpConfig(opts)
+	} else if *opts.listDead {
+		result = doListDeadLetters(opts)
+	} else if 0 < len(*opts.replayDead) {
+		result = doReplayDeadLetters(opts)
+	} else if 0 < len(*opts.local) {
+		result = doReadBinlogFile(opts)
 	} else {
 		result = doStartBinlogRead(opts)
 	}
@@ -50,53 +95,657 @@ func main() {
 
 func doStartBinlogRead(opts *CliOptions) int {
 	conf, err := LoadConfig(opts)
-	conn, err := mysql.Open(conf.Mysql.User, conf.Mysql.Pass, conf.Mysql.Host, conf.Mysql.Port)
 	if err != nil {
 		log.Fatal("error: ", err)
-	} else {
-		log.Printf("connected to mysql(%s@%s:%d)\n", conf.Mysql.User, conf.Mysql.Host, conf.Mysql.Port)
+	}
+
+	schemaCache := schema.NewCache(nil)
+	if 0 < len(conf.SchemaHistory) {
+		err = schemaCache.Load(conf.SchemaHistory)
+		if err != nil {
+			log.Fatal("error: ", err)
+		}
+	}
+
+	var store *checkpoint.Store
+	if 0 < len(conf.Checkpoint) {
+		store = checkpoint.NewStore(conf.Checkpoint)
+	}
+
+	var supervisor *mysql.Supervisor
+	var schemaConn *mysql.Conn
+	open := func() (*mysql.Conn, error) {
+		conn, err := mysql.OpenSSL(conf.Mysql.User, conf.Mysql.Pass, conf.Mysql.Host, conf.Mysql.Port, conf.Mysql.SSLConfig())
+		if err != nil {
+			return nil, err
+		}
+		conn.VerifyChecksum = conf.Mysql.VerifyChecksum
+		conn.HeartbeatPeriod = time.Duration(conf.Mysql.HeartbeatPeriod * float64(time.Second))
+		conn.HeartbeatMultiple = conf.Mysql.HeartbeatMultiple
+		conn.ServerId = conf.Mysql.ServerId
+		conn.ReportHost = conf.Mysql.Hostname
+		conn.ReportPort = conf.Mysql.ReportPort
+
+		// カラム名の取得は binlog dump 中のコネクションとは別のコネクションで行う
+		if schemaConn != nil {
+			schemaConn.Close()
+		}
+		schemaConn, err = mysql.OpenSSL(conf.Mysql.User, conf.Mysql.Pass, conf.Mysql.Host, conf.Mysql.Port, conf.Mysql.SSLConfig())
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		schemaCache.SetConn(schemaConn)
+
+		if reconnects := supervisor.Reconnects(); 0 < reconnects {
+			log.Printf("reconnected to mysql(%s@%s:%d) (reconnects: %d, last error: %s)\n", conf.Mysql.User, conf.Mysql.Host, conf.Mysql.Port, reconnects, supervisor.LastError())
+		} else {
+			log.Printf("connected to mysql(%s@%s:%d)\n", conf.Mysql.User, conf.Mysql.Host, conf.Mysql.Port)
+		}
+		return conn, nil
+	}
+
+	// 再接続した場合は最後に転送したトランザクションの次から読み直す
+	p, err := newPipeline(conf, schemaCache)
+	if err != nil {
+		log.Fatal("error: ", err)
+	}
+	defer p.Close()
+
+	// 全ての転送先に転送した位置を保存する
+	var delivered *checkpoint.Position
+	save := func(cp checkpoint.Position) {
+		delivered = &cp
+		if store != nil {
+			err := store.Save(cp)
+			if err != nil {
+				log.Println("checkpoint save failure: ", err)
+			}
+		}
+	}
+
+	resume := func(conn *mysql.Conn) (mysql.BinlogPosition, error) {
+		// まとめている行を転送してから読み直す (失敗した場合は重複して転送される)
+		if cp := p.flush(true); cp != nil {
+			save(*cp)
+		}
+		p.Reset()
+
+		start := checkpoint.Position{}
+		if delivered != nil {
+			start = *delivered
+		} else {
+			var err error
+			start, err = startPosition(opts, conf, conn, store)
+			if err != nil {
+				return mysql.BinlogPosition{}, err
+			}
+		}
+
+		if 0 < len(start.GTIDSet) {
+			gtidSet, err := binlog.ParseGTIDSet(start.GTIDSet)
+			if err != nil {
+				return mysql.BinlogPosition{}, err
+			}
+			return mysql.BinlogPosition{GTIDSet: gtidSet}, nil
+		}
+		return mysql.BinlogPosition{File: start.File, Pos: start.Pos}, nil
+	}
+
+	// server_id が重複していると既存の接続が切断されるため、読み込みを始める前に確認する
+	err = checkServerId(conf)
+	if err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	supervisor = mysql.NewSupervisor(open, resume)
+	supervisor.MaxRetries = conf.Mysql.MaxRetries
+
+	callback := func(ev *binlog.BinlogEvent) error {
+		if cp := p.process(ev, supervisor.Conn()); cp != nil {
+			save(*cp)
+		}
+		return nil
+	}
+
+	err = supervisor.Run(callback)
+	if err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	return 0
+}
+
+func checkServerId(conf Config) error {
+	conn, err := mysql.OpenSSL(conf.Mysql.User, conf.Mysql.Pass, conf.Mysql.Host, conf.Mysql.Port, conf.Mysql.SSLConfig())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.ServerId = conf.Mysql.ServerId
+	return conn.CheckServerId()
+}
+
+// ローカルのバイナリログファイルを読み込んで転送する
+// カラム名はスキーマ履歴と、接続できる場合は information_schema から取得する
+func doReadBinlogFile(opts *CliOptions) int {
+	conf, err := LoadConfig(opts)
+	if err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	schemaCache, closeSchema := openSchemaCache(conf)
+	defer closeSchema()
+
+	r, err := binlog.OpenFile(*opts.local)
+	if err != nil {
+		log.Fatal("error: ", err)
+	}
+	defer r.Close()
+
+	r.VerifyChecksum = conf.Mysql.VerifyChecksum
+	r.StartPos = uint32(*opts.binlogPos)
+	r.StopFile = *opts.stopFile
+	r.StopPos = uint32(*opts.stopPos)
+	r.StartTime, err = parseDatetime(*opts.startDatetime)
+	if err != nil {
+		log.Fatal("error: ", err)
+	}
+	r.StopTime, err = parseDatetime(*opts.stopDatetime)
+	if err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	log.Printf("start reading binlog file(%s:%d)\n", *opts.local, r.StartPos)
+
+	p, err := newPipeline(conf, schemaCache)
+	if err != nil {
+		log.Fatal("error: ", err)
+	}
+	defer p.Close()
+	for {
+		ev, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal("error: ", err)
+		}
+
+		p.process(ev, fileCursor{r})
+	}
+
+	file, pos := r.Position()
+	log.Printf("finish reading binlog file(%s:%d)\n", file, pos)
+	return 0
+}
+
+// スキーマ履歴を読み込み、接続できる場合は information_schema からも取得する
+func openSchemaCache(conf Config) (*schema.Cache, func()) {
+	schemaCache := schema.NewCache(nil)
+	if 0 < len(conf.SchemaHistory) {
+		err := schemaCache.Load(conf.SchemaHistory)
+		if err != nil {
+			log.Fatal("error: ", err)
+		}
+	}
+	schemaConn, err := mysql.OpenSSL(conf.Mysql.User, conf.Mysql.Pass, conf.Mysql.Host, conf.Mysql.Port, conf.Mysql.SSLConfig())
+	if err != nil {
+		log.Println("schema lookup disabled: ", err)
+		return schemaCache, func() {}
+	}
+	schemaCache.SetConn(schemaConn)
+	return schemaCache, func() { schemaConn.Close() }
+}
+
+// dead letter の一覧を表示する
+func doListDeadLetters(opts *CliOptions) int {
+	conf, err := LoadConfig(opts)
+	if err != nil {
+		log.Fatal("error: ", err)
+	}
+	if len(conf.DeadLetter) == 0 {
+		log.Fatal("error: dead letter is disabled")
+	}
+
+	// 解析し直せないエントリも一覧には表示する
+	entries, err := deadletter.NewStore(conf.DeadLetter).Load()
+	if _, ok := err.(*deadletter.InvalidEntryError); ok {
+		log.Println("warning: ", err)
+	} else if err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	for _, e := range entries {
+		state := "pending"
+		if e.Replayed != nil {
+			state = "replayed"
+		}
+		position := fmt.Sprintf("%s:%d", e.File, e.Pos)
+		if 0 < len(e.GTID) {
+			position += " " + e.GTID
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\t%s\t%s\n", e.Id, e.Time.Format("2006-01-02 15:04:05"), state, position, e.Dest, e.Error)
+	}
+	return 0
+}
+
+// dead letter を現在の設定 (フィルタ、転送先) で転送し直す
+// 転送先は dead letter に保存した dest と同じものを使い、再送済みのものは "all" の場合は除く
+func doReplayDeadLetters(opts *CliOptions) int {
+	conf, err := LoadConfig(opts)
+	if err != nil {
+		log.Fatal("error: ", err)
+	}
+	if len(conf.DeadLetter) == 0 {
+		log.Fatal("error: dead letter is disabled")
+	}
+
+	ids, err := parseIds(*opts.replayDead)
+	if err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	store := deadletter.NewStore(conf.DeadLetter)
+	entries, err := store.Load()
+	if err != nil {
+		log.Fatal("error: ", err)
+	}
+
+	schemaCache, closeSchema := openSchemaCache(conf)
+	defer closeSchema()
+
+	destinations := map[string]*destination{}
+	defer func() {
+		for _, d := range destinations {
+			d.sink.Close()
+		}
+	}()
+
+	result := 0
+	for _, e := range entries {
+		if ids == nil && e.Replayed != nil {
+			continue
+		}
+		if ids != nil && !ids[e.Id] {
+			continue
+		}
+
+		d, err := replayDestination(conf, destinations, e.Dest)
+		if err == nil {
+			err = replayDeadLetter(d, e, schemaCache)
+		}
+		if err == nil {
+			err = store.MarkReplayed(e.Id, time.Now())
+		}
+		if err != nil {
+			log.Printf("dead letter replay failure: %d (%s)\n", e.Id, err)
+			result = 1
+			continue
+		}
+		log.Printf("dead letter replayed: %d (%s:%d -> %s)\n", e.Id, e.File, e.Pos, e.Dest)
+	}
+	return result
+}
+
+// 設定ファイルにある転送先を開く (開いた転送先は使い回す)
+func replayDestination(conf Config, destinations map[string]*destination, dest string) (*destination, error) {
+	if d, ok := destinations[dest]; ok {
+		return d, nil
+	}
+
+	for _, dc := range conf.Destinations() {
+		if dc.Dest != dest {
+			continue
+		}
+		s, err := sink.New(dc.Dest, dc.Options)
+		if err != nil {
+			return nil, err
+		}
+		err = s.Open()
+		if err != nil {
+			return nil, fmt.Errorf("destination open failure: %s (%s)", dc.Dest, err)
+		}
+		d := &destination{dest: dc.Dest, filter: dc.Filter, sink: s}
+		destinations[dest] = d
+		return d, nil
+	}
+	return nil, fmt.Errorf("unknown destination: %s", dest)
+}
+
+func replayDeadLetter(d *destination, e *deadletter.Entry, schemaCache *schema.Cache) error {
+	tx, err := e.Transaction(schemaCache)
+	if err != nil {
+		return err
+	}
+
+	written, err := d.write(tx)
+	if err != nil || !written {
+		return err
+	}
+	return d.sink.Flush()
+}
+
+// "1,3,5" (nil の場合は全て)
+func parseIds(s string) (map[int]bool, error) {
+	if s == "all" {
+		return nil, nil
+	}
+
+	ids := map[int]bool{}
+	for _, v := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid dead letter id: %s", v)
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// "2006-01-02 15:04:05" (ローカル時刻)、空の場合はゼロ値
+func parseDatetime(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04:05", s, time.Local)
+}
+
+// 読み込み開始位置を決める
+// コマンドラインでの指定 > チェックポイント > 最新のバイナリログの末尾 の順に優先する
+// GTIDSet が空でない場合は GTID で読み込む
+func startPosition(opts *CliOptions, conf Config, conn *mysql.Conn, store *checkpoint.Store) (checkpoint.Position, error) {
+	if 0 < len(*opts.gtidSet) {
+		return checkpoint.Position{GTIDSet: *opts.gtidSet}, nil
+	}
+
+	if 0 < len(*opts.binlogFile) {
+		return checkpoint.Position{File: *opts.binlogFile, Pos: uint32(*opts.binlogPos)}, nil
+	}
+
+	if store != nil && *opts.resume {
+		pos, err := store.Load()
+		if err != nil {
+			return checkpoint.Position{}, fmt.Errorf("checkpoint load failure: %s", err)
+		}
+		if pos != nil && conf.Mysql.GTID && 0 < len(pos.GTIDSet) {
+			log.Printf("resume from checkpoint(%s)\n", pos.GTIDSet)
+			return checkpoint.Position{GTIDSet: pos.GTIDSet}, nil
+		}
+		if pos != nil && 0 < len(pos.File) {
+			log.Printf("resume from checkpoint(%s:%d)\n", pos.File, pos.Pos)
+			return checkpoint.Position{File: pos.File, Pos: pos.Pos}, nil
+		}
+	}
+
+	if conf.Mysql.GTID {
+		rs, err := conn.Query("select @@global.gtid_executed")
+		if err != nil {
+			return checkpoint.Position{}, err
+		}
+		if rs != nil && 0 < len(rs.Rows) && 0 < len(rs.Rows[0].Values[0].Value) {
+			return checkpoint.Position{GTIDSet: rs.Rows[0].Values[0].Value}, nil
+		}
 	}
 
 	rs, err := conn.Query("show master logs")
 	if err != nil {
-		log.Fatal("error:", err)
+		return checkpoint.Position{}, err
 	}
 
 	lastRow := len(rs.Rows) - 1
 	binlogFile := rs.Rows[lastRow].Values[0].Value
 	binlogPos, err := strconv.Atoi(rs.Rows[lastRow].Values[1].Value)
 	if err != nil {
-		log.Fatal("error: ", err)
+		return checkpoint.Position{}, err
 	}
 
-	err = conn.DumpBinlog(binlogFile, binlogPos, func(ev *binlog.BinlogEvent) error {
-		if nil != ev.Rows && 0 < len(ev.Rows.Rows) {
-			data, err := conf.Filter.FilterEvent(ev)
-			if err != nil {
-				log.Println("data filter failure: ", err)
-			}
+	return checkpoint.Position{File: binlogFile, Pos: uint32(binlogPos)}, nil
+}
+
+// 読み込み中の位置 (mysql.Conn または fileCursor)
+type cursor interface {
+	Position() (string, uint32)
+	GTIDSet() *binlog.GTIDSet
+}
+
+// GTID を追跡しないローカルファイル
+type fileCursor struct {
+	*binlog.FileReader
+}
+
+func (c fileCursor) GTIDSet() *binlog.GTIDSet {
+	return nil
+}
+
+// 転送先ごとにフィルタして書き込む
+// dirty は Batcher 以外で Flush が完了していない行があることを表す
+// unflushed は Flush が完了していない行を含むトランザクション (Flush で行が破棄された場合に dead letter に保存する)
+// flushed はこの転送先で転送が完了した位置、pending はまだ Flush が完了していない可能性がある最後の位置
+type destination struct {
+	dest      string
+	filter    filter.FilterConfig
+	sink      sink.Sink
+	dirty     bool
+	unflushed []*deadletter.Entry
+	flushed   *txPosition
+	pending   *txPosition
+}
+
+// コミットされたトランザクションの位置 (seq は読み込んだ順の番号)
+type txPosition struct {
+	seq uint64
+	checkpoint.Position
+}
+
+// イベントをトランザクション単位でフィルタして転送する (サーバーとローカルファイルで共通)
+type pipeline struct {
+	schema       *schema.Cache
+	assembler    *binlog.TransactionAssembler
+	destinations []*destination
+
+	// 最後にコミットされたトランザクションの位置と、最後に返した転送済みの位置の seq
+	last  *txPosition
+	saved uint64
+
+	// 転送できなかったトランザクションの保存先 (nil の場合はログに出力するだけ)
+	// description と events は dead letter に保存するイベント
+	deadLetter  *deadletter.Store
+	description []byte
+	events      [][]byte
+}
+
+func newPipeline(conf Config, schemaCache *schema.Cache) (*pipeline, error) {
+	p := &pipeline{schema: schemaCache, assembler: binlog.NewTransactionAssembler()}
+	if 0 < len(conf.DeadLetter) {
+		p.deadLetter = deadletter.NewStore(conf.DeadLetter)
+	}
+	for _, d := range conf.Destinations() {
+		s, err := sink.New(d.Dest, d.Options)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		err = s.Open()
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("destination open failure: %s (%s)", d.Dest, err)
+		}
+		p.destinations = append(p.destinations, &destination{dest: d.Dest, filter: d.Filter, sink: s})
+	}
+	return p, nil
+}
+
+// イベントを処理し、転送が完了した位置が進んだ場合はその位置を返す
+// トランザクションの区切り以外 (ハートビートなど) でも時間の上限に達した転送先を Flush する
+func (p *pipeline) process(ev *binlog.BinlogEvent, c cursor) *checkpoint.Position {
+	// テーブル定義はイベントの位置ごとに管理する
+	file, pos := c.Position()
+	if nil != ev.Query {
+		ddl, err := p.schema.OnQuery(ev.Query, schema.Position{File: file, Pos: pos})
+		if err != nil {
+			log.Println("schema history failure: ", err)
+		} else if ddl != nil {
+			log.Printf("schema changed: %s %v\n", ddl.Type, ddl.Tables)
+		}
+	}
+	if nil != ev.TableMap {
+		err := p.schema.OnTableMap(ev.TableMap, schema.Position{File: file, Pos: pos})
+		if err != nil {
+			log.Println("schema lookup failure: ", err)
+		}
+	}
+
+	if nil != ev.FormatDescription {
+		p.description = ev.Raw
+	} else if nil == ev.Heartbeat && nil == ev.Rotate && nil == ev.PreviousGTIDs {
+		p.events = append(p.events, ev.Raw)
+	}
 
-			if data != nil {
-				err = PostBinary(conf.Dest, data)
+	// コミットされたトランザクション単位で書き込む
+	tx := p.assembler.Add(ev)
+	if tx != nil {
+		if 0 < len(tx.Events) {
+			e := &deadletter.Entry{File: file, Pos: pos, GTID: tx.GTIDString(), Description: p.description, Events: p.events}
+			for _, d := range p.destinations {
+				written, err := d.write(tx)
 				if err != nil {
-					log.Println("data trans failure: ", err)
+					p.deadLetters(d, []*deadletter.Entry{e}, err)
+				} else if written {
+					d.unflushed = append(d.unflushed, e)
 				}
 			}
 		}
+		p.events = nil
+
+		if 0 < pos {
+			cp := checkpoint.Position{File: file, Pos: pos}
+			if gtidSet := c.GTIDSet(); gtidSet != nil {
+				cp.GTIDSet = gtidSet.String()
+			}
+			p.commit(cp)
+		}
+	}
+
+	return p.flush(false)
+}
+
+// トランザクションの書き込みが終わった位置を記録する
+func (p *pipeline) commit(cp checkpoint.Position) {
+	seq := uint64(1)
+	if p.last != nil {
+		seq = p.last.seq + 1
+	}
+	p.last = &txPosition{seq, cp}
+	for _, d := range p.destinations {
+		d.pending = p.last
+	}
+}
+
+// 上限に達した転送先 (force の場合は全ての転送先) を Flush し、
+// 全ての転送先で転送が完了した位置 (転送先ごとの転送済みの位置の最小) が進んだ場合はその位置を返す
+func (p *pipeline) flush(force bool) *checkpoint.Position {
+	for _, d := range p.destinations {
+		if !force && !d.needsFlush() {
+			continue
+		}
+		if err := d.sink.Flush(); err != nil {
+			// 送り直さずに破棄された行は dead letter に保存する
+			if !d.buffered() {
+				p.deadLetters(d, d.unflushed, err)
+				d.unflushed = nil
+			} else {
+				log.Printf("data trans failure: %s (%s)\n", err, d.dest)
+			}
+			continue
+		}
+		d.dirty = false
+		d.unflushed = nil
+	}
+
+	// 残っている行が無い転送先は pending の位置まで転送が完了している
+	min := p.last
+	for _, d := range p.destinations {
+		if d.pending != nil && !d.buffered() {
+			d.flushed = d.pending
+			d.pending = nil
+		}
+		if d.flushed == nil {
+			return nil
+		}
+		if d.flushed.seq < min.seq {
+			min = d.flushed
+		}
+	}
+	if min == nil || min.seq <= p.saved {
 		return nil
-	})
-	if err != nil {
-		log.Fatal("error: ", err)
+	}
+	p.saved = min.seq
+	cp := min.Position
+	return &cp
+}
+
+// 途中のトランザクションを破棄する (再接続してトランザクションの先頭から読み直す場合)
+func (p *pipeline) Reset() {
+	p.assembler.Reset()
+	p.events = nil
+}
+
+// 転送できなかったトランザクションを保存する
+func (p *pipeline) deadLetters(d *destination, entries []*deadletter.Entry, err error) {
+	log.Printf("data trans failure: %s (%s)\n", err, d.dest)
+	if p.deadLetter == nil {
+		return
 	}
 
-	err = conn.Quit()
+	for _, e := range entries {
+		dl := *e
+		dl.Dest = d.dest
+		dl.Error = err.Error()
+		if serr := p.deadLetter.Append(&dl); serr != nil {
+			log.Printf("dead letter save failure: %s (%s:%d)\n", serr, dl.File, dl.Pos)
+			continue
+		}
+		log.Printf("dead letter saved: %d (%s:%d)\n", dl.Id, dl.File, dl.Pos)
+	}
+}
+
+func (p *pipeline) Close() {
+	p.flush(true)
+	for _, d := range p.destinations {
+		if err := d.sink.Close(); err != nil {
+			log.Printf("destination close failure: %s (%s)\n", err, d.dest)
+		}
+	}
+}
+
+// 書き込んだ行がある場合は true を返す
+func (d *destination) write(tx *binlog.Transaction) (bool, error) {
+	rows, err := d.filter.FilterTransactionRows(tx)
 	if err != nil {
-		log.Fatal("error:", err)
+		return false, fmt.Errorf("data filter failure: %s", err)
+	}
+	if len(rows) == 0 {
+		return false, nil
 	}
 
-	time.Sleep(3 * time.Second)
+	d.dirty = true
+	return true, d.sink.Write(rows)
+}
 
-	return 0
+func (d *destination) needsFlush() bool {
+	if b, ok := d.sink.(sink.Batcher); ok {
+		return b.NeedsFlush()
+	}
+	return d.dirty
+}
+
+func (d *destination) buffered() bool {
+	if b, ok := d.sink.(sink.Batcher); ok {
+		return b.Buffered()
+	}
+	return d.dirty
 }
 
 // 設定を出力する
@@ -1,8 +1,310 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/uwork/bingo/checkpoint"
+	"github.com/uwork/bingo/deadletter"
+	"github.com/uwork/bingo/filter"
+	"github.com/uwork/bingo/mysql/binlog"
+	"github.com/uwork/bingo/schema"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
 func TestDoMain(t *testing.T) {
 }
+
+func TestDestinations(t *testing.T) {
+	conf := Config{Dest: "http://localhost:8888/bingo.data"}
+	dests := conf.Destinations()
+	if len(dests) != 1 || dests[0].Dest != conf.Dest {
+		t.Errorf("invalid destinations: %v", dests)
+	}
+
+	conf.Dests = []DestConfig{{Dest: "fluent://localhost:24224"}, {Dest: "file:///tmp/bingo.json"}}
+	dests = conf.Destinations()
+	if len(dests) != 2 || dests[1].Dest != "file:///tmp/bingo.json" {
+		t.Errorf("invalid destinations: %v", dests)
+	}
+}
+
+func TestCompileFilters(t *testing.T) {
+	expecteds := []struct {
+		data string
+		err  bool
+	}{
+		{`{"filter": {"filters": [{"database": "shop_*", "where": "id > 10"}]}}`, false},
+		{`{"dests": [{"dest": "file:///tmp/bingo.json", "filter": {"filters": [{"where": {"left": "$$id", "op": "=="}}]}}]}`, true},
+		{`{"filter": {"filters": [{"operations": ["upsert"]}]}}`, true},
+		{`{"filter": {"excludes": [{"table": "/tmp_(/"}]}}`, true},
+	}
+
+	for _, s := range expecteds {
+		conf := Config{}
+		if err := json.Unmarshal([]byte(s.data), &conf); err != nil {
+			t.Fatal(err)
+		}
+		if err := conf.CompileFilters(); (err != nil) != s.err {
+			t.Errorf("invalid error.  data:%v expected:%v err:%v", s.data, s.err, err)
+		}
+	}
+}
+
+// Flush の結果を切り替えられる転送先
+type testSink struct {
+	rows []filter.FilteredRow
+	err  error
+}
+
+func (s *testSink) Open() error { return nil }
+func (s *testSink) Write(rows []filter.FilteredRow) error {
+	s.rows = append(s.rows, rows...)
+	return nil
+}
+func (s *testSink) Flush() error { return s.err }
+func (s *testSink) Close() error { return nil }
+
+func TestPipelineFlush(t *testing.T) {
+	ok := &testSink{}
+	ng := &testSink{err: errors.New("unavailable")}
+	p := &pipeline{destinations: []*destination{{sink: ok, dirty: true}, {sink: ng, dirty: true}}}
+	p.commit(checkpoint.Position{File: "mysql-bin.000001", Pos: 120})
+
+	// Flush に失敗した転送先がある場合は位置を進めない
+	if cp := p.flush(false); cp != nil {
+		t.Errorf("invalid pattern. checkpoint advanced: %v", cp)
+	}
+	if p.destinations[0].dirty || !p.destinations[1].dirty {
+		t.Errorf("invalid dirty state")
+	}
+
+	ng.err = nil
+	cp := p.flush(false)
+	if cp == nil || cp.Pos != 120 {
+		t.Errorf("invalid checkpoint: %v", cp)
+	}
+	if cp := p.flush(true); cp != nil {
+		t.Errorf("invalid pattern. checkpoint returned twice: %v", cp)
+	}
+}
+
+// rows 行ごとに Flush する転送先
+type testRowsSink struct {
+	testSink
+	rows    int
+	flushed int
+}
+
+func (s *testRowsSink) NeedsFlush() bool { return s.rows <= len(s.testSink.rows) }
+func (s *testRowsSink) Buffered() bool   { return 0 < len(s.testSink.rows) }
+func (s *testRowsSink) Flush() error {
+	s.flushed += len(s.testSink.rows)
+	s.testSink.rows = nil
+	return nil
+}
+
+// バッチの大きさが異なる転送先が交互に行を残していても、両方で転送が完了した位置まで進める
+func TestPipelineFlushBatches(t *testing.T) {
+	two := &testRowsSink{rows: 2}
+	three := &testRowsSink{rows: 3}
+	p := &pipeline{destinations: []*destination{{sink: two}, {sink: three}}}
+
+	checkpoints := []uint32{}
+	for i := 1; i <= 6; i++ {
+		row := []filter.FilteredRow{{Database: "testdb", Table: "testtable"}}
+		two.Write(row)
+		three.Write(row)
+		p.commit(checkpoint.Position{File: "mysql-bin.000001", Pos: uint32(i * 100)})
+		if cp := p.flush(false); cp != nil {
+			checkpoints = append(checkpoints, cp.Pos)
+		}
+	}
+
+	expecteds := []uint32{200, 300, 600}
+	if !reflect.DeepEqual(expecteds, checkpoints) {
+		t.Errorf("invalid checkpoints.  expected:%v checkpoints:%v", expecteds, checkpoints)
+	}
+	if two.flushed != 6 || three.flushed != 6 {
+		t.Errorf("invalid flushed rows: %d %d", two.flushed, three.flushed)
+	}
+}
+
+// Flush に失敗すると行を破棄する転送先
+type testBatchSink struct {
+	testSink
+}
+
+func (s *testBatchSink) NeedsFlush() bool { return true }
+func (s *testBatchSink) Buffered() bool   { return false }
+
+func TestPipelineDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bingo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := deadletter.NewStore(filepath.Join(dir, "bingo.deadletter"))
+	batch := &testBatchSink{testSink{err: errors.New("invalid http response: 400")}}
+	keep := &testSink{err: errors.New("unavailable")}
+	p := &pipeline{deadLetter: store, destinations: []*destination{
+		{dest: "http://localhost/batch", sink: batch},
+		{dest: "http://localhost/keep", sink: keep, dirty: true},
+	}}
+	unflushed := []*deadletter.Entry{
+		{File: "mysql-bin.000001", Pos: 120, Description: formatDescriptionEvent()},
+		{File: "mysql-bin.000001", Pos: 240, Description: formatDescriptionEvent()},
+	}
+	for _, d := range p.destinations {
+		d.unflushed = unflushed
+	}
+	p.commit(checkpoint.Position{File: "mysql-bin.000001", Pos: 240})
+
+	// 破棄された行だけを保存する (残っている行は次の Flush で送り直す)
+	p.flush(false)
+	entries, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("invalid dead letters: %v", entries)
+	}
+	for i, e := range entries {
+		if e.Dest != "http://localhost/batch" || e.Pos != unflushed[i].Pos || e.Error != "invalid http response: 400" {
+			t.Errorf("invalid dead letter: %v", e)
+		}
+	}
+	if len(p.destinations[0].unflushed) != 0 || len(p.destinations[1].unflushed) != 2 {
+		t.Errorf("invalid unflushed entries")
+	}
+}
+
+func makeEvent(evType byte, logPos uint32, body []byte) []byte {
+	size := 19 + len(body)
+	data := []byte{
+		0, 0, 0, 0, // timestamp
+		evType,
+		1, 0, 0, 0, // server id
+		byte(size), byte(size >> 8), byte(size >> 16), byte(size >> 24),
+		byte(logPos), byte(logPos >> 8), byte(logPos >> 16), byte(logPos >> 24),
+		0, 0, // flags
+	}
+	return append(data, body...)
+}
+
+func formatDescriptionEvent() []byte {
+	body := []byte{4, 0}
+	version := make([]byte, 50)
+	copy(version, "5.7.14-log")
+	body = append(body, version...)
+	body = append(body, 0, 0, 0, 0, 19)
+	body = append(body, 0x38, 0xd, 0x0, 0x8, 0x0, 0x12, 0x0, 0x4, 0x4, 0x4, 0x4, 0x12, 0x0, 0x0, 0x5f, 0x0, 0x4, 0x1a, 0x8, 0x0,
+		0x0, 0x0, 0x8, 0x8, 0x8, 0x2, 0x0, 0x0, 0x0, 0xa, 0xa, 0xa, 0x2a, 0x2a, 0x0, 0x12, 0x34, 0x0)
+	body = append(body, binlog.BINLOG_CHECKSUM_ALG_OFF)
+	return makeEvent(binlog.BINLOG_EVENT_FORMAT_DESCRIPTION, 0, body)
+}
+
+// FORMAT_DESCRIPTION_EVENT と、testdb.testtable (id int, value int) に (n, n * 10) を insert するトランザクションを書き込む
+// 各トランザクションの終了位置を返す
+func writeBinlogFile(t *testing.T, path string, ids ...byte) []uint32 {
+	data := []byte(binlog.BINLOG_MAGIC)
+	fd := formatDescriptionEvent()
+	pos := uint32(len(data) + len(fd))
+	data = append(data, makeEvent(binlog.BINLOG_EVENT_FORMAT_DESCRIPTION, pos, fd[19:])...)
+
+	tableMap := []byte{1, 0, 0, 0, 0, 0, 1, 0, 6}
+	tableMap = append(tableMap, []byte("testdb")...)
+	tableMap = append(tableMap, 0, 9)
+	tableMap = append(tableMap, []byte("testtable")...)
+	tableMap = append(tableMap, 0, 2, binlog.TYPE_LONG, binlog.TYPE_LONG, 0, 0)
+
+	ends := []uint32{}
+	for _, id := range ids {
+		rows := []byte{1, 0, 0, 0, 0, 0, 1, 0, 2, 0, 2, 0x03, 0, id, 0, 0, 0, id * 10, 0, 0, 0}
+		events := []struct {
+			evType byte
+			body   []byte
+		}{
+			{binlog.BINLOG_EVENT_TABLE_MAP, tableMap},
+			{binlog.BINLOG_EVENT_WRITE_ROWSv2, rows},
+			{binlog.BINLOG_EVENT_XID, []byte{id, 0, 0, 0, 0, 0, 0, 0}},
+		}
+		for _, ev := range events {
+			pos += uint32(19 + len(ev.body))
+			data = append(data, makeEvent(ev.evType, pos, ev.body)...)
+		}
+		ends = append(ends, pos)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ends
+}
+
+// FORMAT_DESCRIPTION_EVENT から始まるバイナリログを読み込み、
+// 転送に失敗したトランザクションを解析し直せる形で dead letter に保存する
+func TestPipelineDeadLetterTransaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bingo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ends := writeBinlogFile(t, filepath.Join(dir, "mysql-bin.000001"), 1, 2)
+
+	history := filepath.Join(dir, "bingo.schema")
+	err = ioutil.WriteFile(history, []byte(`{"testdb.testtable": [{"file": "mysql-bin.000001", "pos": 4, "columns": ["id", "value"]}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemaCache := schema.NewCache(nil)
+	if err := schemaCache.Load(history); err != nil {
+		t.Fatal(err)
+	}
+
+	store := deadletter.NewStore(filepath.Join(dir, "bingo.deadletter"))
+	batch := &testBatchSink{testSink{err: errors.New("invalid http response: 400")}}
+	p := &pipeline{schema: schemaCache, assembler: binlog.NewTransactionAssembler(), deadLetter: store, destinations: []*destination{
+		{dest: "http://localhost/batch", sink: batch},
+	}}
+
+	// 開始位置より前の FORMAT_DESCRIPTION_EVENT も保存する
+	r, err := binlog.OpenFile(filepath.Join(dir, "mysql-bin.000001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.StartPos = ends[0]
+	for {
+		ev, err := r.Next()
+		if err != nil {
+			break
+		}
+		p.process(ev, fileCursor{r})
+	}
+
+	entries, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Pos != ends[1] {
+		t.Fatalf("invalid dead letters: %v", entries)
+	}
+	if !bytes.Equal(entries[0].Description[19:], formatDescriptionEvent()[19:]) {
+		t.Errorf("invalid format description: %v", entries[0].Description)
+	}
+
+	tx, err := entries[0].Transaction(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Xid != 2 || len(tx.Events) != 1 || tx.Events[0].Rows.Rows[0].Columns[1].String() != "20" {
+		t.Errorf("invalid transaction: %#v", tx)
+	}
+}
@@ -0,0 +1,218 @@
+package mysql
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+const (
+	authNativePassword      = "mysql_native_password"
+	authCachingSha2Password = "caching_sha2_password"
+	authSha256Password      = "sha256_password"
+
+	// http://dev.mysql.com/doc/internals/en/connection-phase-packets.html
+	pAuthMoreData = 0x01
+	pAuthSwitch   = 0xfe
+
+	// caching_sha2_password
+	cachingSha2RequestPublicKey = 0x02
+	cachingSha2FastAuthSuccess  = 0x03
+	cachingSha2PerformFullAuth  = 0x04
+
+	// sha256_password
+	sha256RequestPublicKey = 0x01
+)
+
+// サーバーに認証を拒否された
+type AuthError struct {
+	Plugin string
+	Err    error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authentication error: %s: %s", e.Plugin, e.Err)
+}
+
+// 認証プラグインごとの auth-response を作る
+func (c *Conn) authResponse(pass string, authSalt []byte) ([]byte, error) {
+	switch c.authPlugin {
+	case authNativePassword:
+		if len(pass) == 0 {
+			return []byte{}, nil
+		}
+		return CreateNativePassword([]byte(pass), authSalt), nil
+
+	case authCachingSha2Password:
+		if len(pass) == 0 {
+			return []byte{}, nil
+		}
+		return CreateCachingSha2Password([]byte(pass), authSalt), nil
+
+	case authSha256Password:
+		if len(pass) == 0 {
+			return []byte{0}, nil
+		}
+		if c.isTLS() {
+			return append([]byte(pass), 0), nil
+		}
+		// 公開鍵を要求する
+		return []byte{sha256RequestPublicKey}, nil
+	}
+
+	return nil, fmt.Errorf("%s: unsupported auth plugin", c.authPlugin)
+}
+
+// 認証結果を読み込む (AuthSwitchRequest, AuthMoreData にも対応する)
+// http://dev.mysql.com/doc/internals/en/authentication-method-mismatch.html
+func (c *Conn) readAuthResult(pass string, authSalt []byte) error {
+	for {
+		data, err := c.readPacket()
+		if err != nil {
+			return fmt.Errorf("%s: %s", c.authPlugin, err)
+		}
+
+		var resp []byte
+		switch data[0] {
+		case pOK:
+			return nil
+
+		case pERR:
+			return &AuthError{c.authPlugin, c.errorPacketToString(data)}
+
+		case pAuthSwitch:
+			if len(data) == 1 {
+				return fmt.Errorf("mysql_old_password: unsupported auth plugin")
+			}
+
+			// plugin name + auth plugin data
+			name := data[1:]
+			authSalt = []byte{}
+			if idx := bytes.IndexByte(name, 0x00); 0 <= idx {
+				authSalt = bytes.TrimRight(name[idx+1:], "\x00")
+				name = name[:idx]
+			}
+			c.authPlugin = string(name)
+
+			resp, err = c.authResponse(pass, authSalt)
+			if err != nil {
+				return err
+			}
+
+		case pAuthMoreData:
+			if len(data) < 2 {
+				return fmt.Errorf("%s: invalid auth more data: %#v", c.authPlugin, data)
+			}
+
+			switch c.authPlugin {
+			case authCachingSha2Password:
+				resp, err = c.cachingSha2MoreData(pass, authSalt, data[1:])
+			case authSha256Password:
+				// 公開鍵
+				resp, err = encryptPassword(pass, authSalt, data[1:])
+			default:
+				err = fmt.Errorf("unexpected auth more data: %#v", data)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %s", c.authPlugin, err)
+			}
+
+		default:
+			return fmt.Errorf("%s: unknown error in authentication sequence: %#v", c.authPlugin, data)
+		}
+
+		if resp != nil {
+			err = c.writePacket(resp)
+			if err != nil {
+				return fmt.Errorf("%s: %s", c.authPlugin, err)
+			}
+		}
+	}
+}
+
+func (c *Conn) cachingSha2MoreData(pass string, authSalt []byte, data []byte) ([]byte, error) {
+	switch data[0] {
+	case cachingSha2FastAuthSuccess:
+		// 続けて OK パケットが届く
+		return nil, nil
+
+	case cachingSha2PerformFullAuth:
+		if c.isTLS() {
+			return append([]byte(pass), 0), nil
+		}
+		return []byte{cachingSha2RequestPublicKey}, nil
+	}
+
+	// 公開鍵
+	if data[0] == '-' {
+		return encryptPassword(pass, authSalt, data)
+	}
+
+	return nil, fmt.Errorf("unknown auth more data: %#v", data)
+}
+
+func (c *Conn) isTLS() bool {
+	_, ok := c.nc.(*tls.Conn)
+	return ok
+}
+
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_caching_sha2_authentication_exchanges.html
+// XOR(SHA256(password), SHA256(SHA256(SHA256(password)), scramble))
+func CreateCachingSha2Password(pass []byte, authSalt []byte) []byte {
+	if len(authSalt) > 20 {
+		authSalt = authSalt[:20]
+	}
+
+	crypto := sha256.New()
+
+	crypto.Write(pass)
+	value1 := crypto.Sum(nil)
+
+	crypto.Reset()
+	crypto.Write(value1)
+	value2 := crypto.Sum(nil)
+
+	crypto.Reset()
+	crypto.Write(value2)
+	crypto.Write(authSalt)
+	value3 := crypto.Sum(nil)
+
+	for i := range value1 {
+		value1[i] = value1[i] ^ value3[i]
+	}
+
+	return value1
+}
+
+// サーバーの公開鍵でパスワードを暗号化する
+func encryptPassword(pass string, authSalt []byte, pemData []byte) ([]byte, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, fmt.Errorf("invalid public key: %q", pemData)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not rsa public key: %T", key)
+	}
+
+	if len(authSalt) > 20 {
+		authSalt = authSalt[:20]
+	}
+	plain := append([]byte(pass), 0)
+	for i := range plain {
+		plain[i] ^= authSalt[i%len(authSalt)]
+	}
+
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, plain, nil)
+}
@@ -0,0 +1,177 @@
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testAuthSalt = []byte{119, 10, 41, 56, 96, 16, 76, 53, 22, 7, 86, 111, 65, 40, 103, 93, 55, 1, 84, 61}
+
+func makePacket(seq byte, payload []byte) []byte {
+	return append([]byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq}, payload...)
+}
+
+// 書き込まれたパケットを分割する
+func splitPackets(data []byte) [][]byte {
+	packets := [][]byte{}
+	for 4 <= len(data) {
+		size := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+		packets = append(packets, data[4:4+size])
+		data = data[4+size:]
+	}
+	return packets
+}
+
+func authSwitchPacket(seq byte, plugin string, salt []byte) []byte {
+	payload := append([]byte{pAuthSwitch}, []byte(plugin)...)
+	payload = append(payload, 0)
+	payload = append(payload, salt...)
+	payload = append(payload, 0)
+	return makePacket(seq, payload)
+}
+
+func generatePublicKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func decryptPassword(t *testing.T, key *rsa.PrivateKey, data []byte) string {
+	plain, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, key, data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range plain {
+		plain[i] ^= testAuthSalt[i%len(testAuthSalt)]
+	}
+	return string(plain)
+}
+
+func TestCreateCachingSha2Password(t *testing.T) {
+	expected := []byte{252, 67, 218, 124, 5, 89, 78, 199, 164, 246, 250, 154, 198, 147, 47, 234,
+		120, 191, 224, 76, 1, 113, 110, 115, 20, 109, 62, 111, 53, 160, 154, 210}
+
+	hash := CreateCachingSha2Password([]byte("password!"), append(testAuthSalt, 0))
+	if !reflect.DeepEqual(expected, hash) {
+		t.Errorf("invalid hash.  expected:%v hash:%v", expected, hash)
+	}
+}
+
+func TestHandshakeWriteCachingSha2(t *testing.T) {
+	buf := &bytes.Buffer{}
+	c := &Conn{}
+	c.w = bufio.NewWriter(buf)
+	c.authPlugin = authCachingSha2Password
+
+	err := c.handshakeWrite("user", "password!", append(testAuthSalt, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := buf.Bytes()
+	if !bytes.HasSuffix(packet, []byte("caching_sha2_password\x00")) {
+		t.Errorf("invalid auth plugin name: %v", packet)
+	}
+	hash := CreateCachingSha2Password([]byte("password!"), testAuthSalt)
+	if !bytes.Contains(packet, append([]byte{32}, hash...)) {
+		t.Errorf("invalid auth response: %v", packet)
+	}
+}
+
+func TestAuthSwitch(t *testing.T) {
+	key, pubKey := generatePublicKey(t)
+
+	expecteds := []struct {
+		plugin  string
+		packets [][]byte
+		isOk    bool
+		errMsg  string
+		writes  int
+		encrypt int
+	}{
+		// auth switch to mysql_native_password
+		{authNativePassword, [][]byte{
+			authSwitchPacket(2, authNativePassword, testAuthSalt),
+			makePacket(4, []byte{pOK, 0, 0, 2, 0, 0, 0}),
+		}, true, "", 1, -1},
+		// caching_sha2_password fast auth
+		{authCachingSha2Password, [][]byte{
+			authSwitchPacket(2, authCachingSha2Password, testAuthSalt),
+			makePacket(4, []byte{pAuthMoreData, cachingSha2FastAuthSuccess}),
+			makePacket(5, []byte{pOK, 0, 0, 2, 0, 0, 0}),
+		}, true, "", 1, -1},
+		// caching_sha2_password full auth (rsa)
+		{authCachingSha2Password, [][]byte{
+			authSwitchPacket(2, authCachingSha2Password, testAuthSalt),
+			makePacket(4, []byte{pAuthMoreData, cachingSha2PerformFullAuth}),
+			makePacket(6, append([]byte{pAuthMoreData}, pubKey...)),
+			makePacket(8, []byte{pOK, 0, 0, 2, 0, 0, 0}),
+		}, true, "", 3, 2},
+		// sha256_password
+		{authSha256Password, [][]byte{
+			authSwitchPacket(2, authSha256Password, testAuthSalt),
+			makePacket(4, append([]byte{pAuthMoreData}, pubKey...)),
+			makePacket(6, []byte{pOK, 0, 0, 2, 0, 0, 0}),
+		}, true, "", 2, 1},
+		// access denied
+		{authCachingSha2Password, [][]byte{
+			authSwitchPacket(2, authCachingSha2Password, testAuthSalt),
+			makePacket(4, append([]byte{pERR, 0x15, 0x04, '#', '2', '8', '0', '0', '0'}, []byte("Access denied")...)),
+		}, false, "authentication error: caching_sha2_password: server error: ", 1, -1},
+		// unsupported plugin
+		{"mysql_clear_password", [][]byte{
+			authSwitchPacket(2, "mysql_clear_password", testAuthSalt),
+		}, false, "mysql_clear_password: unsupported auth plugin", 0, -1},
+	}
+
+	for _, s := range expecteds {
+		c := &Conn{}
+		c.authPlugin = authNativePassword
+		c.r = bufio.NewReader(bytes.NewBuffer(bytes.Join(s.packets, nil)))
+		wbuf := &bytes.Buffer{}
+		c.w = bufio.NewWriter(wbuf)
+
+		err := c.readAuthResult("password!", testAuthSalt)
+		if s.isOk {
+			if err != nil {
+				t.Errorf("auth error: %v", err)
+			}
+		} else {
+			if err == nil {
+				t.Errorf("invalid pattern. plugin: %v", s.plugin)
+			} else if !strings.HasPrefix(err.Error(), s.errMsg) {
+				t.Errorf("invalid error.  expected:%v error:%v", s.errMsg, err)
+			}
+		}
+
+		if c.authPlugin != s.plugin {
+			t.Errorf("invalid auth plugin.  expected:%v plugin:%v", s.plugin, c.authPlugin)
+		}
+
+		writes := splitPackets(wbuf.Bytes())
+		if len(writes) != s.writes {
+			t.Errorf("invalid write packets.  expected:%v packets:%v", s.writes, writes)
+			continue
+		}
+		if 0 <= s.encrypt {
+			pass := decryptPassword(t, key, writes[s.encrypt])
+			if pass != "password!\x00" {
+				t.Errorf("invalid encrypted password: %q", pass)
+			}
+		}
+	}
+}
@@ -8,13 +8,17 @@ import (
 	"log"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 )
 
 const (
 	BINLOG_EVENT_QUERY              = 0x02
+	BINLOG_EVENT_ROTATE             = 0x04
 	BINLOG_EVENT_TABLE_MAP          = 0x13
 	BINLOG_EVENT_FORMAT_DESCRIPTION = 0x0f
+	BINLOG_EVENT_XID                = 0x10
+	BINLOG_EVENT_HEARTBEAT          = 0x1b
 
 	BINLOG_EVENT_WRITE_ROWSv1  = 0x17
 	BINLOG_EVENT_UPDATE_ROWSv1 = 0x18
@@ -23,6 +27,10 @@ const (
 	BINLOG_EVENT_WRITE_ROWSv2  = 0x1e
 	BINLOG_EVENT_UPDATE_ROWSv2 = 0x1f
 	BINLOG_EVENT_DELETE_ROWSv2 = 0x20
+
+	BINLOG_EVENT_GTID           = 0x21
+	BINLOG_EVENT_ANONYMOUS_GTID = 0x22
+	BINLOG_EVENT_PREVIOUS_GTIDS = 0x23
 )
 
 // FORMAT_DESCRIPTION_EVENT payload
@@ -32,6 +40,7 @@ type BinlogEventFormatDescription struct {
 	CreateTimestamp        uint32
 	EventHeaderLength      uint8
 	EventTypeHeadersLength []uint8
+	ChecksumAlg            uint8
 }
 
 // QUERY_EVENT post-header + payload
@@ -44,6 +53,42 @@ type BinlogEventQuery struct {
 	Query         string
 }
 
+// ROTATE_EVENT post-header + payload
+type BinlogEventRotate struct {
+	Position uint64
+	NextFile string
+}
+
+// HEARTBEAT_LOG_EVENT payload
+// 送信するイベントが無い間、master_heartbeat_period ごとに送られる
+type BinlogEventHeartbeat struct {
+	LogIdent string
+}
+
+// XID_EVENT payload (InnoDB のトランザクションのコミット)
+type BinlogEventXid struct {
+	Xid uint64
+}
+
+// GTID_LOG_EVENT, ANONYMOUS_GTID_LOG_EVENT payload
+type BinlogEventGTID struct {
+	CommitFlag     bool
+	SID            string
+	GNO            int64
+	LastCommitted  int64
+	SequenceNumber int64
+	Anonymous      bool
+}
+
+func (g *BinlogEventGTID) String() string {
+	return fmt.Sprintf("%s:%d", g.SID, g.GNO)
+}
+
+// PREVIOUS_GTIDS_LOG_EVENT payload
+type BinlogEventPreviousGTIDs struct {
+	GTIDSet *GTIDSet
+}
+
 // TABLE_MAP_EVENT payload
 type BinlogEventTableMap struct {
 	TableId         uint64
@@ -54,6 +99,9 @@ type BinlogEventTableMap struct {
 	ColumnTypes     []byte
 	ColumnMetas     []int
 	NullableColumns []bool
+
+	// binlog にはカラム名が含まれないため、スキーマ情報から設定する
+	ColumnNames []string
 }
 
 type Column struct {
@@ -71,6 +119,7 @@ type Column struct {
 func NewColumn(_type byte, val interface{}) Column {
 	c := Column{}
 	c.Type = _type
+	c.IsPresent = true
 	switch c.Type {
 	case TYPE_LONG, TYPE_LONGLONG,
 		TYPE_INT24, TYPE_TINY, TYPE_SHORT, TYPE_YEAR:
@@ -82,7 +131,7 @@ func NewColumn(_type byte, val interface{}) Column {
 		c.time, _ = val.(time.Time)
 	case TYPE_BLOB, TYPE_MEDIUM_BLOB, TYPE_LONG_BLOB, TYPE_TINY_BLOB:
 		c.bin, _ = val.([]byte)
-	case TYPE_STRING, TYPE_VAR_STRING, TYPE_VARCHAR:
+	case TYPE_STRING, TYPE_VAR_STRING, TYPE_VARCHAR, TYPE_JSON:
 		c.str, _ = val.(string)
 	}
 	return c
@@ -166,7 +215,6 @@ func (c Column) Bytes() []byte {
 	default:
 		return c.bin
 	}
-	return c.bin
 }
 
 func (c Column) Time() time.Time {
@@ -178,7 +226,6 @@ func (c Column) Time() time.Time {
 		num := c.Int()
 		return time.Unix(int64(num), 0)
 	}
-	return c.time
 }
 
 func (c Column) String() string {
@@ -202,6 +249,9 @@ func (c Column) String() string {
 		return string(c.bin)
 	case TYPE_STRING, TYPE_VAR_STRING, TYPE_VARCHAR:
 		return c.str
+	case TYPE_JSON:
+		// JSON 文字列
+		return c.str
 	case TYPE_NULL:
 		return "[NULL]"
 	}
@@ -225,7 +275,7 @@ func (c Column) Equals(c2 Column) bool {
 		return c.time == c2.Time()
 	case TYPE_BLOB, TYPE_MEDIUM_BLOB, TYPE_LONG_BLOB, TYPE_TINY_BLOB:
 		return reflect.DeepEqual(c.bin, c2.Bytes())
-	case TYPE_STRING, TYPE_VAR_STRING, TYPE_VARCHAR:
+	case TYPE_STRING, TYPE_VAR_STRING, TYPE_VARCHAR, TYPE_JSON:
 		return c.str == c2.String()
 	case TYPE_NULL:
 		return c.IsNull == c2.IsNull
@@ -249,7 +299,7 @@ func (c Column) GreaterThan(c2 Column) bool {
 		return c.time.Unix() > c2.Time().Unix()
 	case TYPE_BLOB, TYPE_MEDIUM_BLOB, TYPE_LONG_BLOB, TYPE_TINY_BLOB:
 		return string(c.bin) > string(c2.Bytes())
-	case TYPE_STRING, TYPE_VAR_STRING, TYPE_VARCHAR:
+	case TYPE_STRING, TYPE_VAR_STRING, TYPE_VARCHAR, TYPE_JSON:
 		return c.str > c2.String()
 	case TYPE_NULL:
 		return c.IsNull && !c2.IsNull
@@ -272,7 +322,7 @@ func (c Column) GreaterEquals(c2 Column) bool {
 		return c.time.Unix() >= c2.Time().Unix()
 	case TYPE_BLOB, TYPE_MEDIUM_BLOB, TYPE_LONG_BLOB, TYPE_TINY_BLOB:
 		return string(c.bin) >= string(c2.Bytes())
-	case TYPE_STRING, TYPE_VAR_STRING, TYPE_VARCHAR:
+	case TYPE_STRING, TYPE_VAR_STRING, TYPE_VARCHAR, TYPE_JSON:
 		return c.str >= c2.String()
 	case TYPE_NULL:
 		return c.IsNull || c2.IsNull == false
@@ -281,13 +331,26 @@ func (c Column) GreaterEquals(c2 Column) bool {
 	return false
 }
 
+// insert, update では after image, delete では before image が Columns に入る
+// update の before image は BeforeRow に入る
 type Row struct {
 	IsNullColumns   []bool
 	IsEnableColumns []bool
 	Columns         []Column
+	ColumnNames     []string
 	BeforeRow       *Row
 }
 
+// カラム名からカラムの位置を返す (見つからない場合は -1)
+func (r Row) ColumnIndex(name string) int {
+	for i, n := range r.ColumnNames {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
 // ROW_EVENT payload
 type BinlogEventRows struct {
 	TableId   uint64
@@ -308,21 +371,70 @@ type BinlogEventHeader struct {
 	Flags     uint16
 }
 
+const (
+	// LOG_EVENT_ARTIFICIAL_F: 実際のバイナリログには存在しないイベント (fake rotate 等)
+	LOG_EVENT_ARTIFICIAL_F = 0x20
+)
+
+func (h *BinlogEventHeader) IsArtificial() bool {
+	return h.Flags&LOG_EVENT_ARTIFICIAL_F != 0
+}
+
+func (h *BinlogEventHeader) IsRowsWriteEvent() bool {
+	return h.EventType == BINLOG_EVENT_WRITE_ROWSv1 || h.EventType == BINLOG_EVENT_WRITE_ROWSv2
+}
+
 func (h *BinlogEventHeader) IsRowsUpdateEvent() bool {
 	return h.EventType == BINLOG_EVENT_UPDATE_ROWSv1 || h.EventType == BINLOG_EVENT_UPDATE_ROWSv2
 }
 
+func (h *BinlogEventHeader) IsRowsDeleteEvent() bool {
+	return h.EventType == BINLOG_EVENT_DELETE_ROWSv1 || h.EventType == BINLOG_EVENT_DELETE_ROWSv2
+}
+
 type BinlogEvent struct {
 	Header            *BinlogEventHeader
 	Query             *BinlogEventQuery
+	Rotate            *BinlogEventRotate
+	Xid               *BinlogEventXid
+	Heartbeat         *BinlogEventHeartbeat
+	GTID              *BinlogEventGTID
+	PreviousGTIDs     *BinlogEventPreviousGTIDs
 	FormatDescription *BinlogEventFormatDescription
 	TableMap          *BinlogEventTableMap
 	Rows              *BinlogEventRows
+
+	// チェックサムを含むイベント全体 (解析し直す場合に使う)
+	Raw []byte
+}
+
+// トランザクションの始まり
+func (ev *BinlogEvent) IsBegin() bool {
+	return ev.Query != nil && ev.Query.Query == "BEGIN"
+}
+
+// トランザクションの終わり (XID_EVENT, COMMIT, ROLLBACK)
+// BEGIN の後の QUERY_EVENT (SAVEPOINT, ROLLBACK TO など) はトランザクションの一部で、
+// BEGIN を伴わない QUERY_EVENT (DDL など) はそれ自体が一つのトランザクション
+func (ev *BinlogEvent) IsCommit(inTransaction bool) bool {
+	if ev.Header.EventType == BINLOG_EVENT_XID {
+		return true
+	}
+	if ev.Query == nil || ev.IsBegin() {
+		return false
+	}
+
+	query := strings.ToUpper(strings.TrimSpace(ev.Query.Query))
+	return !inTransaction || query == "COMMIT" || query == "ROLLBACK"
 }
 
 type BinlogParser struct {
 	Description *BinlogEventFormatDescription
 	TableMaps   map[uint64]*BinlogEventTableMap
+
+	// FORMAT_DESCRIPTION_EVENT より前のイベント (fake rotate) に使うチェックサムアルゴリズム
+	ChecksumAlg    uint8
+	VerifyChecksum bool
 }
 
 func (p *BinlogParser) ParseBinlogEvent(data []byte) (*BinlogEvent, int, error) {
@@ -330,19 +442,55 @@ func (p *BinlogParser) ParseBinlogEvent(data []byte) (*BinlogEvent, int, error)
 	if err != nil {
 		return nil, 0, err
 	}
+	ev.Raw = data
+
+	// FORMAT_DESCRIPTION_EVENT は自身にチェックサムアルゴリズムが含まれる
+	if ev.Header.EventType != BINLOG_EVENT_FORMAT_DESCRIPTION {
+		data, err = p.stripChecksum(ev.Header, data, p.ChecksumAlg)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
 
 	switch ev.Header.EventType {
 	case BINLOG_EVENT_FORMAT_DESCRIPTION:
 		if err = p.parseBinlogFormatDescription(ev, data[pos:]); err != nil {
 			return nil, 0, err
 		}
+		if _, err = p.stripChecksum(ev.Header, data, ev.FormatDescription.ChecksumAlg); err != nil {
+			return nil, 0, err
+		}
 		p.Description = ev.FormatDescription
+		p.ChecksumAlg = ev.FormatDescription.ChecksumAlg
 
 	case BINLOG_EVENT_QUERY:
 		if err = p.parseBinlogQuery(ev, data[pos:]); err != nil {
 			return nil, 0, err
 		}
 
+	case BINLOG_EVENT_ROTATE:
+		if err = p.parseBinlogRotate(ev, data[pos:]); err != nil {
+			return nil, 0, err
+		}
+
+	case BINLOG_EVENT_HEARTBEAT:
+		ev.Heartbeat = &BinlogEventHeartbeat{string(data[pos:])}
+
+	case BINLOG_EVENT_XID:
+		if err = p.parseBinlogXid(ev, data[pos:]); err != nil {
+			return nil, 0, err
+		}
+
+	case BINLOG_EVENT_GTID, BINLOG_EVENT_ANONYMOUS_GTID:
+		if err = p.parseBinlogGTID(ev, data[pos:]); err != nil {
+			return nil, 0, err
+		}
+
+	case BINLOG_EVENT_PREVIOUS_GTIDS:
+		if err = p.parseBinlogPreviousGTIDs(ev, data[pos:]); err != nil {
+			return nil, 0, err
+		}
+
 	case BINLOG_EVENT_TABLE_MAP:
 		if err = p.parseBinlogTableMap(ev, data[pos:]); err != nil {
 			return nil, 0, err
@@ -401,7 +549,7 @@ func (p *BinlogParser) parseBinlogFormatDescription(ev *BinlogEvent, data []byte
 	fd.BinlogVersion = uint16(data[pos]) + uint16(data[pos+1])<<8
 	pos += 2
 
-	fd.ServerVersion = string(data[pos : pos+50])
+	fd.ServerVersion = strings.TrimRight(string(data[pos:pos+50]), "\x00")
 	pos += 50
 
 	fd.CreateTimestamp = util.BytesToUint(data[pos : pos+4])
@@ -410,8 +558,19 @@ func (p *BinlogParser) parseBinlogFormatDescription(ev *BinlogEvent, data []byte
 	fd.EventHeaderLength = uint8(data[pos])
 	pos += 1
 
+	// checksum-alg(1) + checksum(4)
+	end := len(data)
+	fd.ChecksumAlg = BINLOG_CHECKSUM_ALG_OFF
+	if hasChecksumAlgorithm(fd.ServerVersion) {
+		end -= 1 + BINLOG_CHECKSUM_LEN
+		if end < pos {
+			return fmt.Errorf("invalid format description event size: %d", len(data))
+		}
+		fd.ChecksumAlg = uint8(data[end])
+	}
+
 	eventsLen := []uint8{}
-	for b := range data[pos:] {
+	for _, b := range data[pos:end] {
 		eventsLen = append(eventsLen, uint8(b))
 	}
 	fd.EventTypeHeadersLength = eventsLen
@@ -421,6 +580,14 @@ func (p *BinlogParser) parseBinlogFormatDescription(ev *BinlogEvent, data []byte
 	return nil
 }
 
+// イベント種別ごとの post-header の長さ
+func (p *BinlogParser) postHeaderLength(eventType uint8) int {
+	if p.Description == nil || int(eventType) < 1 || len(p.Description.EventTypeHeadersLength) < int(eventType) {
+		return -1
+	}
+	return int(p.Description.EventTypeHeadersLength[eventType-1])
+}
+
 func (p *BinlogParser) parseBinlogQuery(ev *BinlogEvent, data []byte) error {
 	pos := 0
 
@@ -437,7 +604,7 @@ func (p *BinlogParser) parseBinlogQuery(ev *BinlogEvent, data []byte) error {
 	q.ErrorCode = uint16(data[pos]) + uint16(data[pos+1])<<8
 	pos += 2
 
-	statusVarsLen := int(uint8(data[pos]) + uint8(data[pos+1])<<8)
+	statusVarsLen := int(uint(data[pos]) | uint(data[pos+1])<<8)
 	pos += 2
 
 	q.StatusVars = string(data[pos : pos+statusVarsLen])
@@ -451,3 +618,75 @@ func (p *BinlogParser) parseBinlogQuery(ev *BinlogEvent, data []byte) error {
 	ev.Query = q
 	return nil
 }
+
+// http://dev.mysql.com/doc/internals/en/rotate-event.html
+func (p *BinlogParser) parseBinlogRotate(ev *BinlogEvent, data []byte) error {
+	if len(data) < 8 {
+		return fmt.Errorf("invalid rotate event size: %d", len(data))
+	}
+
+	r := &BinlogEventRotate{}
+	r.Position, _ = readLittleEndianUvarint(data[:8])
+	r.NextFile = string(data[8:])
+
+	ev.Rotate = r
+	return nil
+}
+
+func (p *BinlogParser) parseBinlogXid(ev *BinlogEvent, data []byte) error {
+	if len(data) < 8 {
+		return fmt.Errorf("invalid xid event size: %d", len(data))
+	}
+
+	x := &BinlogEventXid{}
+	x.Xid, _ = readLittleEndianUvarint(data[:8])
+
+	ev.Xid = x
+	return nil
+}
+
+// mysql source: libbinlogevents/src/control_events.cpp
+func (p *BinlogParser) parseBinlogGTID(ev *BinlogEvent, data []byte) error {
+	if len(data) < 1+16+8 {
+		return fmt.Errorf("invalid gtid event size: %d", len(data))
+	}
+
+	pos := 0
+
+	g := &BinlogEventGTID{}
+	g.Anonymous = ev.Header.EventType == BINLOG_EVENT_ANONYMOUS_GTID
+	g.CommitFlag = data[pos] != 0
+	pos += 1
+
+	g.SID = formatSID(data[pos : pos+16])
+	pos += 16
+
+	gno, _ := readLittleEndianUvarint(data[pos : pos+8])
+	g.GNO = int64(gno)
+	pos += 8
+
+	// logical clock (5.7 以降)
+	if len(data) >= pos+1+8+8 && data[pos] == 2 {
+		pos += 1
+		lastCommitted, _ := readLittleEndianUvarint(data[pos : pos+8])
+		g.LastCommitted = int64(lastCommitted)
+		pos += 8
+
+		sequenceNumber, _ := readLittleEndianUvarint(data[pos : pos+8])
+		g.SequenceNumber = int64(sequenceNumber)
+		pos += 8
+	}
+
+	ev.GTID = g
+	return nil
+}
+
+func (p *BinlogParser) parseBinlogPreviousGTIDs(ev *BinlogEvent, data []byte) error {
+	set, err := DecodeGTIDSet(data)
+	if err != nil {
+		return err
+	}
+
+	ev.PreviousGTIDs = &BinlogEventPreviousGTIDs{set}
+	return nil
+}
@@ -0,0 +1,258 @@
+package binlog
+
+import (
+	"hash/crc32"
+	"testing"
+)
+
+func makeEvent(evType byte, logPos uint32, flags uint16, body []byte) []byte {
+	size := 19 + len(body)
+	data := []byte{
+		0, 0, 0, 0, // timestamp
+		evType,
+		1, 0, 0, 0, // server id
+		byte(size), byte(size >> 8), byte(size >> 16), byte(size >> 24),
+		byte(logPos), byte(logPos >> 8), byte(logPos >> 16), byte(logPos >> 24),
+		byte(flags), byte(flags >> 8),
+	}
+	return append(data, body...)
+}
+
+func TestRotate(t *testing.T) {
+	expecteds := []struct {
+		position   uint64
+		nextFile   string
+		flags      uint16
+		artificial bool
+	}{
+		{4, "mysql-bin.000002", LOG_EVENT_ARTIFICIAL_F, true},
+		{4, "mysql-bin.000003", 0, false},
+		{0x1234567890, "binlog.000010", 0, false},
+	}
+
+	p := getParser(t)
+	for _, s := range expecteds {
+		body := []byte{
+			byte(s.position), byte(s.position >> 8), byte(s.position >> 16), byte(s.position >> 24),
+			byte(s.position >> 32), byte(s.position >> 40), byte(s.position >> 48), byte(s.position >> 56),
+		}
+		body = append(body, []byte(s.nextFile)...)
+
+		ev, _, err := p.ParseBinlogEvent(makeEvent(BINLOG_EVENT_ROTATE, 0, s.flags, body))
+		if err != nil {
+			t.Errorf("parse error: %v", err)
+			continue
+		}
+
+		if ev.Rotate == nil {
+			t.Errorf("rotate event was not parsed: %#v", ev)
+			continue
+		}
+		if ev.Rotate.Position != s.position {
+			t.Errorf("invalid position.  expected:%v position:%v", s.position, ev.Rotate.Position)
+		}
+		if ev.Rotate.NextFile != s.nextFile {
+			t.Errorf("invalid next file.  expected:%v file:%v", s.nextFile, ev.Rotate.NextFile)
+		}
+		if ev.Header.IsArtificial() != s.artificial {
+			t.Errorf("invalid artificial flag.  expected:%v flag:%v", s.artificial, ev.Header.IsArtificial())
+		}
+	}
+
+	_, _, err := p.ParseBinlogEvent(makeEvent(BINLOG_EVENT_ROTATE, 0, 0, []byte{4, 0, 0}))
+	if err == nil {
+		t.Errorf("invalid pattern. short rotate event was parsed")
+	}
+}
+
+// チェックサムを付与する (event size も更新する)
+func withChecksum(ev []byte) []byte {
+	data := append([]byte{}, ev...)
+	size := len(data) + 4
+	data[9], data[10], data[11], data[12] = byte(size), byte(size>>8), byte(size>>16), byte(size>>24)
+
+	sum := crc32.ChecksumIEEE(data)
+	return append(data, byte(sum), byte(sum>>8), byte(sum>>16), byte(sum>>24))
+}
+
+func formatDescriptionBody(serverVersion string, alg byte) []byte {
+	body := []byte{4, 0}
+	version := make([]byte, 50)
+	copy(version, serverVersion)
+	body = append(body, version...)
+	body = append(body, 0, 0, 0, 0, 19)
+	body = append(body, 0x38, 0xd, 0x0, 0x8, 0x0, 0x12, 0x0, 0x4, 0x4, 0x4, 0x4, 0x12, 0x0, 0x0, 0x5f, 0x0, 0x4, 0x1a, 0x8, 0x0,
+		0x0, 0x0, 0x8, 0x8, 0x8, 0x2, 0x0, 0x0, 0x0, 0xa, 0xa, 0xa, 0x2a, 0x2a, 0x0, 0x12, 0x34, 0x0)
+	return append(body, alg)
+}
+
+func TestChecksum(t *testing.T) {
+	p := &BinlogParser{}
+	p.TableMaps = map[uint64]*BinlogEventTableMap{}
+	p.ChecksumAlg = BINLOG_CHECKSUM_ALG_CRC32
+	p.VerifyChecksum = true
+
+	// fake rotate event (before format description)
+	rotate := append([]byte{4, 0, 0, 0, 0, 0, 0, 0}, []byte("mysql-bin.000001")...)
+	ev, _, err := p.ParseBinlogEvent(withChecksum(makeEvent(BINLOG_EVENT_ROTATE, 0, LOG_EVENT_ARTIFICIAL_F, rotate)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Rotate.NextFile != "mysql-bin.000001" {
+		t.Errorf("invalid next file.  expected:%v file:%v", "mysql-bin.000001", ev.Rotate.NextFile)
+	}
+
+	ev, _, err = p.ParseBinlogEvent(withChecksum(makeEvent(BINLOG_EVENT_FORMAT_DESCRIPTION, 0, 0, formatDescriptionBody("5.7.14-log", BINLOG_CHECKSUM_ALG_CRC32))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.FormatDescription.ChecksumAlg != BINLOG_CHECKSUM_ALG_CRC32 {
+		t.Errorf("invalid checksum alg.  expected:%v alg:%v", BINLOG_CHECKSUM_ALG_CRC32, ev.FormatDescription.ChecksumAlg)
+	}
+	if ev.FormatDescription.ServerVersion != "5.7.14-log" {
+		t.Errorf("invalid server version: %q", ev.FormatDescription.ServerVersion)
+	}
+	if len(ev.FormatDescription.EventTypeHeadersLength) != 38 {
+		t.Errorf("invalid post header lengths: %v", ev.FormatDescription.EventTypeHeadersLength)
+	}
+	if p.postHeaderLength(BINLOG_EVENT_TABLE_MAP) != 8 {
+		t.Errorf("invalid table map post header length: %d", p.postHeaderLength(BINLOG_EVENT_TABLE_MAP))
+	}
+
+	rotate = append([]byte{4, 0, 0, 0, 0, 0, 0, 0}, []byte("mysql-bin.000002")...)
+	data := withChecksum(makeEvent(BINLOG_EVENT_ROTATE, 1024, 0, rotate))
+	ev, _, err = p.ParseBinlogEvent(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Rotate.NextFile != "mysql-bin.000002" {
+		t.Errorf("invalid next file.  expected:%v file:%v", "mysql-bin.000002", ev.Rotate.NextFile)
+	}
+
+	// corrupted event
+	data[len(data)-5] ^= 0xff
+	_, _, err = p.ParseBinlogEvent(data)
+	if cerr, ok := err.(*BinlogChecksumError); !ok {
+		t.Errorf("invalid error.  expected:BinlogChecksumError error:%v", err)
+	} else if cerr.LogPos != 1024 || cerr.EventType != BINLOG_EVENT_ROTATE {
+		t.Errorf("invalid error: %v", cerr)
+	}
+
+	// no verification
+	p.VerifyChecksum = false
+	_, _, err = p.ParseBinlogEvent(data)
+	if err != nil {
+		t.Errorf("parse error: %v", err)
+	}
+}
+
+func TestHasChecksumAlgorithm(t *testing.T) {
+	expecteds := []struct {
+		version string
+		result  bool
+	}{
+		{"5.5.40-log", false},
+		{"5.6.0", false},
+		{"5.6.1", true},
+		{"5.6.30-log", true},
+		{"5.7.14-log", true},
+		{"8.0.32", true},
+		{"10.1.2-MariaDB", true},
+		{"unknown", false},
+	}
+
+	for _, s := range expecteds {
+		if hasChecksumAlgorithm(s.version) != s.result {
+			t.Errorf("invalid result.  version:%v expected:%v", s.version, s.result)
+		}
+	}
+}
+
+// TABLE_MAP_EVENT (LONG カラムのみ)
+func tableMapBody(tableId byte, schema string, table string, columnCount int) []byte {
+	body := []byte{tableId, 0, 0, 0, 0, 0, 1, 0}
+	body = append(body, byte(len(schema)))
+	body = append(body, []byte(schema)...)
+	body = append(body, 0, byte(len(table)))
+	body = append(body, []byte(table)...)
+	body = append(body, 0, byte(columnCount))
+	for i := 0; i < columnCount; i++ {
+		body = append(body, TYPE_LONG)
+	}
+	body = append(body, 0) // metadata
+	body = append(body, make([]byte, (columnCount+7)/8)...)
+	return body
+}
+
+// ROWS_EVENT v2 (LONG カラムのみ, NULL なし)
+func rowsBody(tableId byte, columnCount int, update bool, rows ...[]int) []byte {
+	body := []byte{tableId, 0, 0, 0, 0, 0, 1, 0, 2, 0, byte(columnCount)}
+	bitmap := make([]byte, (columnCount+7)/8)
+	for i := 0; i < columnCount; i++ {
+		bitmap[i/8] |= 1 << uint(i%8)
+	}
+	body = append(body, bitmap...)
+	if update {
+		body = append(body, bitmap...)
+	}
+
+	for _, row := range rows {
+		body = append(body, make([]byte, (columnCount+7)/8)...)
+		for _, v := range row {
+			body = append(body, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+		}
+	}
+	return body
+}
+
+func TestRowsImages(t *testing.T) {
+	p := getParser(t)
+
+	_, _, err := p.ParseBinlogEvent(makeEvent(BINLOG_EVENT_TABLE_MAP, 100, 0, tableMapBody(1, "testdb", "testtable", 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// update: (1, 10) -> (1, 20), (2, 30) -> (2, 40)
+	ev, _, err := p.ParseBinlogEvent(makeEvent(BINLOG_EVENT_UPDATE_ROWSv2, 200, 0, rowsBody(1, 2, true, []int{1, 10}, []int{1, 20}, []int{2, 30}, []int{2, 40})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ev.Header.IsRowsUpdateEvent() || ev.Header.IsRowsWriteEvent() || ev.Header.IsRowsDeleteEvent() {
+		t.Errorf("invalid event type: %#v", ev.Header)
+	}
+
+	expecteds := []struct {
+		before []int
+		after  []int
+	}{
+		{[]int{1, 10}, []int{1, 20}},
+		{[]int{2, 30}, []int{2, 40}},
+	}
+	if len(ev.Rows.Rows) != len(expecteds) {
+		t.Fatalf("invalid rows: %#v", ev.Rows.Rows)
+	}
+	for i, s := range expecteds {
+		row := ev.Rows.Rows[i]
+		if row.BeforeRow == nil {
+			t.Errorf("before image was not parsed: %#v", row)
+			continue
+		}
+		for j := range s.after {
+			if !row.Columns[j].IsPresent || row.Columns[j].Int() != s.after[j] {
+				t.Errorf("invalid after image.  expected:%v column:%#v", s.after[j], row.Columns[j])
+			}
+			if row.BeforeRow.Columns[j].Int() != s.before[j] {
+				t.Errorf("invalid before image.  expected:%v column:%v", s.before[j], row.BeforeRow.Columns[j].Int())
+			}
+		}
+	}
+
+	ev, _, err = p.ParseBinlogEvent(makeEvent(BINLOG_EVENT_DELETE_ROWSv2, 300, 0, rowsBody(1, 2, false, []int{1, 20})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ev.Header.IsRowsDeleteEvent() || ev.Rows.Rows[0].BeforeRow != nil || ev.Rows.Rows[0].Columns[1].Int() != 20 {
+		t.Errorf("invalid delete rows: %#v", ev.Rows.Rows)
+	}
+}
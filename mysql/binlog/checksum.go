@@ -0,0 +1,81 @@
+package binlog
+
+import (
+	"fmt"
+	"github.com/uwork/bingo/util"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+const (
+	// mysql source: libbinlogevents/include/binlog_event.h
+	BINLOG_CHECKSUM_ALG_OFF   = 0
+	BINLOG_CHECKSUM_ALG_CRC32 = 1
+	BINLOG_CHECKSUM_ALG_UNDEF = 0xff
+
+	BINLOG_CHECKSUM_LEN = 4
+)
+
+// イベントの CRC32 が一致しない場合のエラー
+type BinlogChecksumError struct {
+	EventType uint8
+	LogPos    uint32
+	Expected  uint32
+	Actual    uint32
+}
+
+func (e *BinlogChecksumError) Error() string {
+	return fmt.Sprintf("binlog event corrupted (type: %#x, log_pos: %d): checksum %#08x != %#08x",
+		e.EventType, e.LogPos, e.Actual, e.Expected)
+}
+
+// チェックサム部分を除いたイベントデータを返す
+func (p *BinlogParser) stripChecksum(head *BinlogEventHeader, data []byte, alg byte) ([]byte, error) {
+	if alg != BINLOG_CHECKSUM_ALG_CRC32 {
+		return data, nil
+	}
+
+	if len(data) < 19+BINLOG_CHECKSUM_LEN {
+		return nil, fmt.Errorf("binlog event data size %d is too small for checksum", len(data))
+	}
+
+	body := data[:len(data)-BINLOG_CHECKSUM_LEN]
+	if p.VerifyChecksum {
+		expected := util.BytesToUint(data[len(body):])
+		actual := crc32.ChecksumIEEE(body)
+		if expected != actual {
+			return nil, &BinlogChecksumError{head.EventType, head.LogPos, expected, actual}
+		}
+	}
+
+	return body, nil
+}
+
+// FORMAT_DESCRIPTION_EVENT にチェックサムアルゴリズムが含まれるバージョンか (5.6.1 以降)
+func hasChecksumAlgorithm(serverVersion string) bool {
+	version := serverVersion
+	if idx := strings.IndexFunc(version, func(r rune) bool { return r != '.' && (r < '0' || '9' < r) }); 0 <= idx {
+		version = version[:idx]
+	}
+
+	nums := []int{}
+	for _, v := range strings.SplitN(version, ".", 3) {
+		num, err := strconv.Atoi(v)
+		if err != nil {
+			return false
+		}
+		nums = append(nums, num)
+	}
+	for len(nums) < 3 {
+		nums = append(nums, 0)
+	}
+
+	if nums[0] != 5 {
+		return nums[0] > 5
+	}
+	if nums[1] != 6 {
+		return nums[1] > 6
+	}
+	return nums[2] >= 1
+}
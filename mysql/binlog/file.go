@@ -0,0 +1,197 @@
+package binlog
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/uwork/bingo/util"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// バイナリログファイルの先頭 4 バイト
+const BINLOG_MAGIC = "\xfebin"
+
+// ローカルのバイナリログファイル (mysql-bin.000001 等) からイベントを読み込む
+// ROTATE_EVENT を読み込むと、同じディレクトリにある次のファイルに移る
+type FileReader struct {
+	// 最初のファイルの StartPos より前のイベントは返さない (FORMAT_DESCRIPTION_EVENT を除く)
+	StartPos uint32
+
+	// StopFile の StopPos 以降のイベントは返さない (StopPos が 0 の場合は制限しない)
+	// StopFile が空の場合は最初のファイル
+	StopFile string
+	StopPos  uint32
+
+	// StartTime より前のイベントは返さず (FORMAT_DESCRIPTION_EVENT を除く)、StopTime 以降のイベントで終了する (ゼロ値の場合は制限しない)
+	StartTime time.Time
+	StopTime  time.Time
+
+	VerifyChecksum bool
+
+	dir    string
+	first  string
+	file   string
+	f      *os.File
+	r      *bufio.Reader
+	pos    uint32
+	parser *BinlogParser
+}
+
+func OpenFile(path string) (*FileReader, error) {
+	r := &FileReader{dir: filepath.Dir(path), first: filepath.Base(path)}
+	err := r.open(r.first)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *FileReader) open(file string) error {
+	path := filepath.Join(r.dir, file)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(f)
+	magic := make([]byte, len(BINLOG_MAGIC))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != BINLOG_MAGIC {
+		f.Close()
+		return fmt.Errorf("invalid binlog file (magic header mismatch): %s", path)
+	}
+
+	if r.f != nil {
+		r.f.Close()
+	}
+	r.file = file
+	r.f = f
+	r.r = br
+	r.pos = uint32(len(BINLOG_MAGIC))
+
+	// ファイルごとに FORMAT_DESCRIPTION_EVENT から読み直す
+	r.parser = &BinlogParser{TableMaps: map[uint64]*BinlogEventTableMap{}}
+	return nil
+}
+
+// 次のイベントを返す
+// 終了位置に達した場合、読み込むファイルが無くなった場合は io.EOF を返す
+func (r *FileReader) Next() (*BinlogEvent, error) {
+	for {
+		if r.f == nil {
+			return nil, io.EOF
+		}
+
+		start := r.pos
+		if r.isStopPos(start) {
+			r.Close()
+			return nil, io.EOF
+		}
+
+		ev, err := r.readEvent()
+		if err == io.EOF {
+			// ROTATE_EVENT の無いファイルの末尾 (書き込み中のファイルなど)
+			r.Close()
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !r.StopTime.IsZero() && ev.Header.EventType != BINLOG_EVENT_FORMAT_DESCRIPTION &&
+			!time.Unix(int64(ev.Header.Timestamp), 0).Before(r.StopTime) {
+			r.Close()
+			return nil, io.EOF
+		}
+
+		skip := r.file == r.first && start < r.StartPos
+		if !r.StartTime.IsZero() && time.Unix(int64(ev.Header.Timestamp), 0).Before(r.StartTime) {
+			skip = true
+		}
+		// FORMAT_DESCRIPTION_EVENT は開始位置や開始時刻より前でも返す (イベントを解析し直す場合に必要)
+		if ev.FormatDescription != nil {
+			skip = false
+		}
+
+		if ev.Rotate != nil && !ev.Header.IsArtificial() {
+			err = r.rotate(ev.Rotate.NextFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !skip {
+			return ev, nil
+		}
+	}
+}
+
+func (r *FileReader) isStopPos(pos uint32) bool {
+	if r.StopPos == 0 {
+		return false
+	}
+	stopFile := r.StopFile
+	if len(stopFile) == 0 {
+		stopFile = r.first
+	}
+	return r.file == stopFile && r.StopPos <= pos
+}
+
+// 次のファイルが存在しない場合はそこで終了する
+func (r *FileReader) rotate(next string) error {
+	if _, err := os.Stat(filepath.Join(r.dir, next)); os.IsNotExist(err) {
+		r.Close()
+		return nil
+	}
+	return r.open(next)
+}
+
+func (r *FileReader) readEvent() (*BinlogEvent, error) {
+	header := make([]byte, 19)
+	n, err := io.ReadFull(r.r, header)
+	if n == 0 && err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("binlog event header read failure: %s:%d (%s)", r.file, r.pos, err)
+	}
+
+	size := util.BytesToUint(header[9:13])
+	if size < 19 {
+		return nil, fmt.Errorf("invalid binlog event size: %s:%d (%d)", r.file, r.pos, size)
+	}
+
+	data := make([]byte, size)
+	copy(data, header)
+	if _, err := io.ReadFull(r.r, data[19:]); err != nil {
+		return nil, fmt.Errorf("binlog event read failure: %s:%d (%s)", r.file, r.pos, err)
+	}
+
+	r.parser.VerifyChecksum = r.VerifyChecksum
+	ev, _, err := r.parser.ParseBinlogEvent(data)
+	if err != nil {
+		return nil, fmt.Errorf("binlog event parse failure: %s:%d (%s)", r.file, r.pos, err)
+	}
+	r.pos += size
+	return ev, nil
+}
+
+// 読み込み済みのファイル名と位置
+func (r *FileReader) Position() (string, uint32) {
+	return r.file, r.pos
+}
+
+// 読み込み中のフォーマット
+func (r *FileReader) Description() *BinlogEventFormatDescription {
+	return r.parser.Description
+}
+
+func (r *FileReader) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
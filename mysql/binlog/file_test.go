@@ -0,0 +1,130 @@
+package binlog
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 先頭からの位置を log_pos に設定してバイナリログファイルを作る
+func writeBinlogFile(t *testing.T, path string, events ...[]byte) {
+	data := []byte(BINLOG_MAGIC)
+	for _, ev := range events {
+		pos := len(data) + len(ev)
+		ev[13], ev[14], ev[15], ev[16] = byte(pos), byte(pos>>8), byte(pos>>16), byte(pos>>24)
+		data = append(data, ev...)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func timestampEvent(timestamp uint32, ev []byte) []byte {
+	ev[0], ev[1], ev[2], ev[3] = byte(timestamp), byte(timestamp>>8), byte(timestamp>>16), byte(timestamp>>24)
+	return ev
+}
+
+func xidEvent(timestamp uint32, xid byte) []byte {
+	return timestampEvent(timestamp, makeEvent(BINLOG_EVENT_XID, 0, 0, []byte{xid, 0, 0, 0, 0, 0, 0, 0}))
+}
+
+func TestFileReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bingo-binlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fd := func() []byte {
+		return timestampEvent(1000, makeEvent(BINLOG_EVENT_FORMAT_DESCRIPTION, 0, 0, formatDescriptionBody("5.7.14-log", BINLOG_CHECKSUM_ALG_OFF)))
+	}
+	rotate := append([]byte{4, 0, 0, 0, 0, 0, 0, 0}, []byte("mysql-bin.000002")...)
+
+	// FORMAT_DESCRIPTION(4-119), XID(119-146), XID(146-173), ROTATE(173-216)
+	writeBinlogFile(t, filepath.Join(dir, "mysql-bin.000001"),
+		fd(), xidEvent(1001, 1), xidEvent(1002, 2), timestampEvent(1003, makeEvent(BINLOG_EVENT_ROTATE, 0, 0, rotate)))
+	writeBinlogFile(t, filepath.Join(dir, "mysql-bin.000002"),
+		fd(), xidEvent(1004, 3), xidEvent(1005, 4))
+
+	expecteds := []struct {
+		startPos  uint32
+		stopFile  string
+		stopPos   uint32
+		startTime uint32
+		stopTime  uint32
+		xids      []uint64
+		file      string
+		fds       int
+	}{
+		{4, "", 0, 0, 0, []uint64{1, 2, 3, 4}, "mysql-bin.000002", 2},
+		{146, "", 0, 0, 0, []uint64{2, 3, 4}, "mysql-bin.000002", 2},
+		{4, "", 146, 0, 0, []uint64{1}, "mysql-bin.000001", 1},
+		{4, "mysql-bin.000002", 146, 0, 0, []uint64{1, 2, 3}, "mysql-bin.000002", 2},
+		{4, "", 0, 1002, 1005, []uint64{2, 3}, "mysql-bin.000002", 2},
+	}
+
+	for _, s := range expecteds {
+		r, err := OpenFile(filepath.Join(dir, "mysql-bin.000001"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.StartPos = s.startPos
+		r.StopFile = s.stopFile
+		r.StopPos = s.stopPos
+		if 0 < s.startTime {
+			r.StartTime = time.Unix(int64(s.startTime), 0)
+		}
+		if 0 < s.stopTime {
+			r.StopTime = time.Unix(int64(s.stopTime), 0)
+		}
+
+		xids := []uint64{}
+		fds := 0
+		for {
+			ev, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ev.Xid != nil {
+				xids = append(xids, ev.Xid.Xid)
+			}
+			if ev.FormatDescription != nil {
+				fds++
+			}
+		}
+
+		// FORMAT_DESCRIPTION_EVENT は開始位置、開始時刻より前でも返す
+		if fds != s.fds {
+			t.Errorf("invalid format descriptions.  expected:%d fds:%d", s.fds, fds)
+		}
+
+		if len(xids) != len(s.xids) {
+			t.Errorf("invalid xids.  expected:%v xids:%v", s.xids, xids)
+		} else {
+			for i := range xids {
+				if xids[i] != s.xids[i] {
+					t.Errorf("invalid xids.  expected:%v xids:%v", s.xids, xids)
+					break
+				}
+			}
+		}
+		if file, _ := r.Position(); file != s.file {
+			t.Errorf("invalid file.  expected:%v file:%v", s.file, file)
+		}
+	}
+
+	// マジックヘッダーが無い
+	path := filepath.Join(dir, "invalid")
+	if err := ioutil.WriteFile(path, []byte("\x00bin"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFile(path); err == nil {
+		t.Errorf("invalid pattern. file without magic header was opened")
+	}
+}
@@ -0,0 +1,248 @@
+package binlog
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GTID の区間 [Start, Stop)
+type GTIDInterval struct {
+	Start int64
+	Stop  int64
+}
+
+// 実行済み GTID の集合 (例: 3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5:7)
+type GTIDSet struct {
+	sets map[string][]GTIDInterval
+}
+
+func NewGTIDSet() *GTIDSet {
+	return &GTIDSet{map[string][]GTIDInterval{}}
+}
+
+// 文字列表現の GTID セットを解析する
+func ParseGTIDSet(str string) (*GTIDSet, error) {
+	s := NewGTIDSet()
+
+	str = strings.TrimSpace(str)
+	if len(str) == 0 {
+		return s, nil
+	}
+
+	for _, part := range strings.Split(str, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ":")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid gtid set: %s", part)
+		}
+
+		sid, err := normalizeSID(fields[0])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, iv := range fields[1:] {
+			nums := strings.SplitN(iv, "-", 2)
+			start, err := strconv.ParseInt(nums[0], 10, 64)
+			if err != nil || start < 1 {
+				return nil, fmt.Errorf("invalid gtid interval: %s", iv)
+			}
+			stop := start
+			if len(nums) == 2 {
+				stop, err = strconv.ParseInt(nums[1], 10, 64)
+				if err != nil || stop < start {
+					return nil, fmt.Errorf("invalid gtid interval: %s", iv)
+				}
+			}
+			s.addInterval(sid, GTIDInterval{start, stop + 1})
+		}
+	}
+
+	return s, nil
+}
+
+// バイナリ表現 (COM_BINLOG_DUMP_GTID, PREVIOUS_GTIDS_LOG_EVENT) の GTID セットを解析する
+func DecodeGTIDSet(data []byte) (*GTIDSet, error) {
+	s := NewGTIDSet()
+	if len(data) < 8 {
+		return nil, fmt.Errorf("invalid gtid set data size: %d", len(data))
+	}
+
+	sidCount, _ := readLittleEndianUvarint(data[:8])
+	pos := 8
+
+	for i := uint64(0); i < sidCount; i++ {
+		if len(data) < pos+16+8 {
+			return nil, fmt.Errorf("invalid gtid set data size: %d", len(data))
+		}
+		sid := formatSID(data[pos : pos+16])
+		pos += 16
+
+		intervalCount, _ := readLittleEndianUvarint(data[pos : pos+8])
+		pos += 8
+
+		if uint64(len(data)-pos) < intervalCount*16 {
+			return nil, fmt.Errorf("invalid gtid set data size: %d", len(data))
+		}
+		for j := uint64(0); j < intervalCount; j++ {
+			start, _ := readLittleEndianUvarint(data[pos : pos+8])
+			stop, _ := readLittleEndianUvarint(data[pos+8 : pos+16])
+			pos += 16
+			s.addInterval(sid, GTIDInterval{int64(start), int64(stop)})
+		}
+	}
+
+	return s, nil
+}
+
+// バイナリ表現に変換する
+func (s *GTIDSet) Encode() []byte {
+	sids := s.sortedSIDs()
+
+	data := writeLittleEndianUint64(nil, uint64(len(sids)))
+	for _, sid := range sids {
+		b, _ := hex.DecodeString(strings.Replace(sid, "-", "", -1))
+		data = append(data, b...)
+
+		intervals := s.sets[sid]
+		data = writeLittleEndianUint64(data, uint64(len(intervals)))
+		for _, iv := range intervals {
+			data = writeLittleEndianUint64(data, uint64(iv.Start))
+			data = writeLittleEndianUint64(data, uint64(iv.Stop))
+		}
+	}
+
+	return data
+}
+
+func (s *GTIDSet) String() string {
+	parts := []string{}
+	for _, sid := range s.sortedSIDs() {
+		part := sid
+		for _, iv := range s.sets[sid] {
+			if iv.Stop-1 == iv.Start {
+				part += fmt.Sprintf(":%d", iv.Start)
+			} else {
+				part += fmt.Sprintf(":%d-%d", iv.Start, iv.Stop-1)
+			}
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s *GTIDSet) Clone() *GTIDSet {
+	c := NewGTIDSet()
+	for sid, intervals := range s.sets {
+		c.sets[sid] = append([]GTIDInterval{}, intervals...)
+	}
+	return c
+}
+
+// GTID を1つ追加する
+func (s *GTIDSet) Add(sid string, gno int64) error {
+	sid, err := normalizeSID(sid)
+	if err != nil {
+		return err
+	}
+	s.addInterval(sid, GTIDInterval{gno, gno + 1})
+	return nil
+}
+
+// 他の GTID セットを追加する
+func (s *GTIDSet) Union(other *GTIDSet) {
+	for sid, intervals := range other.sets {
+		for _, iv := range intervals {
+			s.addInterval(sid, iv)
+		}
+	}
+}
+
+// GTID が含まれるか
+func (s *GTIDSet) ContainsGTID(sid string, gno int64) bool {
+	sid, err := normalizeSID(sid)
+	if err != nil {
+		return false
+	}
+	for _, iv := range s.sets[sid] {
+		if iv.Start <= gno && gno < iv.Stop {
+			return true
+		}
+	}
+	return false
+}
+
+// 他の GTID セットをすべて含むか
+func (s *GTIDSet) Contains(other *GTIDSet) bool {
+	for sid, intervals := range other.sets {
+		for _, iv := range intervals {
+			if !s.containsInterval(sid, iv) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *GTIDSet) containsInterval(sid string, target GTIDInterval) bool {
+	for _, iv := range s.sets[sid] {
+		if iv.Start <= target.Start && target.Stop <= iv.Stop {
+			return true
+		}
+	}
+	return false
+}
+
+// 区間を追加して、重なり・隣接する区間をまとめる
+func (s *GTIDSet) addInterval(sid string, add GTIDInterval) {
+	if add.Stop <= add.Start {
+		return
+	}
+
+	intervals := append(s.sets[sid], add)
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].Start < intervals[j].Start })
+
+	merged := []GTIDInterval{}
+	for _, iv := range intervals {
+		last := len(merged) - 1
+		if 0 <= last && iv.Start <= merged[last].Stop {
+			if merged[last].Stop < iv.Stop {
+				merged[last].Stop = iv.Stop
+			}
+		} else {
+			merged = append(merged, iv)
+		}
+	}
+	s.sets[sid] = merged
+}
+
+func (s *GTIDSet) sortedSIDs() []string {
+	sids := []string{}
+	for sid := range s.sets {
+		sids = append(sids, sid)
+	}
+	sort.Strings(sids)
+	return sids
+}
+
+func normalizeSID(sid string) (string, error) {
+	b, err := hex.DecodeString(strings.Replace(strings.TrimSpace(sid), "-", "", -1))
+	if err != nil || len(b) != 16 {
+		return "", fmt.Errorf("invalid server uuid: %s", sid)
+	}
+	return formatSID(b), nil
+}
+
+func formatSID(b []byte) string {
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+func writeLittleEndianUint64(data []byte, v uint64) []byte {
+	for i := uint(0); i < 8; i++ {
+		data = append(data, byte(v>>(i*8)))
+	}
+	return data
+}
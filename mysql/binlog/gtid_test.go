@@ -0,0 +1,152 @@
+package binlog
+
+import (
+	"reflect"
+	"testing"
+)
+
+const (
+	testSID1 = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	testSID2 = "5c7a8f62-2b2e-11e6-8e9c-080027a3c27f"
+)
+
+func TestParseGTIDSet(t *testing.T) {
+	expecteds := []struct {
+		input  string
+		isOk   bool
+		result string
+	}{
+		{"", true, ""},
+		{testSID1 + ":1-5", true, testSID1 + ":1-5"},
+		{testSID1 + ":1-5:6-8:10", true, testSID1 + ":1-8:10"},
+		{testSID1 + ":7:1-3", true, testSID1 + ":1-3:7"},
+		{"3E11FA47-71CA-11E1-9E33-C80AA9429562:1", true, testSID1 + ":1"},
+		{testSID2 + ":1-3,\n" + testSID1 + ":1-2", true, testSID1 + ":1-2," + testSID2 + ":1-3"},
+		{testSID1, false, ""},
+		{testSID1 + ":0", false, ""},
+		{testSID1 + ":5-3", false, ""},
+		{"invalid:1-3", false, ""},
+	}
+
+	for _, s := range expecteds {
+		set, err := ParseGTIDSet(s.input)
+		if !s.isOk {
+			if err == nil {
+				t.Errorf("invalid pattern. input: %v", s.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parse error: %v", err)
+			continue
+		}
+		if set.String() != s.result {
+			t.Errorf("invalid gtid set.  expected:%v set:%v", s.result, set.String())
+		}
+	}
+}
+
+func TestGTIDSetUnionContains(t *testing.T) {
+	set, _ := ParseGTIDSet(testSID1 + ":1-5")
+	other, _ := ParseGTIDSet(testSID1 + ":6-7:10," + testSID2 + ":1")
+
+	if set.Contains(other) {
+		t.Errorf("invalid contains: %v contains %v", set, other)
+	}
+
+	set.Union(other)
+	if set.String() != testSID1+":1-7:10,"+testSID2+":1" {
+		t.Errorf("invalid union: %v", set)
+	}
+	if !set.Contains(other) {
+		t.Errorf("invalid contains: %v not contains %v", set, other)
+	}
+
+	set.Add(testSID1, 8)
+	set.Add(testSID1, 9)
+	if set.String() != testSID1+":1-10,"+testSID2+":1" {
+		t.Errorf("invalid add: %v", set)
+	}
+
+	expecteds := []struct {
+		sid    string
+		gno    int64
+		result bool
+	}{
+		{testSID1, 1, true},
+		{testSID1, 10, true},
+		{testSID1, 11, false},
+		{testSID2, 1, true},
+		{testSID2, 2, false},
+		{"invalid", 1, false},
+	}
+	for _, s := range expecteds {
+		if set.ContainsGTID(s.sid, s.gno) != s.result {
+			t.Errorf("invalid contains.  gtid:%s:%d expected:%v", s.sid, s.gno, s.result)
+		}
+	}
+}
+
+func TestGTIDSetEncode(t *testing.T) {
+	set, _ := ParseGTIDSet(testSID1 + ":1-5:7")
+
+	expected := []byte{
+		1, 0, 0, 0, 0, 0, 0, 0,
+		0x3e, 0x11, 0xfa, 0x47, 0x71, 0xca, 0x11, 0xe1, 0x9e, 0x33, 0xc8, 0x0a, 0xa9, 0x42, 0x95, 0x62,
+		2, 0, 0, 0, 0, 0, 0, 0,
+		1, 0, 0, 0, 0, 0, 0, 0, 6, 0, 0, 0, 0, 0, 0, 0,
+		7, 0, 0, 0, 0, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0,
+	}
+	data := set.Encode()
+	if !reflect.DeepEqual(expected, data) {
+		t.Errorf("invalid encode.  expected:%v data:%v", expected, data)
+	}
+
+	decoded, err := DecodeGTIDSet(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.String() != set.String() {
+		t.Errorf("invalid decode.  expected:%v set:%v", set, decoded)
+	}
+
+	_, err = DecodeGTIDSet(data[:20])
+	if err == nil {
+		t.Errorf("invalid pattern. short data was decoded")
+	}
+}
+
+func TestGTIDEvent(t *testing.T) {
+	p := getParser(t)
+
+	body := []byte{1,
+		0x3e, 0x11, 0xfa, 0x47, 0x71, 0xca, 0x11, 0xe1, 0x9e, 0x33, 0xc8, 0x0a, 0xa9, 0x42, 0x95, 0x62,
+		42, 0, 0, 0, 0, 0, 0, 0,
+		2, 3, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0,
+	}
+	ev, _, err := p.ParseBinlogEvent(makeEvent(BINLOG_EVENT_GTID, 100, 0, body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := ev.GTID
+	if g == nil || g.String() != testSID1+":42" || g.Anonymous || !g.CommitFlag || g.LastCommitted != 3 || g.SequenceNumber != 4 {
+		t.Errorf("invalid gtid event: %#v", g)
+	}
+
+	ev, _, err = p.ParseBinlogEvent(makeEvent(BINLOG_EVENT_ANONYMOUS_GTID, 100, 0, body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.GTID == nil || !ev.GTID.Anonymous {
+		t.Errorf("invalid anonymous gtid event: %#v", ev.GTID)
+	}
+
+	set, _ := ParseGTIDSet(testSID1 + ":1-41")
+	ev, _, err = p.ParseBinlogEvent(makeEvent(BINLOG_EVENT_PREVIOUS_GTIDS, 100, 0, set.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.PreviousGTIDs == nil || ev.PreviousGTIDs.GTIDSet.String() != set.String() {
+		t.Errorf("invalid previous gtids event: %#v", ev.PreviousGTIDs)
+	}
+}
@@ -0,0 +1,323 @@
+package binlog
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// mysql-source: sql/json_binary.h
+const (
+	JSONB_TYPE_SMALL_OBJECT = 0x00
+	JSONB_TYPE_LARGE_OBJECT = 0x01
+	JSONB_TYPE_SMALL_ARRAY  = 0x02
+	JSONB_TYPE_LARGE_ARRAY  = 0x03
+	JSONB_TYPE_LITERAL      = 0x04
+	JSONB_TYPE_INT16        = 0x05
+	JSONB_TYPE_UINT16       = 0x06
+	JSONB_TYPE_INT32        = 0x07
+	JSONB_TYPE_UINT32       = 0x08
+	JSONB_TYPE_INT64        = 0x09
+	JSONB_TYPE_UINT64       = 0x0a
+	JSONB_TYPE_DOUBLE       = 0x0b
+	JSONB_TYPE_STRING       = 0x0c
+	JSONB_TYPE_OPAQUE       = 0x0f
+
+	JSONB_LITERAL_NULL  = 0x00
+	JSONB_LITERAL_TRUE  = 0x01
+	JSONB_LITERAL_FALSE = 0x02
+)
+
+// MySQL のバイナリ JSON を JSON 文字列に変換する
+// オブジェクトのキーはバイナリ JSON に格納されている順 (キーの長さ順) で出力する
+func DecodeJSONB(data []byte) (string, error) {
+	// 空の場合は JSON の null (カラム自体の NULL は null-bitmap で表される)
+	if len(data) == 0 {
+		return "null", nil
+	}
+
+	d := &jsonbDecoder{}
+	err := d.decodeValue(data[0], data[1:])
+	if err != nil {
+		return "", err
+	}
+	return d.buf.String(), nil
+}
+
+type jsonbDecoder struct {
+	buf bytes.Buffer
+}
+
+func (d *jsonbDecoder) decodeValue(t byte, data []byte) error {
+	switch t {
+	case JSONB_TYPE_SMALL_OBJECT:
+		return d.decodeComposite(data, true, false)
+	case JSONB_TYPE_LARGE_OBJECT:
+		return d.decodeComposite(data, true, true)
+	case JSONB_TYPE_SMALL_ARRAY:
+		return d.decodeComposite(data, false, false)
+	case JSONB_TYPE_LARGE_ARRAY:
+		return d.decodeComposite(data, false, true)
+
+	case JSONB_TYPE_LITERAL:
+		if len(data) < 1 {
+			return jsonbError("literal", data)
+		}
+		return d.decodeLiteral(data[0])
+
+	case JSONB_TYPE_INT16:
+		if len(data) < 2 {
+			return jsonbError("int16", data)
+		}
+		d.buf.WriteString(strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(data))), 10))
+	case JSONB_TYPE_UINT16:
+		if len(data) < 2 {
+			return jsonbError("uint16", data)
+		}
+		d.buf.WriteString(strconv.FormatUint(uint64(binary.LittleEndian.Uint16(data)), 10))
+	case JSONB_TYPE_INT32:
+		if len(data) < 4 {
+			return jsonbError("int32", data)
+		}
+		d.buf.WriteString(strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(data))), 10))
+	case JSONB_TYPE_UINT32:
+		if len(data) < 4 {
+			return jsonbError("uint32", data)
+		}
+		d.buf.WriteString(strconv.FormatUint(uint64(binary.LittleEndian.Uint32(data)), 10))
+	case JSONB_TYPE_INT64:
+		if len(data) < 8 {
+			return jsonbError("int64", data)
+		}
+		d.buf.WriteString(strconv.FormatInt(int64(binary.LittleEndian.Uint64(data)), 10))
+	case JSONB_TYPE_UINT64:
+		if len(data) < 8 {
+			return jsonbError("uint64", data)
+		}
+		d.buf.WriteString(strconv.FormatUint(binary.LittleEndian.Uint64(data), 10))
+	case JSONB_TYPE_DOUBLE:
+		if len(data) < 8 {
+			return jsonbError("double", data)
+		}
+		f := math.Float64frombits(binary.LittleEndian.Uint64(data))
+		d.buf.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+
+	case JSONB_TYPE_STRING:
+		size, n, err := readJSONBVarLength(data)
+		if err != nil || len(data) < n+size {
+			return jsonbError("string", data)
+		}
+		d.writeString(string(data[n : n+size]))
+
+	case JSONB_TYPE_OPAQUE:
+		return d.decodeOpaque(data)
+
+	default:
+		return fmt.Errorf("unknown jsonb type: %d", t)
+	}
+	return nil
+}
+
+func (d *jsonbDecoder) decodeLiteral(v byte) error {
+	switch v {
+	case JSONB_LITERAL_NULL:
+		d.buf.WriteString("null")
+	case JSONB_LITERAL_TRUE:
+		d.buf.WriteString("true")
+	case JSONB_LITERAL_FALSE:
+		d.buf.WriteString("false")
+	default:
+		return fmt.Errorf("unknown jsonb literal: %d", v)
+	}
+	return nil
+}
+
+// object, array
+// offset はこの値の先頭 (element-count) からの位置
+func (d *jsonbDecoder) decodeComposite(data []byte, isObject bool, large bool) error {
+	offsetSize := 2
+	if large {
+		offsetSize = 4
+	}
+	readOffset := func(pos int) int {
+		if large {
+			return int(binary.LittleEndian.Uint32(data[pos:]))
+		}
+		return int(binary.LittleEndian.Uint16(data[pos:]))
+	}
+
+	if len(data) < offsetSize*2 {
+		return jsonbError("composite header", data)
+	}
+	count := readOffset(0)
+	size := readOffset(offsetSize)
+	if len(data) < size {
+		return jsonbError("composite", data)
+	}
+	data = data[:size]
+
+	keyEntrySize := 0
+	if isObject {
+		keyEntrySize = offsetSize + 2
+	}
+	valueEntrySize := 1 + offsetSize
+
+	headerSize := offsetSize*2 + count*(keyEntrySize+valueEntrySize)
+	if len(data) < headerSize {
+		return jsonbError("composite entries", data)
+	}
+
+	if isObject {
+		d.buf.WriteByte('{')
+	} else {
+		d.buf.WriteByte('[')
+	}
+
+	for i := 0; i < count; i++ {
+		if 0 < i {
+			d.buf.WriteString(", ")
+		}
+
+		if isObject {
+			keyEntry := offsetSize*2 + i*keyEntrySize
+			keyOffset := readOffset(keyEntry)
+			keyLen := int(binary.LittleEndian.Uint16(data[keyEntry+offsetSize:]))
+			if len(data) < keyOffset+keyLen {
+				return jsonbError("object key", data)
+			}
+			d.writeString(string(data[keyOffset : keyOffset+keyLen]))
+			d.buf.WriteString(": ")
+		}
+
+		valueEntry := offsetSize*2 + count*keyEntrySize + i*valueEntrySize
+		t := data[valueEntry]
+
+		// literal, int16, uint16 (large の場合は int32, uint32 も) は値が entry に入っている
+		inlined := t == JSONB_TYPE_LITERAL || t == JSONB_TYPE_INT16 || t == JSONB_TYPE_UINT16
+		if large && (t == JSONB_TYPE_INT32 || t == JSONB_TYPE_UINT32) {
+			inlined = true
+		}
+
+		var err error
+		if inlined {
+			err = d.decodeValue(t, data[valueEntry+1:valueEntry+valueEntrySize])
+		} else {
+			offset := readOffset(valueEntry + 1)
+			if len(data) <= offset {
+				return jsonbError("value offset", data)
+			}
+			err = d.decodeValue(t, data[offset:])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if isObject {
+		d.buf.WriteByte('}')
+	} else {
+		d.buf.WriteByte(']')
+	}
+	return nil
+}
+
+// opaque: カラムの型 + 可変長のサイズ + データ
+func (d *jsonbDecoder) decodeOpaque(data []byte) error {
+	if len(data) < 1 {
+		return jsonbError("opaque", data)
+	}
+	fieldType := data[0]
+	size, n, err := readJSONBVarLength(data[1:])
+	if err != nil || len(data) < 1+n+size {
+		return jsonbError("opaque", data)
+	}
+	data = data[1+n : 1+n+size]
+
+	switch fieldType {
+	case TYPE_NEWDECIMAL:
+		if len(data) < 2 {
+			return jsonbError("decimal", data)
+		}
+		dec, _, err := readDecimal(data[2:], int(data[0]), int(data[1]))
+		if err != nil {
+			return err
+		}
+		d.buf.WriteString(dec)
+		return nil
+
+	case TYPE_DATETIME, TYPE_TIMESTAMP, TYPE_DATE, TYPE_TIME:
+		if len(data) < 8 {
+			return jsonbError("datetime", data)
+		}
+		packed := int64(binary.LittleEndian.Uint64(data))
+		d.writeString(formatPackedTime(fieldType, packed))
+		return nil
+	}
+
+	// その他の型は MySQL と同じく base64 で出力する
+	d.writeString(fmt.Sprintf("base64:type%d:%s", fieldType, base64.StdEncoding.EncodeToString(data)))
+	return nil
+}
+
+func (d *jsonbDecoder) writeString(s string) {
+	enc := json.NewEncoder(&d.buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+
+	// Encode は末尾に改行を付ける
+	d.buf.Truncate(d.buf.Len() - 1)
+}
+
+// mysql-source: sql-common/my_time.c (TIME_from_longlong_*_packed)
+func formatPackedTime(fieldType byte, packed int64) string {
+	sign := ""
+	if packed < 0 {
+		sign = "-"
+		packed = -packed
+	}
+	intpart := packed >> 24
+	frac := packed % (1 << 24)
+
+	if fieldType == TYPE_TIME {
+		hour := (intpart >> 12) % (1 << 10)
+		minute := (intpart >> 6) % (1 << 6)
+		second := intpart % (1 << 6)
+		return fmt.Sprintf("%s%02d:%02d:%02d.%06d", sign, hour, minute, second, frac)
+	}
+
+	ymd := intpart >> 17
+	ym := ymd >> 5
+	hms := intpart % (1 << 17)
+
+	year := ym / 13
+	month := ym % 13
+	day := ymd % (1 << 5)
+	if fieldType == TYPE_DATE {
+		return fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	}
+
+	hour := hms >> 12
+	minute := (hms >> 6) % (1 << 6)
+	second := hms % (1 << 6)
+	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d.%06d", year, month, day, hour, minute, second, frac)
+}
+
+// 7bit ずつ下位から格納され、最上位ビットが立っている場合は続きがある
+func readJSONBVarLength(data []byte) (int, int, error) {
+	length := 0
+	for i := 0; i < 5 && i < len(data); i++ {
+		length |= int(data[i]&0x7f) << uint(7*i)
+		if data[i]&0x80 == 0 {
+			return length, i + 1, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid jsonb variable length: %v", data)
+}
+
+func jsonbError(name string, data []byte) error {
+	return fmt.Errorf("invalid jsonb %s: %v", name, data)
+}
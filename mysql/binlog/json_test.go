@@ -0,0 +1,96 @@
+package binlog
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func packedDatetime(year, month, day, hour, minute, second, frac int64) []byte {
+	ymd := (year*13+month)<<5 | day
+	hms := hour<<12 | minute<<6 | second
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64((ymd<<17|hms)<<24|frac))
+	return buf
+}
+
+func TestDecodeJSONB(t *testing.T) {
+	expecteds := []struct {
+		data []byte
+		json string
+	}{
+		{[]byte{}, `null`},
+		{[]byte{0x04, 0x00}, `null`},
+		{[]byte{0x04, 0x02}, `false`},
+		{[]byte{0x05, 0xff, 0xff}, `-1`},
+		{[]byte{0x06, 0xff, 0xff}, `65535`},
+		{[]byte{0x07, 0x70, 0x11, 0x01, 0x00}, `70000`},
+		{[]byte{0x08, 0xff, 0xff, 0xff, 0xff}, `4294967295`},
+		{[]byte{0x09, 0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, `-2`},
+		{[]byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, `18446744073709551615`},
+		{[]byte{0x0b, 0x1f, 0x85, 0xeb, 0x51, 0xb8, 0x1e, 0x09, 0x40}, `3.14`},
+		{append([]byte{0x0c, 0x0a}, []byte(`"<hello>"\`)...), `"\"<hello>\"\\"`},
+		{append([]byte{0x0c, 0x06}, []byte("はろ")...), `"はろ"`},
+		// {"a": 1, "b": [true, null, "x"]}
+		{[]byte{0x00, 0x02, 0x00, 0x23, 0x00, 0x12, 0x00, 0x01, 0x00, 0x13, 0x00, 0x01, 0x00, 0x05, 0x01, 0x00, 0x02, 0x14, 0x00, 0x61, 0x62,
+			0x03, 0x00, 0x0f, 0x00, 0x04, 0x01, 0x00, 0x04, 0x00, 0x00, 0x0c, 0x0d, 0x00, 0x01, 0x78}, `{"a": 1, "b": [true, null, "x"]}`},
+		// {"k": 70000} (large object)
+		{[]byte{0x01, 0x01, 0x00, 0x00, 0x00, 0x14, 0x00, 0x00, 0x00, 0x13, 0x00, 0x00, 0x00, 0x01, 0x00, 0x07, 0x70, 0x11, 0x01, 0x00, 0x6b}, `{"k": 70000}`},
+		// []
+		{[]byte{0x02, 0x00, 0x00, 0x04, 0x00}, `[]`},
+		// opaque decimal(8,2)
+		{[]byte{0x0f, TYPE_NEWDECIMAL, 0x06, 0x08, 0x02, 0x80, 0x0b, 0xd8, 0x31}, `3032.49`},
+		{[]byte{0x0f, TYPE_NEWDECIMAL, 0x06, 0x08, 0x02, 0x7f, 0xf4, 0x27, 0xce}, `-3032.49`},
+		// opaque datetime, date, time
+		{append([]byte{0x0f, TYPE_DATETIME, 0x08}, packedDatetime(2015, 1, 15, 23, 24, 25, 123456)...), `"2015-01-15 23:24:25.123456"`},
+		{append([]byte{0x0f, TYPE_DATE, 0x08}, packedDatetime(2015, 1, 15, 0, 0, 0, 0)...), `"2015-01-15"`},
+		{append([]byte{0x0f, TYPE_TIME, 0x08}, packedDatetime(0, 0, 0, 12, 34, 56, 0)...), `"12:34:56.000000"`},
+		// opaque (その他)
+		{[]byte{0x0f, TYPE_BLOB, 0x02, 0x61, 0x62}, `"base64:type252:YWI="`},
+	}
+
+	for _, s := range expecteds {
+		json, err := DecodeJSONB(s.data)
+		if err != nil {
+			t.Errorf("decode error: %v data:%v", err, s.data)
+			continue
+		}
+		if json != s.json {
+			t.Errorf("invalid json.  expected:%v json:%v", s.json, json)
+		}
+	}
+
+	errors := [][]byte{
+		{0x05, 0x01},
+		{0x0c, 0x05, 0x61},
+		{0x00, 0x02, 0x00, 0x23, 0x00},
+		{0x04, 0x03},
+		{0x0e},
+	}
+	for _, data := range errors {
+		if json, err := DecodeJSONB(data); err == nil {
+			t.Errorf("invalid jsonb was decoded: %v json:%v", data, json)
+		}
+	}
+}
+
+func TestReadDecimal(t *testing.T) {
+	expecteds := []struct {
+		data  []byte
+		prec  int
+		dec   int
+		value string
+	}{
+		{[]byte{0x80, 0x0b, 0xd8, 0x31}, 8, 2, "3032.49"},
+		{[]byte{0x80, 0x00, 0x00, 0x00, 0x00}, 10, 0, "0"},
+		{[]byte{0x80, 0x05}, 4, 2, "0.05"},
+		{[]byte{0x81, 0x0d, 0xfb, 0x38, 0xd2, 0x00, 0xbc, 0x61, 0x4e, 0x09}, 20, 10, "1234567890.0123456789"},
+		{[]byte{0x7e, 0xf2, 0x04, 0xc7, 0x2d, 0xff, 0x43, 0x9e, 0xb1, 0xf6}, 20, 10, "-1234567890.0123456789"},
+	}
+
+	for _, s := range expecteds {
+		value, size, err := readDecimal(s.data, s.prec, s.dec)
+		if err != nil || value != s.value || size != len(s.data) {
+			t.Errorf("invalid decimal.  expected:%v value:%v size:%v err:%v", s.value, value, size, err)
+		}
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"github.com/uwork/bingo/util"
 	"math"
-	"strconv"
 )
 
 const (
@@ -51,7 +50,7 @@ var DECIMAL_SIZES = [...]int{0, 1, 1, 2, 2, 3, 3, 4, 4, 4}
 func (p *BinlogParser) parseBinlogTableMap(ev *BinlogEvent, data []byte) error {
 
 	tableIdSize := 6
-	if p.Description.EventTypeHeadersLength[BINLOG_EVENT_TABLE_MAP] == 6 {
+	if p.postHeaderLength(BINLOG_EVENT_TABLE_MAP) == 6 {
 		tableIdSize = 4
 	}
 
@@ -141,7 +140,7 @@ func (p *BinlogParser) parseBinlogTableMap(ev *BinlogEvent, data []byte) error {
 func (p *BinlogParser) parseBinlogRows(ev *BinlogEvent, data []byte) error {
 
 	tableIdSize := 6
-	if p.Description.EventTypeHeadersLength[BINLOG_EVENT_TABLE_MAP] == 6 {
+	if p.postHeaderLength(BINLOG_EVENT_TABLE_MAP) == 6 {
 		tableIdSize = 4
 	}
 
@@ -152,6 +151,10 @@ func (p *BinlogParser) parseBinlogRows(ev *BinlogEvent, data []byte) error {
 	pos := tableIdSize
 
 	tmap := p.TableMaps[r.TableId]
+	if tmap == nil {
+		// TABLE_MAP_EVENT より後の位置から読み込んだ場合
+		return fmt.Errorf("unknown table id: %d", r.TableId)
+	}
 	r.Schema = tmap.SchemaName
 	r.Table = tmap.TableName
 
@@ -196,12 +199,16 @@ func (p *BinlogParser) parseBinlogRows(ev *BinlogEvent, data []byte) error {
 		}
 		pos += n
 
+		// update は before image, after image の順に並んでいる
 		if ev.Header.IsRowsUpdateEvent() {
-			rowBefore, n, err := p.parseRowBinary(ev, r, presentedUpdateColumns, data[pos:])
+			rowAfter, n, err := p.parseRowBinary(ev, r, presentedUpdateColumns, data[pos:])
 			if err != nil {
 				return err
 			}
 			pos += n
+
+			rowBefore := row
+			row = rowAfter
 			row.BeforeRow = &rowBefore
 		}
 		r.Rows = append(r.Rows, row)
@@ -215,6 +222,9 @@ func (p *BinlogParser) parseRowBinary(ev *BinlogEvent, r *BinlogEventRows, prese
 	tmap := p.TableMaps[r.TableId]
 	row := Row{}
 	row.IsEnableColumns = presentedColumns
+	if len(tmap.ColumnNames) == tmap.ColumnCount {
+		row.ColumnNames = tmap.ColumnNames
+	}
 
 	// null-bitmap
 	nullBitmapsSize := (tmap.ColumnCount + 7) / 8
@@ -233,6 +243,7 @@ func (p *BinlogParser) parseRowBinary(ev *BinlogEvent, r *BinlogEventRows, prese
 			col.IsPresent = true
 			row.Columns = append(row.Columns, col)
 		} else {
+			col.IsPresent = true
 			col.Type = tmap.ColumnTypes[i]
 			col.Meta = tmap.ColumnMetas[i]
 
@@ -242,58 +253,14 @@ func (p *BinlogParser) parseRowBinary(ev *BinlogEvent, r *BinlogEventRows, prese
 			switch col.Type {
 			case TYPE_NEWDECIMAL:
 				// mysql source: strings/decimal.c
-				prec := col.Meta >> 8
-				dec := col.Meta & 0xff
-				intg := prec - dec
-
-				intg0 := int(float64(intg) / 9.0)
-				frac0 := int(float64(dec) / 9.0)
-				intg0x := intg - intg0*9
-				frac0x := dec - frac0*9
-
-				intsize := intg0*4 + DECIMAL_SIZES[intg0x]
-				decsize := frac0*4 + DECIMAL_SIZES[frac0x]
-
-				size = int(intsize + decsize)
-
+				str, size, err := readDecimal(data[pos:], col.Meta>>8, col.Meta&0xff)
+				if err != nil {
+					return row, pos, err
+				}
 				col.bin = data[pos : pos+size]
+				col.str = str
 				pos += size
 
-				// sign
-				sign := ""
-				if col.bin[0]&0x80 == 0 {
-					sign = "-"
-				}
-				col.bin[0] ^= 0x80 // remove sign flag
-
-				ints := "0"
-				decs := "0"
-
-				offset := 0
-				if 0 < intsize {
-					buff, _ := readBigEndianVarint(col.bin[offset : offset+DECIMAL_SIZES[intg0x]])
-					ints = strconv.Itoa(int(buff))
-					offset += DECIMAL_SIZES[intg0x]
-					for i := 0; i < intg0; i++ {
-						buff, _ = readBigEndianVarint(col.bin[offset : offset+4])
-						ints += strconv.Itoa(int(buff))
-						offset += 4
-					}
-				}
-
-				if 0 < decsize {
-					buff, _ := readBigEndianVarint(col.bin[offset : offset+DECIMAL_SIZES[frac0x]])
-					decs = strconv.Itoa(int(buff))
-					offset += DECIMAL_SIZES[frac0x]
-					for i := 0; i < frac0; i++ {
-						buff, _ = readBigEndianVarint(col.bin[offset : offset+4])
-						decs += strconv.Itoa(int(buff))
-						offset += 4
-					}
-				}
-
-				col.str = fmt.Sprintf("%s%s.%s", sign, ints, decs)
-
 			case TYPE_FLOAT, TYPE_DOUBLE:
 				size = int(col.Meta)
 				buf := data[pos : pos+size]
@@ -410,7 +377,8 @@ func (p *BinlogParser) parseRowBinary(ev *BinlogEvent, r *BinlogEventRows, prese
 			case TYPE_DATETIME:
 				// TODO
 				size = 8
-				num, _ := readLittleEndianVarint(data[pos : pos+size])
+				col.bin = data[pos : pos+size]
+				num, _ := readLittleEndianVarint(col.bin)
 				col.num = int(num)
 				pos += size
 
@@ -449,6 +417,14 @@ func (p *BinlogParser) parseRowBinary(ev *BinlogEvent, r *BinlogEventRows, prese
 				col.bin = data[pos : pos+int(strlen)]
 				pos += int(strlen)
 
+				if col.Type == TYPE_JSON {
+					str, err := DecodeJSONB(col.bin)
+					if err != nil {
+						return row, pos, err
+					}
+					col.str = str
+				}
+
 			default:
 				// unknown
 				col.bin = []byte{}
@@ -0,0 +1,81 @@
+package binlog
+
+// BEGIN から COMMIT (XID_EVENT) までの ROWS_EVENT
+type Transaction struct {
+	GTID   *BinlogEventGTID
+	Xid    uint64
+	Events []*BinlogEvent
+
+	// コミットしたイベント (XID_EVENT, QUERY_EVENT) のタイムスタンプと位置
+	Timestamp uint32
+	LogPos    uint32
+}
+
+// GTID がある場合は "sid:gno" を返す (ANONYMOUS_GTID の場合は空)
+func (tx *Transaction) GTIDString() string {
+	if tx.GTID == nil || tx.GTID.Anonymous {
+		return ""
+	}
+	return tx.GTID.String()
+}
+
+// イベントをトランザクション単位にまとめる
+type TransactionAssembler struct {
+	gtid *BinlogEventGTID
+	tx   *Transaction
+
+	// BEGIN から COMMIT までの間
+	inTransaction bool
+}
+
+func NewTransactionAssembler() *TransactionAssembler {
+	return &TransactionAssembler{}
+}
+
+// イベントを追加し、トランザクションが終わった場合はそのトランザクションを返す
+// BEGIN を伴わない QUERY_EVENT (DDL など) は ROWS_EVENT の無いトランザクションとして返す
+// BEGIN の後の SAVEPOINT などの QUERY_EVENT では区切らない
+func (a *TransactionAssembler) Add(ev *BinlogEvent) *Transaction {
+	switch {
+	case ev.GTID != nil:
+		a.gtid = ev.GTID
+
+	case ev.IsBegin():
+		a.begin()
+		a.inTransaction = true
+
+	case ev.Rows != nil:
+		if a.tx == nil {
+			a.begin()
+		}
+		a.tx.Events = append(a.tx.Events, ev)
+
+	case ev.IsCommit(a.inTransaction):
+		if a.tx == nil {
+			a.begin()
+		}
+		tx := a.tx
+		if ev.Xid != nil {
+			tx.Xid = ev.Xid.Xid
+		}
+		tx.Timestamp = ev.Header.Timestamp
+		tx.LogPos = ev.Header.LogPos
+
+		a.tx = nil
+		a.gtid = nil
+		a.inTransaction = false
+		return tx
+	}
+	return nil
+}
+
+// 途中のトランザクションを破棄する (再接続してトランザクションの先頭から読み直す場合)
+func (a *TransactionAssembler) Reset() {
+	a.tx = nil
+	a.gtid = nil
+	a.inTransaction = false
+}
+
+func (a *TransactionAssembler) begin() {
+	a.tx = &Transaction{GTID: a.gtid}
+}
@@ -0,0 +1,102 @@
+package binlog
+
+import (
+	"testing"
+)
+
+func TestTransactionAssembler(t *testing.T) {
+	p := getParser(t)
+
+	gtidBody := append([]byte{0x01}, make([]byte, 16)...)
+	gtidBody = append(gtidBody, 0x05, 0, 0, 0, 0, 0, 0, 0)
+	queryBody := func(query string) []byte {
+		// slave_proxy_id, execution time, schema length, error code, status vars length
+		body := []byte{0, 0, 0, 0, 0, 0, 0, 0, 6, 0, 0, 0, 0}
+		return append(append(body, []byte("testdb")...), append([]byte{0}, []byte(query)...)...)
+	}
+	xidBody := []byte{0x2a, 0, 0, 0, 0, 0, 0, 0}
+
+	events := [][]byte{
+		makeEvent(BINLOG_EVENT_GTID, 100, 0, gtidBody),
+		makeEvent(BINLOG_EVENT_QUERY, 200, 0, queryBody("BEGIN")),
+		makeEvent(BINLOG_EVENT_TABLE_MAP, 300, 0, tableMapBody(1, "testdb", "testtable", 2)),
+		makeEvent(BINLOG_EVENT_WRITE_ROWSv2, 400, 0, rowsBody(1, 2, false, []int{1, 10}, []int{2, 20})),
+		makeEvent(BINLOG_EVENT_DELETE_ROWSv2, 500, 0, rowsBody(1, 2, false, []int{3, 30})),
+		makeEvent(BINLOG_EVENT_XID, 600, 0, xidBody),
+		makeEvent(BINLOG_EVENT_QUERY, 700, 0, queryBody("create table t2 (id int)")),
+	}
+
+	a := NewTransactionAssembler()
+	txs := []*Transaction{}
+	for _, data := range events {
+		ev, _, err := p.ParseBinlogEvent(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tx := a.Add(ev); tx != nil {
+			txs = append(txs, tx)
+		}
+	}
+
+	if len(txs) != 2 {
+		t.Fatalf("invalid transactions: %#v", txs)
+	}
+
+	tx := txs[0]
+	if tx.Xid != 0x2a || tx.LogPos != 600 || len(tx.Events) != 2 || tx.GTID == nil || tx.GTID.GNO != 5 {
+		t.Errorf("invalid transaction: %#v", tx)
+	}
+	if tx.GTIDString() != "00000000-0000-0000-0000-000000000000:5" {
+		t.Errorf("invalid gtid: %s", tx.GTIDString())
+	}
+
+	// DDL
+	tx = txs[1]
+	if tx.Xid != 0 || tx.LogPos != 700 || len(tx.Events) != 0 || tx.GTID != nil {
+		t.Errorf("invalid transaction: %#v", tx)
+	}
+
+	// SAVEPOINT, ROLLBACK TO はトランザクションの一部
+	events = [][]byte{
+		makeEvent(BINLOG_EVENT_GTID, 800, 0, gtidBody),
+		makeEvent(BINLOG_EVENT_QUERY, 900, 0, queryBody("BEGIN")),
+		makeEvent(BINLOG_EVENT_WRITE_ROWSv2, 1000, 0, rowsBody(1, 2, false, []int{4, 40})),
+		makeEvent(BINLOG_EVENT_QUERY, 1100, 0, queryBody("SAVEPOINT `sp`")),
+		makeEvent(BINLOG_EVENT_WRITE_ROWSv2, 1200, 0, rowsBody(1, 2, false, []int{5, 50})),
+		makeEvent(BINLOG_EVENT_QUERY, 1300, 0, queryBody("ROLLBACK TO `sp`")),
+		makeEvent(BINLOG_EVENT_WRITE_ROWSv2, 1400, 0, rowsBody(1, 2, false, []int{6, 60})),
+		makeEvent(BINLOG_EVENT_XID, 1500, 0, xidBody),
+		// 非トランザクションテーブルの更新は COMMIT で終わる
+		makeEvent(BINLOG_EVENT_QUERY, 1600, 0, queryBody("BEGIN")),
+		makeEvent(BINLOG_EVENT_WRITE_ROWSv2, 1700, 0, rowsBody(1, 2, false, []int{7, 70})),
+		makeEvent(BINLOG_EVENT_QUERY, 1800, 0, queryBody("COMMIT")),
+	}
+	txs = []*Transaction{}
+	for _, data := range events {
+		ev, _, err := p.ParseBinlogEvent(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tx := a.Add(ev); tx != nil {
+			txs = append(txs, tx)
+		}
+	}
+	if len(txs) != 2 {
+		t.Fatalf("invalid transactions: %#v", txs)
+	}
+	if tx := txs[0]; tx.Xid != 0x2a || tx.LogPos != 1500 || len(tx.Events) != 3 || tx.GTID == nil {
+		t.Errorf("invalid transaction: %#v", tx)
+	}
+	if tx := txs[1]; tx.Xid != 0 || tx.LogPos != 1800 || len(tx.Events) != 1 {
+		t.Errorf("invalid transaction: %#v", tx)
+	}
+
+	// 途中で破棄したトランザクションは返さない
+	a.Add(&BinlogEvent{Header: &BinlogEventHeader{}, Query: &BinlogEventQuery{Query: "BEGIN"}})
+	a.Add(&BinlogEvent{Header: &BinlogEventHeader{}, Rows: &BinlogEventRows{}})
+	a.Reset()
+	tx = a.Add(&BinlogEvent{Header: &BinlogEventHeader{EventType: BINLOG_EVENT_XID}, Xid: &BinlogEventXid{1}})
+	if tx == nil || len(tx.Events) != 0 {
+		t.Errorf("invalid transaction: %#v", tx)
+	}
+}
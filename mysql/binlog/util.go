@@ -1,6 +1,9 @@
 package binlog
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -62,7 +65,7 @@ func readBigEndianVarint64(data []byte) (int64, int) {
 }
 
 func readBigEndianUvarint(data []byte) (uint, int) {
-	v, n := readBigEndianUvarint(data)
+	v, n := readBigEndianUvarint64(data)
 	return uint(v), n
 }
 
@@ -203,3 +206,65 @@ func MY_PACKED_TIME_MAKE_INT(u uint64) uint64 {
 func MY_PACKED_TIME_MAKE(u uint64, frac uint64) uint64 {
 	return (u << 24) + frac
 }
+
+// mysql-source: strings/decimal.c (bin2decimal)
+// 整数部、小数部とも 9 桁ごとに 4 バイトで格納され、端数の桁は整数部では先頭、小数部では末尾に格納される
+func readDecimal(data []byte, prec int, dec int) (string, int, error) {
+	intg := prec - dec
+	intg0 := intg / 9
+	frac0 := dec / 9
+	intg0x := intg - intg0*9
+	frac0x := dec - frac0*9
+
+	size := intg0*4 + DECIMAL_SIZES[intg0x] + frac0*4 + DECIMAL_SIZES[frac0x]
+	if len(data) < size || size == 0 {
+		return "", 0, fmt.Errorf("invalid decimal data: %v (precision:%d scale:%d)", data, prec, dec)
+	}
+
+	// 負数は全てのビットが反転している
+	buf := make([]byte, size)
+	copy(buf, data[:size])
+	negative := buf[0]&0x80 == 0
+	buf[0] ^= 0x80
+	if negative {
+		for i := range buf {
+			buf[i] ^= 0xff
+		}
+	}
+
+	pos := 0
+	read := func(n int) uint64 {
+		v, _ := readBigEndianUvarint64(buf[pos : pos+n])
+		pos += n
+		return v
+	}
+
+	ints := ""
+	if 0 < intg0x {
+		ints = strconv.FormatUint(read(DECIMAL_SIZES[intg0x]), 10)
+	}
+	for i := 0; i < intg0; i++ {
+		ints += fmt.Sprintf("%09d", read(4))
+	}
+	ints = strings.TrimLeft(ints, "0")
+	if ints == "" {
+		ints = "0"
+	}
+
+	decs := ""
+	for i := 0; i < frac0; i++ {
+		decs += fmt.Sprintf("%09d", read(4))
+	}
+	if 0 < frac0x {
+		decs += fmt.Sprintf("%0*d", frac0x, read(DECIMAL_SIZES[frac0x]))
+	}
+
+	str := ints
+	if 0 < dec {
+		str += "." + decs
+	}
+	if negative {
+		str = "-" + str
+	}
+	return str, size, nil
+}
@@ -1,7 +1,9 @@
 package mysql
 
 import (
+	"fmt"
 	"github.com/uwork/bingo/mysql/binlog"
+	"time"
 )
 
 type BinlogEOFError struct {
@@ -11,6 +13,17 @@ func (e *BinlogEOFError) Error() string {
 	return "End of binlog stream."
 }
 
+const DEFAULT_HEARTBEAT_MULTIPLE = 2.0
+
+// ハートビートの間隔を過ぎてもイベントを受信できなかった (サーバーが停止している可能性がある)
+type HeartbeatTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *HeartbeatTimeoutError) Error() string {
+	return fmt.Sprintf("no binlog event or heartbeat received in %s", e.Timeout)
+}
+
 func (c *Conn) dumpNextBinlog() (*binlog.BinlogEvent, error) {
 	data, err := c.readPacket()
 	if err != nil {
@@ -30,5 +43,91 @@ func (c *Conn) dumpNextBinlog() (*binlog.BinlogEvent, error) {
 		return nil, err
 	}
 
+	c.updatePosition(ev)
+
 	return ev, err
 }
+
+// 読み込み済みのバイナリログのファイル名と位置
+func (c *Conn) Position() (string, uint32) {
+	c.posMutex.Lock()
+	defer c.posMutex.Unlock()
+
+	return c.binlogFile, c.binlogPos
+}
+
+func (c *Conn) setPosition(file string, pos uint32) {
+	c.posMutex.Lock()
+	defer c.posMutex.Unlock()
+
+	c.binlogFile = file
+	c.binlogPos = pos
+}
+
+// 実行済みの GTID セット (DumpBinlogGTID で読み込んでいない場合は nil)
+func (c *Conn) GTIDSet() *binlog.GTIDSet {
+	c.posMutex.Lock()
+	defer c.posMutex.Unlock()
+
+	if c.gtidSet == nil {
+		return nil
+	}
+	return c.gtidSet.Clone()
+}
+
+func (c *Conn) setGTIDSet(gtidSet *binlog.GTIDSet) {
+	c.posMutex.Lock()
+	defer c.posMutex.Unlock()
+
+	c.gtidSet = gtidSet
+	c.gtid = nil
+	c.inTransaction = false
+}
+
+func (c *Conn) updatePosition(ev *binlog.BinlogEvent) {
+	c.updateGTIDSet(ev)
+
+	// ハートビートは読み込み位置を変えない
+	if ev.Heartbeat != nil {
+		return
+	}
+
+	if ev.Rotate != nil {
+		// fake rotate event (dump start) も含めて次のファイルに移る
+		c.setPosition(ev.Rotate.NextFile, uint32(ev.Rotate.Position))
+		return
+	}
+
+	// artificial event の log_pos は 0 になっている
+	if 0 < ev.Header.LogPos && !ev.Header.IsArtificial() {
+		c.posMutex.Lock()
+		c.binlogPos = ev.Header.LogPos
+		c.posMutex.Unlock()
+	}
+}
+
+// トランザクションがコミットされた時点で GTID を実行済みにする
+func (c *Conn) updateGTIDSet(ev *binlog.BinlogEvent) {
+	c.posMutex.Lock()
+	defer c.posMutex.Unlock()
+
+	if c.gtidSet == nil {
+		return
+	}
+
+	if ev.GTID != nil {
+		c.gtid = nil
+		c.inTransaction = false
+		if !ev.GTID.Anonymous {
+			c.gtid = ev.GTID
+		}
+	} else if ev.IsBegin() {
+		c.inTransaction = true
+	} else if ev.IsCommit(c.inTransaction) {
+		c.inTransaction = false
+		if c.gtid != nil {
+			c.gtidSet.Add(c.gtid.SID, c.gtid.GNO)
+			c.gtid = nil
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/uwork/bingo/mysql/binlog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func binlogPacket(seq byte, evType byte, logPos uint32, flags uint16, body []byte) []byte {
+	size := 19 + len(body)
+	ev := []byte{
+		0, 0, 0, 0,
+		evType,
+		1, 0, 0, 0,
+		byte(size), byte(size >> 8), byte(size >> 16), byte(size >> 24),
+		byte(logPos), byte(logPos >> 8), byte(logPos >> 16), byte(logPos >> 24),
+		byte(flags), byte(flags >> 8),
+	}
+	payload := append([]byte{pOK}, ev...)
+	payload = append(payload, body...)
+
+	packet := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq}
+	return append(packet, payload...)
+}
+
+func rotateBody(pos uint64, file string) []byte {
+	body := []byte{byte(pos), byte(pos >> 8), byte(pos >> 16), byte(pos >> 24), 0, 0, 0, 0}
+	return append(body, []byte(file)...)
+}
+
+func TestBinlogPosition(t *testing.T) {
+	expecteds := []struct {
+		packet []byte
+		file   string
+		pos    uint32
+	}{
+		// fake rotate event
+		{binlogPacket(1, binlog.BINLOG_EVENT_ROTATE, 0, binlog.LOG_EVENT_ARTIFICIAL_F, rotateBody(1024, "mysql-bin.000001")), "mysql-bin.000001", 1024},
+		{binlogPacket(2, binlog.BINLOG_EVENT_XID, 1055, 0, []byte{1, 0, 0, 0, 0, 0, 0, 0}), "mysql-bin.000001", 1055},
+		// artificial event does not move the cursor
+		{binlogPacket(3, binlog.BINLOG_EVENT_XID, 0, binlog.LOG_EVENT_ARTIFICIAL_F, []byte{2, 0, 0, 0, 0, 0, 0, 0}), "mysql-bin.000001", 1055},
+		// rotate by flush logs
+		{binlogPacket(4, binlog.BINLOG_EVENT_ROTATE, 1100, 0, rotateBody(4, "mysql-bin.000002")), "mysql-bin.000002", 4},
+		{binlogPacket(5, binlog.BINLOG_EVENT_XID, 150, 0, []byte{3, 0, 0, 0, 0, 0, 0, 0}), "mysql-bin.000002", 150},
+		// heartbeat does not move the cursor
+		{binlogPacket(6, binlog.BINLOG_EVENT_HEARTBEAT, 2000, 0, []byte("mysql-bin.000002")), "mysql-bin.000002", 150},
+	}
+
+	buf := &bytes.Buffer{}
+	for _, s := range expecteds {
+		buf.Write(s.packet)
+	}
+
+	c := &Conn{}
+	c.r = bufio.NewReader(buf)
+	c.binlogParser = &binlog.BinlogParser{}
+	c.binlogParser.TableMaps = map[uint64]*binlog.BinlogEventTableMap{}
+	c.setPosition("mysql-bin.000000", 4)
+
+	for _, s := range expecteds {
+		_, err := c.dumpNextBinlog()
+		if err != nil {
+			t.Errorf("read error: %v", err)
+		}
+
+		file, pos := c.Position()
+		if file != s.file || pos != s.pos {
+			t.Errorf("invalid position.  expected:%s:%d position:%s:%d", s.file, s.pos, file, pos)
+		}
+	}
+}
+
+func TestBinlogGTIDSet(t *testing.T) {
+	sid := []byte{0x3e, 0x11, 0xfa, 0x47, 0x71, 0xca, 0x11, 0xe1, 0x9e, 0x33, 0xc8, 0x0a, 0xa9, 0x42, 0x95, 0x62}
+	gtidBody := func(gno byte) []byte {
+		body := append([]byte{1}, sid...)
+		return append(body, gno, 0, 0, 0, 0, 0, 0, 0)
+	}
+	xidBody := []byte{1, 0, 0, 0, 0, 0, 0, 0}
+	queryBody := func(query string) []byte {
+		body := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+		return append(body, []byte(query)...)
+	}
+
+	expecteds := []struct {
+		packet []byte
+		result string
+	}{
+		{binlogPacket(1, binlog.BINLOG_EVENT_GTID, 100, 0, gtidBody(6)), "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5"},
+		{binlogPacket(2, binlog.BINLOG_EVENT_XID, 200, 0, xidBody), "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-6"},
+		{binlogPacket(3, binlog.BINLOG_EVENT_ANONYMOUS_GTID, 300, 0, gtidBody(0)), "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-6"},
+		{binlogPacket(4, binlog.BINLOG_EVENT_XID, 400, 0, xidBody), "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-6"},
+		{binlogPacket(5, binlog.BINLOG_EVENT_GTID, 500, 0, gtidBody(8)), "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-6"},
+		{binlogPacket(6, binlog.BINLOG_EVENT_XID, 600, 0, xidBody), "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-6:8"},
+		// SAVEPOINT ではコミットされない
+		{binlogPacket(7, binlog.BINLOG_EVENT_GTID, 700, 0, gtidBody(9)), "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-6:8"},
+		{binlogPacket(8, binlog.BINLOG_EVENT_QUERY, 800, 0, queryBody("BEGIN")), "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-6:8"},
+		{binlogPacket(9, binlog.BINLOG_EVENT_QUERY, 900, 0, queryBody("SAVEPOINT sp")), "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-6:8"},
+		{binlogPacket(10, binlog.BINLOG_EVENT_XID, 1000, 0, xidBody), "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-6:8-9"},
+		// DDL
+		{binlogPacket(11, binlog.BINLOG_EVENT_GTID, 1100, 0, gtidBody(10)), "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-6:8-9"},
+		{binlogPacket(12, binlog.BINLOG_EVENT_QUERY, 1200, 0, queryBody("create table t2 (id int)")), "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-6:8-10"},
+	}
+
+	buf := &bytes.Buffer{}
+	for _, s := range expecteds {
+		buf.Write(s.packet)
+	}
+
+	c := &Conn{}
+	c.r = bufio.NewReader(buf)
+	c.binlogParser = &binlog.BinlogParser{}
+	c.binlogParser.TableMaps = map[uint64]*binlog.BinlogEventTableMap{}
+
+	if c.GTIDSet() != nil {
+		t.Errorf("invalid gtid set.  expected:nil set:%v", c.GTIDSet())
+	}
+
+	start, _ := binlog.ParseGTIDSet("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5")
+	c.setGTIDSet(start.Clone())
+
+	for _, s := range expecteds {
+		_, err := c.dumpNextBinlog()
+		if err != nil {
+			t.Errorf("read error: %v", err)
+		}
+
+		if set := c.GTIDSet(); set == nil || set.String() != s.result {
+			t.Errorf("invalid gtid set.  expected:%v set:%v", s.result, set)
+		}
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	buf := &bytes.Buffer{}
+	buf.Write(makePacket(1, []byte{pOK, 0, 0, 0, 0, 0, 0})) // show global variables
+	buf.Write(makePacket(1, []byte{pOK, 0, 0, 0, 0, 0, 0})) // set @master_heartbeat_period
+	buf.Write(makePacket(1, []byte{pOK, 0, 0, 0, 0, 0, 0})) // register slave
+	buf.Write(binlogPacket(1, binlog.BINLOG_EVENT_HEARTBEAT, 2000, 0, []byte("mysql-bin.000002")))
+
+	written := &bytes.Buffer{}
+	client, server := net.Pipe()
+	defer server.Close()
+
+	c := &Conn{nc: client}
+	c.r = bufio.NewReader(buf)
+	c.w = bufio.NewWriter(written)
+	c.HeartbeatPeriod = 500 * time.Millisecond
+	c.HeartbeatMultiple = 1.5
+
+	if err := c.prepareDump(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(written.String(), "set @master_heartbeat_period = 500000000") {
+		t.Errorf("heartbeat period was not set: %q", written.String())
+	}
+	if c.readTimeout() != 750*time.Millisecond {
+		t.Errorf("invalid read timeout: %v", c.readTimeout())
+	}
+
+	ev, err := c.readNextBinlog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Heartbeat == nil || ev.Heartbeat.LogIdent != "mysql-bin.000002" {
+		t.Errorf("invalid heartbeat: %#v", ev.Heartbeat)
+	}
+
+	// ハートビートが届かない
+	c.r = bufio.NewReader(client)
+	c.HeartbeatPeriod = 10 * time.Millisecond
+	c.HeartbeatMultiple = 2
+	start := time.Now()
+	_, err = c.readNextBinlog()
+	if terr, ok := err.(*HeartbeatTimeoutError); !ok || terr.Timeout != 20*time.Millisecond {
+		t.Errorf("invalid timeout error: %#v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond || time.Second < elapsed {
+		t.Errorf("invalid timeout: %v", elapsed)
+	}
+}
+
+func TestLargeBinlogEvent(t *testing.T) {
+	// ok(1) + header(19) + post-header(13) + schema(6) + 0x00(1)
+	headerSize := 1 + 19 + 13 + 6 + 1
+
+	for _, size := range []int{maxPacketSize, maxPacketSize + 1, maxPacketSize*2 + 10} {
+		query := bytes.Repeat([]byte("x"), size-headerSize)
+		body := []byte{0, 0, 0, 0, 0, 0, 0, 0, 6, 0, 0, 0, 0}
+		body = append(body, []byte("testdb")...)
+		body = append(body, 0)
+		body = append(body, query...)
+
+		packet := binlogPacket(1, binlog.BINLOG_EVENT_QUERY, 1024, 0, body)
+		payload := packet[4:]
+		if len(payload) != size {
+			t.Fatalf("invalid payload size.  expected:%v size:%v", size, len(payload))
+		}
+
+		c := &Conn{}
+		c.r = bufio.NewReader(bytes.NewBuffer(splitPayload(1, payload)))
+		c.binlogParser = &binlog.BinlogParser{}
+		c.binlogParser.TableMaps = map[uint64]*binlog.BinlogEventTableMap{}
+
+		ev, err := c.dumpNextBinlog()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Query == nil || ev.Query.Schema != "testdb" || len(ev.Query.Query) != len(query) {
+			t.Errorf("invalid large event.  size:%v", size)
+		}
+		if ev.Header.EventSize != uint32(size-1) {
+			t.Errorf("invalid event size.  expected:%v size:%v", size-1, ev.Header.EventSize)
+		}
+	}
+}
+
+// fake rotate と FORMAT_DESCRIPTION_EVENT もコールバックに渡す
+func TestDumpBinlogFormatDescription(t *testing.T) {
+	c := dumpTestConn(t, "mysql-bin.000001", 200)
+
+	events := []*binlog.BinlogEvent{}
+	err := c.DumpBinlog("mysql-bin.000001", 4, func(ev *binlog.BinlogEvent) error {
+		events = append(events, ev)
+		return nil
+	})
+	if err == nil {
+		t.Errorf("disconnected, but no error")
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("invalid events: %d", len(events))
+	}
+	if events[0].Rotate == nil || events[2].Xid == nil {
+		t.Errorf("invalid events: %v %v", events[0], events[2])
+	}
+	fd := events[1]
+	if fd.FormatDescription == nil || fd.FormatDescription.ServerVersion != "5.5.0-test" {
+		t.Errorf("invalid format description: %v", fd.FormatDescription)
+	}
+	if len(fd.Raw) != int(fd.Header.EventSize) {
+		t.Errorf("invalid raw event: %d", len(fd.Raw))
+	}
+}
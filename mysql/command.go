@@ -5,6 +5,8 @@ import (
 	"github.com/uwork/bingo/mysql/binlog"
 	"github.com/uwork/bingo/util"
 	"log"
+	"net"
+	"strings"
 	"time"
 )
 
@@ -46,6 +48,7 @@ const (
 
 const (
 	serverMoreResultsExists = 0x0008
+	binlogThroughGTID       = 0x04
 )
 
 type Value struct {
@@ -80,44 +83,138 @@ type ResultSet struct {
 
 type OnEvent func(*binlog.BinlogEvent) error
 
-func (c *Conn) DumpBinlog(binlogFile string, binlogPos int, callback OnEvent) error {
+// pos の位置からバイナリログを読み込む
+func (c *Conn) Dump(pos BinlogPosition, callback OnEvent) error {
+	if pos.GTIDSet != nil {
+		return c.DumpBinlogGTID(pos.GTIDSet, callback)
+	}
+	return c.DumpBinlog(pos.File, int(pos.Pos), callback)
+}
 
-	if c.binlogParser == nil {
-		c.binlogParser = &binlog.BinlogParser{}
-		c.binlogParser.TableMaps = map[uint64]*binlog.BinlogEventTableMap{}
+func (c *Conn) DumpBinlog(binlogFile string, binlogPos int, callback OnEvent) error {
+	err := c.prepareDump()
+	if err != nil {
+		return err
 	}
 
 	args := []byte{}
 	args = append(args, util.IntToBytes(binlogPos)...)
-	args = append(args, []byte{0x00, 0x00}...)    // BLOCKING_IO(0) NON_BLOCKING_IO(1)
-	args = append(args, util.IntToBytes(0x20)...) // FIXME: serverId
+	args = append(args, []byte{0x00, 0x00}...) // BLOCKING_IO(0) NON_BLOCKING_IO(1)
+	args = append(args, uint32ToBytes(c.serverId())...)
 	args = append(args, []byte(binlogFile)...)
 
-	err := c.commandBinary(COM_BINLOG_DUMP, args)
+	c.setPosition(binlogFile, uint32(binlogPos))
+	c.setGTIDSet(nil)
+
+	err = c.commandBinary(COM_BINLOG_DUMP, args)
 	if err != nil {
 		return err
 	}
 
-	err = c.readResultPacket()
+	return c.readBinlogStream(callback)
+}
+
+// gtidSet に含まれないトランザクションからバイナリログを読み込む
+// http://dev.mysql.com/doc/internals/en/com-binlog-dump-gtid.html
+func (c *Conn) DumpBinlogGTID(gtidSet *binlog.GTIDSet, callback OnEvent) error {
+	err := c.prepareDump()
 	if err != nil {
 		return err
 	}
 
-	// first event is format description
-	_, err = c.dumpNextBinlog()
+	data := gtidSet.Encode()
+
+	args := []byte{}
+	args = append(args, []byte{binlogThroughGTID, 0x00}...) // flags
+	args = append(args, uint32ToBytes(c.serverId())...)
+	args = append(args, util.IntToBytes(0)...) // binlog-filename-len
+	args = append(args, util.IntToBytes(4)...) // binlog-pos
+	args = append(args, util.IntToBytes(0)...)
+	args = append(args, util.IntToBytes(len(data))...)
+	args = append(args, data...)
+
+	c.setPosition("", 4)
+	c.setGTIDSet(gtidSet.Clone())
+
+	err = c.commandBinary(COM_BINLOG_DUMP_GTID, args)
 	if err != nil {
 		return err
 	}
 
+	return c.readBinlogStream(callback)
+}
+
+func (c *Conn) prepareDump() error {
+	if c.binlogParser == nil {
+		c.binlogParser = &binlog.BinlogParser{}
+		c.binlogParser.TableMaps = map[uint64]*binlog.BinlogEventTableMap{}
+	}
+	c.binlogParser.VerifyChecksum = c.VerifyChecksum
+
+	err := c.announceChecksum()
+	if err != nil {
+		return err
+	}
+
+	// 単位はナノ秒
+	if 0 < c.HeartbeatPeriod {
+		err = c.UpdateQuery(fmt.Sprintf("set @master_heartbeat_period = %d", c.HeartbeatPeriod.Nanoseconds()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.RegisterSlave()
+}
+
+// ハートビートの間隔から読み込みのタイムアウトを決める
+func (c *Conn) readTimeout() time.Duration {
+	if c.HeartbeatPeriod <= 0 {
+		return 24 * 365 * time.Hour
+	}
+
+	multiple := c.HeartbeatMultiple
+	if multiple < 1 {
+		multiple = DEFAULT_HEARTBEAT_MULTIPLE
+	}
+	return time.Duration(float64(c.HeartbeatPeriod) * multiple)
+}
+
+// タイムアウトを設定して次のイベントを読み込む
+func (c *Conn) readNextBinlog() (*binlog.BinlogEvent, error) {
+	timeout := c.readTimeout()
+	c.nc.SetReadDeadline(time.Now().Add(timeout))
+
+	ev, err := c.dumpNextBinlog()
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return nil, &HeartbeatTimeoutError{timeout}
+	}
+	return ev, err
+}
+
+func (c *Conn) readBinlogStream(callback OnEvent) error {
+	// fake rotate event, format description
+	// FORMAT_DESCRIPTION_EVENT もコールバックに渡す (イベントを解析し直す場合に必要)
+	c.binlogParser.Description = nil
+	for c.binlogParser.Description == nil {
+		ev, err := c.readNextBinlog()
+		if err != nil {
+			return err
+		}
+
+		err = callback(ev)
+		if err != nil {
+			return err
+		}
+	}
+
 	log.Println("start reading binlog")
 	log.Println("    Binlog Version: ", c.binlogParser.Description.BinlogVersion)
 	log.Println("    Server Version: ", c.binlogParser.Description.ServerVersion)
 
 	for {
-		c.nc.SetDeadline(time.Now().Add(24 * 365 * time.Hour))
-
 		// read next binlog
-		ev, err := c.dumpNextBinlog()
+		ev, err := c.readNextBinlog()
 		if err != nil {
 			return err
 		}
@@ -127,6 +224,32 @@ func (c *Conn) DumpBinlog(binlogFile string, binlogPos int, callback OnEvent) er
 			return err
 		}
 	}
+}
+
+// バイナリログのチェックサムに対応している事をサーバーに通知する
+func (c *Conn) announceChecksum() error {
+	rs, err := c.Query("show global variables like 'binlog_checksum'")
+	if err != nil {
+		return err
+	}
+
+	// binlog_checksum が存在しない (< 5.6.2)
+	if rs == nil || len(rs.Rows) == 0 || len(rs.Rows[0].Values) < 2 {
+		c.binlogParser.ChecksumAlg = binlog.BINLOG_CHECKSUM_ALG_OFF
+		return nil
+	}
+
+	err = c.UpdateQuery("set @master_binlog_checksum = @@global.binlog_checksum")
+	if err != nil {
+		return err
+	}
+
+	// fake rotate event はサーバーのアルゴリズムでチェックサムが付与される
+	if strings.ToUpper(rs.Rows[0].Values[1].Value) == "CRC32" {
+		c.binlogParser.ChecksumAlg = binlog.BINLOG_CHECKSUM_ALG_CRC32
+	} else {
+		c.binlogParser.ChecksumAlg = binlog.BINLOG_CHECKSUM_ALG_OFF
+	}
 
 	return nil
 }
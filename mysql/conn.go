@@ -6,6 +6,8 @@ import (
 	"github.com/uwork/bingo/mysql/binlog"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 )
 
 type Conn struct {
@@ -16,11 +18,51 @@ type Conn struct {
 	sequence     uint
 	warnings     uint
 	status       uint
+	authPlugin   string
+	host         string
+	ssl          *SSLConfig
 
 	binlogParser *binlog.BinlogParser
+
+	// binlog dump settings
+	VerifyChecksum bool
+
+	// HeartbeatPeriod * HeartbeatMultiple の間イベントを受信できなければ切断されたとみなす
+	// HeartbeatPeriod が 0 の場合はハートビートを要求しない
+	HeartbeatPeriod   time.Duration
+	HeartbeatMultiple float64
+
+	// レプリカとして登録する server_id (0 の場合は DEFAULT_SERVER_ID) と、
+	// SHOW SLAVE HOSTS に表示するホスト名とポート
+	ServerId   uint32
+	ReportHost string
+	ReportPort int
+
+	// current binlog cursor
+	posMutex   sync.Mutex
+	binlogFile string
+	binlogPos  uint32
+	gtidSet    *binlog.GTIDSet
+	gtid       *binlog.BinlogEventGTID
+
+	// BEGIN から COMMIT までの間
+	inTransaction bool
+}
+
+// 接続時のハンドシェイク (認証を含む) の失敗
+type HandshakeError struct {
+	Err error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("handshake error: %s", e.Err)
 }
 
 func Open(user string, pass string, host string, port int) (*Conn, error) {
+	return OpenSSL(user, pass, host, port, nil)
+}
+
+func OpenSSL(user string, pass string, host string, port int, ssl *SSLConfig) (*Conn, error) {
 
 	// connect to mysql server.
 	myconn, err := net.Dial("tcp", host+":"+strconv.Itoa(port))
@@ -37,14 +79,22 @@ func Open(user string, pass string, host string, port int) (*Conn, error) {
 	}
 
 	conn := &Conn{}
+	conn.host = host
+	conn.ssl = ssl
 	conn.nc = myconn
 	conn.r = bufio.NewReader(myconn)
 	conn.w = bufio.NewWriter(myconn)
 
 	err = conn.handshake(user, pass)
 	if err != nil {
-		return nil, fmt.Errorf("handshake error: %s", err)
+		conn.nc.Close()
+		return nil, &HandshakeError{err}
 	}
 
 	return conn, nil
 }
+
+// COM_QUIT を送らずに切断する
+func (c *Conn) Close() error {
+	return c.nc.Close()
+}
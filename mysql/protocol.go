@@ -5,6 +5,7 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"github.com/uwork/bingo/util"
+	"io"
 )
 
 const (
@@ -68,13 +69,19 @@ func (c *Conn) handshake(user string, pass string) error {
 		return err
 	}
 
+	// SSLRequest
+	err = c.upgradeSSL()
+	if err != nil {
+		return err
+	}
+
 	// write handshake packet
 	err = c.handshakeWrite(user, pass, authSalt)
 	if err != nil {
 		return err
 	}
 
-	err = c.readResultPacket()
+	err = c.readAuthResult(pass, authSalt)
 	if err != nil {
 		return err
 	}
@@ -95,21 +102,18 @@ func (c *Conn) handshakeRead() ([]byte, error) {
 
 	// auth-plugin-data-part-1
 	partPos := 1 + bytes.IndexByte(data[1:], 0x00) + 1 + 4
-	authSalt := data[partPos : partPos+8]
+	authSalt := append([]byte{}, data[partPos:partPos+8]...)
 
 	// auth-plugindata-part-1(8) + filler(1)
 	partPos += 8 + 1
 
 	// capability flags
-	capability := int(uint(data[partPos])<<8 + uint(data[partPos+1]))
+	capability := int(uint(data[partPos]) | uint(data[partPos+1])<<8)
 	c.capabilities = capability
 	partPos += 2
 	if capability&clientProtocolVersion41 == 0 {
 		return nil, fmt.Errorf("client protocol version: %d & %d != 0", capability, clientProtocolVersion41)
 	}
-	if capability&clientSSL == 0 {
-		return nil, fmt.Errorf("ssl not supported.")
-	}
 
 	// more data...
 	if len(data) > partPos && capability&clientSecureConnection != 0 {
@@ -128,23 +132,44 @@ func (c *Conn) handshakeRead() ([]byte, error) {
 
 		// auth-plugin-data-part2
 		authSalt = append(authSalt, data[partPos:partPos+int(authData2Len)]...)
+		partPos += int(authData2Len)
+
+		// auth-plugin name
+		if len(data) > partPos {
+			name := data[partPos:]
+			if idx := bytes.IndexByte(name, 0x00); 0 <= idx {
+				name = name[:idx]
+			}
+			c.authPlugin = string(name)
+		}
 	}
 
 	return authSalt, nil
 }
 
+// capability flags
+func (c *Conn) clientCapability() int {
+	capability := clientProtocolVersion41 | clientSecureConnection | clientPluginAuth | clientLongPassword | c.capabilities&0x4 // longflag
+	if c.isTLS() {
+		capability |= clientSSL
+	}
+	return capability
+}
+
 func (c *Conn) handshakeWrite(user string, pass string, authSalt []byte) error {
 
-	// capability flags
-	capability := clientProtocolVersion41 | clientSecureConnection | clientPluginAuth | clientLongPassword | c.capabilities&0x4 // longflag
+	capability := c.clientCapability()
 	maxPacketSize := 0x0
 	characterSet := byte(33) // utf8 http://dev.mysql.com/doc/internals/en/character-set.html
 
-	passwordBytes := []byte{}
-	if len(pass) > 0 {
-		passwordBytes = CreateNativePassword([]byte(pass), authSalt)
+	if len(c.authPlugin) == 0 {
+		c.authPlugin = authNativePassword
 	}
-	authPluginName := []byte("mysql_native_password")
+	passwordBytes, err := c.authResponse(pass, authSalt)
+	if err != nil {
+		return err
+	}
+	authPluginName := []byte(c.authPlugin)
 
 	// make payload
 	payload := []byte{}
@@ -159,7 +184,7 @@ func (c *Conn) handshakeWrite(user string, pass string, authSalt []byte) error {
 	payload = append(payload, authPluginName...)
 	payload = append(payload, 0)
 
-	err := c.writePacket(payload)
+	err = c.writePacket(payload)
 	if err != nil {
 		return err
 	}
@@ -229,6 +254,20 @@ func (c *Conn) readFixedLengthInteger() (int64, error) {
 	return v, nil
 }
 
+// サーバーが返した ERR packet (認証、クエリ、COM_BINLOG_DUMP など)
+// 認証の失敗は AuthError で包んで返す
+type ServerError struct {
+	Code    int
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	if e.Code == 0 && len(e.Message) == 0 {
+		return "server error"
+	}
+	return fmt.Sprintf("server error: %s (%d)", e.Message, e.Code)
+}
+
 func (c *Conn) errorPacketToString(data []byte) error {
 	if len(data) > 1 {
 		errorCode := int(uint(data[1]) + uint(data[2])<<8)
@@ -239,9 +278,9 @@ func (c *Conn) errorPacketToString(data []byte) error {
 		} else {
 			errorMessage = string(data[3:idx])
 		}
-		return fmt.Errorf("authentication error: %s (%d)", errorMessage, errorCode)
+		return &ServerError{errorCode, errorMessage}
 	} else {
-		return fmt.Errorf("authentication error")
+		return &ServerError{}
 	}
 }
 
@@ -257,97 +296,83 @@ func (c *Conn) readEOFPacket(data []byte) {
 }
 
 // http://dev.mysql.com/doc/internals/en/mysql-packet.html
+// ペイロードが 0xffffff 以上の場合は複数のパケットに分割されているため、
+// 0xffffff 未満のパケットが来るまで読み込んで結合する
 func (c *Conn) readPacket() ([]byte, error) {
+	var payload []byte
+	for {
+		head, err := c.readBytes(4)
+		if err != nil {
+			return nil, err
+		}
 
-	head, err := c.readBytes(4)
-	if err != nil {
-		return nil, err
-	}
+		length := int(uint(head[0]) + uint(head[1])<<8 + uint(head[2])<<16)
+		seqId := uint(head[3])
+		c.sequence = seqId + 1
 
-	length := int(uint(head[0]) + uint(head[1])<<8 + uint(head[2])<<16)
-	seqId := uint(head[3])
-	c.sequence = seqId + 1
+		data, err := c.readBytes(length)
+		if err != nil {
+			return nil, err
+		}
 
-	payload, err := c.readBytes(length)
-	if err != nil {
-		return nil, err
+		if payload == nil && length < maxPacketSize {
+			return data, nil
+		}
+		payload = append(payload, data...)
+		if length < maxPacketSize {
+			return payload, nil
+		}
 	}
-
-	return payload, nil
 }
 
+// ペイロードが 0xffffff 以上の場合は 0xffffff ずつ分割して送る
+// ちょうど 0xffffff の倍数の場合は末尾に空のパケットを送る
 func (c *Conn) writePacket(payload []byte) error {
-	packet := make([]byte, 4)
+	for {
+		size := len(payload)
+		if maxPacketSize < size {
+			size = maxPacketSize
+		}
 
-	payloadSize := len(payload)
-	packet[0] = byte(payloadSize)
-	packet[1] = byte(payloadSize >> 8)
-	packet[2] = byte(payloadSize >> 16)
-	packet[3] = byte(c.sequence) // sequence id
-	packet = append(packet, payload...)
+		packet := make([]byte, 4, 4+size)
+		packet[0] = byte(size)
+		packet[1] = byte(size >> 8)
+		packet[2] = byte(size >> 16)
+		packet[3] = byte(c.sequence) // sequence id
+		packet = append(packet, payload[:size]...)
 
-	err := c.writeBytes(packet)
-	if err != nil {
-		return err
-	}
+		err := c.writeBytes(packet)
+		if err != nil {
+			return err
+		}
 
-	c.sequence += 1
+		c.sequence += 1
 
-	return nil
+		payload = payload[size:]
+		if size < maxPacketSize {
+			return nil
+		}
+	}
 }
 
 func (c *Conn) readBytes(expectSize int) ([]byte, error) {
 	data := make([]byte, expectSize)
 
-	tryCount := 0
-	readedSize := 0
-	for {
-		tryCount += 1
-
-		size, err := c.r.Read(data[readedSize:])
-		if err != nil {
-			return nil, err
-		}
-
-		readedSize += size
-		if readedSize >= expectSize {
-			break
-		}
-
-		// try count check.
-		if tryCount > 10 {
-			return nil, fmt.Errorf("packet read count was over.")
-		}
+	_, err := io.ReadFull(c.r, data)
+	if err != nil {
+		return nil, err
 	}
 
 	return data, nil
 }
 
 func (c *Conn) writeBytes(data []byte) error {
-	dataLen := len(data)
-
-	tryCount := 0
-	writedSize := 0
-	for {
-		tryCount += 1
-
-		size, err := c.w.Write(data[writedSize:])
-		if err != nil {
-			return err
-		}
-
-		writedSize += size
-		if writedSize >= dataLen {
-			break
-		}
-
-		// try count check.
-		if tryCount > 10 {
-			return fmt.Errorf("packet write count was over.")
-		}
+	_, err := c.w.Write(data)
+	if err != nil {
+		return err
 	}
 
-	err := c.w.Flush()
+	err = c.w.Flush()
 	if err != nil {
 		return err
 	}
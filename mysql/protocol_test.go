@@ -58,6 +58,9 @@ func TestHandshakeRead(t *testing.T) {
 		if !reflect.DeepEqual(s.salt, salt) {
 			t.Errorf("invalid read data.  expected:%v salt:%v", s.salt, salt)
 		}
+		if c.authPlugin != "mysql_native_password" {
+			t.Errorf("invalid auth plugin.  expected:mysql_native_password plugin:%v", c.authPlugin)
+		}
 	}
 
 }
@@ -134,9 +137,9 @@ func TestReadResultPacket(t *testing.T) {
 			var expectedMessage string
 			if s.data[4] == pERR {
 				if len(s.errMsg) != 0 {
-					expectedMessage = fmt.Sprintf("authentication error: %s (%d)", s.errMsg, s.errCode)
+					expectedMessage = fmt.Sprintf("server error: %s (%d)", s.errMsg, s.errCode)
 				} else {
-					expectedMessage = "authentication error"
+					expectedMessage = "server error"
 				}
 			} else {
 				expectedMessage = fmt.Sprintf("unknown error in authentication sequence: %#v", s.data[4:])
@@ -289,3 +292,71 @@ func TestCreateNativePassword(t *testing.T) {
 		}
 	}
 }
+
+// 0xffffff ずつ分割したパケットを作る
+func splitPayload(seq byte, payload []byte) []byte {
+	buf := &bytes.Buffer{}
+	for {
+		size := len(payload)
+		if maxPacketSize < size {
+			size = maxPacketSize
+		}
+		buf.Write(makePacket(seq, payload[:size]))
+		seq++
+
+		payload = payload[size:]
+		if size < maxPacketSize {
+			return buf.Bytes()
+		}
+	}
+}
+
+func TestLargePacket(t *testing.T) {
+	expecteds := []struct {
+		size    int
+		packets int
+	}{
+		{maxPacketSize - 1, 1},
+		{maxPacketSize, 2},
+		{maxPacketSize + 1, 2},
+		{maxPacketSize * 2, 3},
+	}
+
+	for _, s := range expecteds {
+		payload := make([]byte, s.size)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+
+		// write
+		buf := &bytes.Buffer{}
+		c := &Conn{}
+		c.w = bufio.NewWriter(buf)
+		err := c.writePacket(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packets := splitPackets(buf.Bytes()); len(packets) != s.packets {
+			t.Errorf("invalid packet count.  size:%v expected:%v packets:%v", s.size, s.packets, len(packets))
+		}
+		if !bytes.Equal(splitPayload(0, payload), buf.Bytes()) {
+			t.Errorf("invalid write data.  size:%v", s.size)
+		}
+		if c.sequence != uint(s.packets) {
+			t.Errorf("invalid sequence.  expected:%v sequence:%v", s.packets, c.sequence)
+		}
+
+		// read
+		c.r = bufio.NewReader(buf)
+		data, err := c.readPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload, data) {
+			t.Errorf("invalid read data.  size:%v length:%v", s.size, len(data))
+		}
+		if c.sequence != uint(s.packets) {
+			t.Errorf("invalid sequence.  expected:%v sequence:%v", s.packets, c.sequence)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package mysql
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// ServerId が設定されていない場合に使用する
+// 0 はバイナリログの末尾で EOF を返す (mysqlbinlog 用) ため使用しない
+const DEFAULT_SERVER_ID = 0x20
+
+// 同じ server_id のサーバーやレプリカが既に存在する
+// 同じ server_id で binlog dump を行うと、古い方の接続がサーバーに切断される
+type ServerIdCollisionError struct {
+	ServerId uint32
+	Host     string
+	Port     string
+}
+
+func (e *ServerIdCollisionError) Error() string {
+	if len(e.Port) == 0 {
+		return fmt.Sprintf("server_id %d is already used by %s", e.ServerId, e.Host)
+	}
+	return fmt.Sprintf("server_id %d is already used by %s:%s", e.ServerId, e.Host, e.Port)
+}
+
+func (c *Conn) serverId() uint32 {
+	if c.ServerId == 0 {
+		return DEFAULT_SERVER_ID
+	}
+	return c.ServerId
+}
+
+// レプリカとしてサーバーに登録する (SHOW SLAVE HOSTS に表示される)
+// http://dev.mysql.com/doc/internals/en/com-register-slave.html
+func (c *Conn) RegisterSlave() error {
+	host := c.ReportHost
+	if 255 < len(host) {
+		return fmt.Errorf("report host is too long: %s", host)
+	}
+
+	args := []byte{}
+	args = append(args, uint32ToBytes(c.serverId())...)
+	args = append(args, byte(len(host)))
+	args = append(args, []byte(host)...)
+	args = append(args, 0x00)                                      // user
+	args = append(args, 0x00)                                      // password
+	args = append(args, byte(c.ReportPort), byte(c.ReportPort>>8)) // port
+	args = append(args, uint32ToBytes(0)...)                       // replication rank
+	args = append(args, uint32ToBytes(0)...)                       // master id
+
+	err := c.commandBinary(COM_REGISTER_SLAVE, args)
+	if err != nil {
+		return err
+	}
+
+	return c.readResultPacket()
+}
+
+// server_id がサーバー自身や登録済みのレプリカと重複していないか確認する
+// 再起動直後は自分自身の以前の接続が切断を検知されるまで登録されたままになるため、
+// ReportHost, ReportPort が同じレプリカは重複とみなさない
+func (c *Conn) CheckServerId() error {
+	id := c.serverId()
+	idString := strconv.FormatUint(uint64(id), 10)
+
+	rs, err := c.Query("select @@server_id")
+	if err != nil {
+		return err
+	}
+	if rs != nil && 0 < len(rs.Rows) && rs.Rows[0].Values[0].Value == idString {
+		return &ServerIdCollisionError{ServerId: id, Host: c.host}
+	}
+
+	// Server_id, Host, Port, Master_id, (Slave_UUID)
+	rs, err = c.Query("show slave hosts")
+	if err != nil {
+		return err
+	}
+	if rs != nil {
+		port := strconv.Itoa(c.ReportPort)
+		for _, row := range rs.Rows {
+			if len(row.Values) < 3 || row.Values[0].Value != idString {
+				continue
+			}
+			if row.Values[1].Value == c.ReportHost && row.Values[2].Value == port {
+				continue
+			}
+			return &ServerIdCollisionError{ServerId: id, Host: row.Values[1].Value, Port: row.Values[2].Value}
+		}
+	}
+	return nil
+}
+
+func uint32ToBytes(v uint32) []byte {
+	return []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)}
+}
@@ -0,0 +1,112 @@
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func lengthEncodedString(s string) []byte {
+	return append([]byte{byte(len(s))}, []byte(s)...)
+}
+
+// カラム定義、行、EOF のパケットを作る
+func resultSetPackets(columns []string, rows ...[]string) []byte {
+	eof := []byte{pEOF, 0, 0, 0, 0}
+
+	seq := byte(1)
+	buf := &bytes.Buffer{}
+	buf.Write(makePacket(seq, []byte{byte(len(columns))}))
+	for _, name := range columns {
+		seq++
+		def := []byte{}
+		def = append(def, lengthEncodedString("def")...)
+		def = append(def, 0, 0, 0)
+		def = append(def, lengthEncodedString(name)...)
+		def = append(def, make([]byte, 13)...)
+		buf.Write(makePacket(seq, def))
+	}
+	seq++
+	buf.Write(makePacket(seq, eof))
+	for _, row := range rows {
+		seq++
+		values := []byte{}
+		for _, v := range row {
+			values = append(values, lengthEncodedString(v)...)
+		}
+		buf.Write(makePacket(seq, values))
+	}
+	seq++
+	buf.Write(makePacket(seq, eof))
+	return buf.Bytes()
+}
+
+func TestRegisterSlave(t *testing.T) {
+	written := &bytes.Buffer{}
+	c := &Conn{}
+	c.r = bufio.NewReader(bytes.NewBuffer(makePacket(1, []byte{pOK, 0, 0, 0, 0, 0, 0})))
+	c.w = bufio.NewWriter(written)
+	c.ServerId = 1001
+	c.ReportHost = "bingo01"
+	c.ReportPort = 3307
+
+	err := c.RegisterSlave()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{COM_REGISTER_SLAVE, 0xe9, 0x03, 0, 0, 7}
+	expected = append(expected, []byte("bingo01")...)
+	expected = append(expected, 0, 0, 0xeb, 0x0c, 0, 0, 0, 0, 0, 0, 0, 0)
+	if packets := splitPackets(written.Bytes()); len(packets) != 1 || !reflect.DeepEqual(expected, packets[0]) {
+		t.Errorf("invalid register slave packet.  expected:%v packets:%v", expected, packets)
+	}
+}
+
+func TestCheckServerId(t *testing.T) {
+	slaveHosts := []string{"Server_id", "Host", "Port", "Master_id", "Slave_UUID"}
+
+	expecteds := []struct {
+		serverId  uint32
+		master    string
+		slaves    [][]string
+		collision *ServerIdCollisionError
+	}{
+		{1001, "1", [][]string{{"1002", "bingo02", "3306", "1", ""}}, nil},
+		{1001, "1", [][]string{}, nil},
+		// サーバー自身と重複
+		{1, "1", [][]string{}, &ServerIdCollisionError{1, "db01", ""}},
+		// 登録済みのレプリカと重複
+		{1001, "1", [][]string{{"1002", "bingo02", "3306", "1", ""}, {"1001", "bingo01", "3307", "1", ""}}, &ServerIdCollisionError{1001, "bingo01", "3307"}},
+		// 未設定の場合は DEFAULT_SERVER_ID
+		{0, "1", [][]string{{"32", "bingo01", "3306", "1", ""}}, &ServerIdCollisionError{DEFAULT_SERVER_ID, "bingo01", "3306"}},
+		// 再起動前の自分自身の登録 (hostname, report_port が同じ) は重複としない
+		{1001, "1", [][]string{{"1001", "bingo09", "3309", "1", ""}}, nil},
+		{1001, "1", [][]string{{"1001", "bingo09", "3306", "1", ""}}, &ServerIdCollisionError{1001, "bingo09", "3306"}},
+	}
+
+	for _, s := range expecteds {
+		buf := &bytes.Buffer{}
+		buf.Write(resultSetPackets([]string{"@@server_id"}, []string{s.master}))
+		buf.Write(resultSetPackets(slaveHosts, s.slaves...))
+
+		c := &Conn{host: "db01"}
+		c.r = bufio.NewReader(buf)
+		c.w = bufio.NewWriter(&bytes.Buffer{})
+		c.ServerId = s.serverId
+		c.ReportHost = "bingo09"
+		c.ReportPort = 3309
+
+		err := c.CheckServerId()
+		if s.collision == nil {
+			if err != nil {
+				t.Errorf("invalid collision.  input:%v error:%v", s.serverId, err)
+			}
+			continue
+		}
+		if cerr, ok := err.(*ServerIdCollisionError); !ok || !reflect.DeepEqual(s.collision, cerr) {
+			t.Errorf("invalid collision.  expected:%v error:%v", s.collision, err)
+		}
+	}
+}
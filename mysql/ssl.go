@@ -0,0 +1,148 @@
+package mysql
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/uwork/bingo/util"
+	"io/ioutil"
+)
+
+const (
+	SSL_MODE_DISABLED        = "disabled"
+	SSL_MODE_PREFERRED       = "preferred"
+	SSL_MODE_REQUIRED        = "required"
+	SSL_MODE_VERIFY_CA       = "verify-ca"
+	SSL_MODE_VERIFY_IDENTITY = "verify-identity"
+)
+
+type SSLConfig struct {
+	Mode string
+	CA   string
+	Cert string
+	Key  string
+	// 証明書を検証するホスト名 (省略時は接続先ホスト)
+	ServerName string
+}
+
+func (s *SSLConfig) mode() string {
+	if s == nil || len(s.Mode) == 0 {
+		return SSL_MODE_DISABLED
+	}
+	return s.Mode
+}
+
+func (s *SSLConfig) tlsConfig(host string) (*tls.Config, error) {
+	conf := &tls.Config{}
+	conf.ServerName = host
+	if 0 < len(s.ServerName) {
+		conf.ServerName = s.ServerName
+	}
+
+	if 0 < len(s.CA) {
+		pem, err := ioutil.ReadFile(s.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid ca certificate: %s", s.CA)
+		}
+		conf.RootCAs = pool
+	}
+
+	if 0 < len(s.Cert) || 0 < len(s.Key) {
+		cert, err := tls.LoadX509KeyPair(s.Cert, s.Key)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	switch s.mode() {
+	case SSL_MODE_PREFERRED, SSL_MODE_REQUIRED:
+		// 暗号化のみ (証明書は検証しない)
+		conf.InsecureSkipVerify = true
+
+	case SSL_MODE_VERIFY_CA:
+		// 証明書チェーンのみ検証する (ホスト名は検証しない)
+		conf.InsecureSkipVerify = true
+		conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyCertificateChain(rawCerts, conf.RootCAs)
+		}
+
+	case SSL_MODE_VERIFY_IDENTITY:
+
+	default:
+		return nil, fmt.Errorf("invalid ssl mode: %s", s.mode())
+	}
+
+	return conf, nil
+}
+
+func verifyCertificateChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	certs := []*x509.Certificate{}
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("no server certificate")
+	}
+
+	opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// SSLRequest を送信して TLS に切り替える
+// http://dev.mysql.com/doc/internals/en/ssl-handshake.html
+func (c *Conn) upgradeSSL() error {
+	mode := c.ssl.mode()
+	if mode == SSL_MODE_DISABLED {
+		return nil
+	}
+
+	if c.capabilities&clientSSL == 0 {
+		if mode == SSL_MODE_PREFERRED {
+			return nil
+		}
+		return fmt.Errorf("ssl not supported by server. (ssl mode: %s)", mode)
+	}
+
+	conf, err := c.ssl.tlsConfig(c.host)
+	if err != nil {
+		return err
+	}
+
+	payload := []byte{}
+	payload = append(payload, util.IntToBytes(c.clientCapability()|clientSSL)...)
+	payload = append(payload, util.IntToBytes(0)...) // max packet size
+	payload = append(payload, byte(33))              // utf8
+	payload = append(payload, make([]byte, 23)...)   // reserved(23)
+
+	err = c.writePacket(payload)
+	if err != nil {
+		return err
+	}
+
+	tc := tls.Client(c.nc, conf)
+	err = tc.Handshake()
+	if err != nil {
+		return fmt.Errorf("ssl handshake error: %s", err)
+	}
+
+	c.nc = tc
+	c.r = bufio.NewReader(tc)
+	c.w = bufio.NewWriter(tc)
+
+	return nil
+}
@@ -0,0 +1,256 @@
+package mysql
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	tlsCert tls.Certificate
+	pemFile string
+}
+
+// テスト用の証明書を作成する (parent が nil の場合は自己署名 CA)
+func createTestCert(t *testing.T, dir string, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	signCert, signKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		tmpl.DNSNames = []string{name}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		signCert, signKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signCert, &key.PublicKey, signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	tlsCert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pemFile := filepath.Join(dir, name+".pem")
+	if err := ioutil.WriteFile(pemFile, certPem, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert, key, tlsCert, pemFile}
+}
+
+func serverHandshakePacket(capability int) []byte {
+	payload := []byte{protocolVersion}
+	payload = append(payload, []byte("5.7.14-test")...)
+	payload = append(payload, 0)
+	payload = append(payload, 1, 0, 0, 0) // connection id
+	payload = append(payload, testAuthSalt[:8]...)
+	payload = append(payload, 0)
+	payload = append(payload, byte(capability), byte(capability>>8))
+	payload = append(payload, 33, 2, 0)
+	payload = append(payload, byte(capability>>16), byte(capability>>24))
+	payload = append(payload, 21)
+	payload = append(payload, make([]byte, 10)...)
+	payload = append(payload, testAuthSalt[8:]...)
+	payload = append(payload, 0)
+	payload = append(payload, []byte(authNativePassword)...)
+	payload = append(payload, 0)
+	return makePacket(0, payload)
+}
+
+// MySQL サーバーの代わりに handshake だけを行うサーバー
+func startTestServer(t *testing.T, cert *testCert, sslSupported bool) (int, chan bool) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan bool, 1)
+	go func() {
+		defer l.Close()
+
+		nc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer nc.Close()
+
+		capability := clientProtocolVersion41 | clientSecureConnection | clientPluginAuth | clientLongPassword
+		if sslSupported {
+			capability |= clientSSL
+		}
+
+		c := &Conn{nc: nc, w: bufio.NewWriter(nc)}
+		if err := c.writeBytes(serverHandshakePacket(capability)); err != nil {
+			return
+		}
+
+		// TLS の ClientHello を読み込まないように bufio を使わずに読む
+		head := make([]byte, 4)
+		if _, err := io.ReadFull(nc, head); err != nil {
+			return
+		}
+		data := make([]byte, int(head[0])|int(head[1])<<8|int(head[2])<<16)
+		if _, err := io.ReadFull(nc, data); err != nil {
+			return
+		}
+		c.sequence = uint(head[3]) + 1
+
+		isTLS := false
+		if len(data) == 32 && data[1]&(clientSSL>>8) != 0 {
+			tc := tls.Server(nc, &tls.Config{Certificates: []tls.Certificate{cert.tlsCert}})
+			if err := tc.Handshake(); err != nil {
+				result <- false
+				return
+			}
+			isTLS = true
+			c.nc = tc
+			c.r = bufio.NewReader(tc)
+			c.w = bufio.NewWriter(tc)
+
+			// handshake response
+			if _, err := c.readPacket(); err != nil {
+				return
+			}
+		}
+
+		c.writePacket([]byte{pOK, 0, 0, 2, 0, 0, 0})
+		result <- isTLS
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port, result
+}
+
+func TestOpenSSL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bingo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := createTestCert(t, dir, "bingo-test-ca", nil)
+	server := createTestCert(t, dir, "localhost", ca)
+	otherCA := createTestCert(t, dir, "bingo-other-ca", nil)
+
+	expecteds := []struct {
+		ssl          *SSLConfig
+		host         string
+		sslSupported bool
+		isOk         bool
+		isTLS        bool
+	}{
+		{nil, "127.0.0.1", true, true, false},
+		{&SSLConfig{Mode: SSL_MODE_DISABLED}, "127.0.0.1", true, true, false},
+		{&SSLConfig{Mode: SSL_MODE_PREFERRED}, "127.0.0.1", true, true, true},
+		{&SSLConfig{Mode: SSL_MODE_PREFERRED}, "127.0.0.1", false, true, false},
+		{&SSLConfig{Mode: SSL_MODE_REQUIRED}, "127.0.0.1", true, true, true},
+		{&SSLConfig{Mode: SSL_MODE_REQUIRED}, "127.0.0.1", false, false, false},
+		{&SSLConfig{Mode: SSL_MODE_VERIFY_CA, CA: ca.pemFile, ServerName: "mismatch.example"}, "127.0.0.1", true, true, true},
+		{&SSLConfig{Mode: SSL_MODE_VERIFY_CA, CA: otherCA.pemFile}, "127.0.0.1", true, false, false},
+		{&SSLConfig{Mode: SSL_MODE_VERIFY_IDENTITY, CA: ca.pemFile}, "localhost", true, true, true},
+		{&SSLConfig{Mode: SSL_MODE_VERIFY_IDENTITY, CA: ca.pemFile, ServerName: "mismatch.example"}, "127.0.0.1", true, false, false},
+		{&SSLConfig{Mode: "unknown"}, "127.0.0.1", true, false, false},
+	}
+
+	for _, s := range expecteds {
+		port, result := startTestServer(t, server, s.sslSupported)
+
+		conn, err := OpenSSL("user", "", s.host, port, s.ssl)
+		if !s.isOk {
+			if err == nil {
+				t.Errorf("invalid pattern. ssl: %#v", s.ssl)
+				conn.nc.Close()
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("open error: %v (ssl: %#v)", err, s.ssl)
+			continue
+		}
+		if conn.isTLS() != s.isTLS {
+			t.Errorf("invalid tls state.  expected:%v tls:%v (ssl: %#v)", s.isTLS, conn.isTLS(), s.ssl)
+		}
+		if isTLS := <-result; isTLS != s.isTLS {
+			t.Errorf("invalid server tls state.  expected:%v tls:%v (ssl: %#v)", s.isTLS, isTLS, s.ssl)
+		}
+		conn.nc.Close()
+	}
+}
+
+func TestSSLConfigClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bingo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := createTestCert(t, dir, "bingo-test-ca", nil)
+	client := createTestCert(t, dir, "client", ca)
+
+	keyDer, _ := x509.MarshalECPrivateKey(client.key)
+	keyFile := filepath.Join(dir, "client-key.pem")
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	ssl := &SSLConfig{Mode: SSL_MODE_VERIFY_IDENTITY, CA: ca.pemFile, Cert: client.pemFile, Key: keyFile}
+	conf, err := ssl.tlsConfig("db.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Certificates) != 1 || conf.ServerName != "db.example" || conf.InsecureSkipVerify {
+		t.Errorf("invalid tls config: %#v", conf)
+	}
+
+	expecteds := []*SSLConfig{
+		{Mode: SSL_MODE_REQUIRED, CA: filepath.Join(dir, "notfound.pem")},
+		{Mode: SSL_MODE_REQUIRED, CA: keyFile},
+		{Mode: SSL_MODE_REQUIRED, Cert: client.pemFile},
+	}
+	for i, s := range expecteds {
+		if _, err := s.tlsConfig("db.example"); err == nil {
+			t.Errorf("invalid pattern. index: %d", i)
+		}
+	}
+}
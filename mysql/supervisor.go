@@ -0,0 +1,200 @@
+package mysql
+
+import (
+	"github.com/uwork/bingo/mysql/binlog"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_MIN_BACKOFF = 1 * time.Second
+	DEFAULT_MAX_BACKOFF = 1 * time.Minute
+)
+
+// 再接続しても回復しないサーバーのエラー
+// https://dev.mysql.com/doc/refman/5.7/en/error-messages-server.html
+const (
+	ER_DBACCESS_DENIED_ERROR             = 1044
+	ER_ACCESS_DENIED_ERROR               = 1045
+	ER_SPECIFIC_ACCESS_DENIED_ERROR      = 1227
+	ER_MASTER_FATAL_ERROR_READING_BINLOG = 1236 // バイナリログが purge された、読み込み位置が不正など
+	ER_ACCESS_DENIED_NO_PASSWORD_ERROR   = 1698
+)
+
+// バイナリログの読み込み開始位置
+// GTIDSet が nil でない場合は GTID で読み込む
+type BinlogPosition struct {
+	File    string
+	Pos     uint32
+	GTIDSet *binlog.GTIDSet
+}
+
+// 接続する
+type OpenFunc func() (*Conn, error)
+
+// 接続ごとに読み込みを再開する位置を返す (転送済みの位置)
+type ResumeFunc func(c *Conn) (BinlogPosition, error)
+
+// コールバック以外のエラーで読み込みが止まった場合に再接続して読み込みを再開する
+// 認証の失敗など、再接続しても回復しないエラー (IsFatalError) の場合は再接続しない
+// 再接続の間隔は MinBackoff から倍々に MaxBackoff まで伸ばし、ジッターを加える
+type Supervisor struct {
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// 連続して失敗できる回数 (0 の場合は無制限)
+	MaxRetries int
+
+	open   OpenFunc
+	resume ResumeFunc
+	sleep  func(time.Duration)
+
+	mutex      sync.Mutex
+	conn       *Conn
+	reconnects int
+	lastError  error
+}
+
+// コールバックが返したエラー
+type callbackError struct {
+	err error
+}
+
+func (e *callbackError) Error() string {
+	return e.err.Error()
+}
+
+func NewSupervisor(open OpenFunc, resume ResumeFunc) *Supervisor {
+	return &Supervisor{
+		MinBackoff: DEFAULT_MIN_BACKOFF,
+		MaxBackoff: DEFAULT_MAX_BACKOFF,
+		open:       open,
+		resume:     resume,
+		sleep:      time.Sleep,
+	}
+}
+
+// バイナリログを読み込む
+// コールバックがエラーを返した場合はそのエラーを返して終了する
+func (s *Supervisor) Run(callback OnEvent) error {
+	failures := 0
+	for {
+		received := false
+		err := s.dump(func(ev *binlog.BinlogEvent) error {
+			received = true
+			if err := callback(ev); err != nil {
+				return &callbackError{err}
+			}
+			return nil
+		})
+		if cerr, ok := err.(*callbackError); ok {
+			return cerr.err
+		}
+
+		s.mutex.Lock()
+		s.lastError = err
+		s.mutex.Unlock()
+
+		if IsFatalError(err) {
+			return err
+		}
+
+		// イベントを受信できていれば接続には成功しているので、間隔を戻す
+		if received {
+			failures = 0
+		}
+		failures++
+
+		if 0 < s.MaxRetries && s.MaxRetries < failures {
+			return err
+		}
+
+		backoff := s.backoff(failures)
+		log.Printf("binlog connection lost: %s (reconnect after %s)\n", err, backoff)
+		s.sleep(backoff)
+
+		s.mutex.Lock()
+		s.reconnects++
+		s.mutex.Unlock()
+	}
+}
+
+// 再接続しても回復しないエラー (認証の失敗、権限不足、purge されたバイナリログ、チェックサムの不一致、server_id の重複)
+func IsFatalError(err error) bool {
+	switch e := err.(type) {
+	case *HandshakeError:
+		return IsFatalError(e.Err)
+	case *AuthError, *binlog.BinlogChecksumError, *ServerIdCollisionError:
+		return true
+	case *ServerError:
+		switch e.Code {
+		case ER_DBACCESS_DENIED_ERROR, ER_ACCESS_DENIED_ERROR, ER_SPECIFIC_ACCESS_DENIED_ERROR,
+			ER_MASTER_FATAL_ERROR_READING_BINLOG, ER_ACCESS_DENIED_NO_PASSWORD_ERROR:
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Supervisor) dump(callback OnEvent) error {
+	conn, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	pos, err := s.resume(conn)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.conn = conn
+	s.mutex.Unlock()
+
+	return conn.Dump(pos, callback)
+}
+
+// failures 回目の失敗後に待つ時間
+func (s *Supervisor) backoff(failures int) time.Duration {
+	backoff := s.MinBackoff
+	for i := 1; i < failures && backoff < s.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if s.MaxBackoff < backoff {
+		backoff = s.MaxBackoff
+	}
+
+	// 半分から全体の範囲でばらつかせる
+	half := int64(backoff / 2)
+	if half <= 0 {
+		return backoff
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// 現在の接続
+func (s *Supervisor) Conn() *Conn {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.conn
+}
+
+// 再接続した回数
+func (s *Supervisor) Reconnects() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.reconnects
+}
+
+// 最後に接続が切れた原因
+func (s *Supervisor) LastError() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.lastError
+}
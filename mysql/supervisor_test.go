@@ -0,0 +1,183 @@
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/uwork/bingo/mysql/binlog"
+	"net"
+	"testing"
+	"time"
+)
+
+func formatDescriptionPacket(seq byte) []byte {
+	body := []byte{4, 0}
+	version := make([]byte, 50)
+	copy(version, "5.5.0-test")
+	body = append(body, version...)
+	body = append(body, 0, 0, 0, 0, 19)
+	body = append(body, 0x38, 0xd, 0x0, 0x8, 0x0, 0x12, 0x0, 0x4, 0x4, 0x4, 0x4, 0x12, 0x0, 0x0, 0x5f, 0x0, 0x4, 0x1a, 0x8, 0x0)
+	return binlogPacket(seq, binlog.BINLOG_EVENT_FORMAT_DESCRIPTION, 0, 0, body)
+}
+
+// packets を読み込ませた後に切断される接続
+func dumpTestConn(t *testing.T, file string, xidPositions ...uint32) *Conn {
+	buf := &bytes.Buffer{}
+	buf.Write(makePacket(1, []byte{pOK, 0, 0, 0, 0, 0, 0})) // show global variables
+	buf.Write(makePacket(1, []byte{pOK, 0, 0, 0, 0, 0, 0})) // register slave
+	buf.Write(binlogPacket(1, binlog.BINLOG_EVENT_ROTATE, 0, binlog.LOG_EVENT_ARTIFICIAL_F, rotateBody(4, file)))
+	buf.Write(formatDescriptionPacket(2))
+	for i, pos := range xidPositions {
+		buf.Write(binlogPacket(byte(3+i), binlog.BINLOG_EVENT_XID, pos, 0, []byte{byte(i), 0, 0, 0, 0, 0, 0, 0}))
+	}
+
+	client, server := net.Pipe()
+	server.Close()
+
+	c := &Conn{nc: client}
+	c.r = bufio.NewReader(buf)
+	c.w = bufio.NewWriter(&bytes.Buffer{})
+	return c
+}
+
+func TestSupervisor(t *testing.T) {
+	errRefused := fmt.Errorf("connection refused")
+	errStop := fmt.Errorf("stop")
+
+	opens := 0
+	open := func() (*Conn, error) {
+		opens++
+		switch opens {
+		case 1:
+			return dumpTestConn(t, "mysql-bin.000001", 200, 300), nil
+		case 2:
+			return nil, errRefused
+		default:
+			return dumpTestConn(t, "mysql-bin.000001", 400), nil
+		}
+	}
+
+	delivered := BinlogPosition{File: "mysql-bin.000001", Pos: 4}
+	resumed := []BinlogPosition{}
+	resume := func(c *Conn) (BinlogPosition, error) {
+		resumed = append(resumed, delivered)
+		return delivered, nil
+	}
+
+	s := NewSupervisor(open, resume)
+	s.MinBackoff = 10 * time.Millisecond
+	s.MaxBackoff = 15 * time.Millisecond
+	sleeps := []time.Duration{}
+	s.sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+	}
+
+	err := s.Run(func(ev *binlog.BinlogEvent) error {
+		file, pos := s.Conn().Position()
+		delivered = BinlogPosition{File: file, Pos: pos}
+		if pos == 400 {
+			return errStop
+		}
+		return nil
+	})
+
+	if err != errStop {
+		t.Errorf("invalid error: %v", err)
+	}
+	if s.Reconnects() != 2 || s.LastError() != errRefused {
+		t.Errorf("invalid reconnects: %d %v", s.Reconnects(), s.LastError())
+	}
+
+	expecteds := []BinlogPosition{
+		{File: "mysql-bin.000001", Pos: 4},
+		{File: "mysql-bin.000001", Pos: 300},
+	}
+	if len(resumed) != len(expecteds) {
+		t.Fatalf("invalid resume positions: %v", resumed)
+	}
+	for i, pos := range expecteds {
+		if resumed[i] != pos {
+			t.Errorf("invalid resume position.  expected:%v position:%v", pos, resumed[i])
+		}
+	}
+
+	// 1回目: 5ms-10ms, 2回目: 7.5ms-15ms (MaxBackoff)
+	if len(sleeps) != 2 || sleeps[0] < 5*time.Millisecond || 10*time.Millisecond < sleeps[0] ||
+		sleeps[1] < 7500*time.Microsecond || 15*time.Millisecond < sleeps[1] {
+		t.Errorf("invalid backoff: %v", sleeps)
+	}
+}
+
+func TestSupervisorMaxRetries(t *testing.T) {
+	errRefused := fmt.Errorf("connection refused")
+
+	s := NewSupervisor(func() (*Conn, error) {
+		return nil, errRefused
+	}, func(c *Conn) (BinlogPosition, error) {
+		return BinlogPosition{}, nil
+	})
+	s.MaxRetries = 3
+	s.sleep = func(d time.Duration) {}
+
+	err := s.Run(func(ev *binlog.BinlogEvent) error {
+		return nil
+	})
+	if err != errRefused || s.Reconnects() != 3 {
+		t.Errorf("invalid retries: %d %v", s.Reconnects(), err)
+	}
+}
+
+func TestSupervisorFatalError(t *testing.T) {
+	expecteds := []struct {
+		err   error
+		fatal bool
+	}{
+		{&HandshakeError{&AuthError{"mysql_native_password", &ServerError{ER_ACCESS_DENIED_ERROR, "Access denied for user 'bingo'@'localhost'"}}}, true},
+		{&ServerError{ER_MASTER_FATAL_ERROR_READING_BINLOG, "Could not find first log file name in binary log index file"}, true},
+		{&ServerError{ER_SPECIFIC_ACCESS_DENIED_ERROR, "Access denied; you need (at least one of) the REPLICATION SLAVE privilege(s)"}, true},
+		{&binlog.BinlogChecksumError{}, true},
+		{&ServerIdCollisionError{ServerId: 1, Host: "db01"}, true},
+		{&ServerError{1053, "Server shutdown in progress"}, false},
+		{&HandshakeError{fmt.Errorf("EOF")}, false},
+		{&HeartbeatTimeoutError{time.Second}, false},
+		{fmt.Errorf("connection refused"), false},
+	}
+
+	for _, e := range expecteds {
+		opens := 0
+		s := NewSupervisor(func() (*Conn, error) {
+			opens++
+			if opens == 1 {
+				return nil, e.err
+			}
+			return nil, fmt.Errorf("connection refused")
+		}, func(c *Conn) (BinlogPosition, error) {
+			return BinlogPosition{}, nil
+		})
+		s.MaxRetries = 1
+		s.sleep = func(d time.Duration) {}
+
+		err := s.Run(func(ev *binlog.BinlogEvent) error {
+			return nil
+		})
+		if IsFatalError(e.err) != e.fatal || (err == e.err) != e.fatal || s.LastError() != err {
+			t.Errorf("invalid fatal error.  error:%v expected:%v result:%v reconnects:%d", e.err, e.fatal, err, s.Reconnects())
+		}
+	}
+}
+
+func TestSupervisorBackoff(t *testing.T) {
+	s := NewSupervisor(nil, nil)
+	s.MinBackoff = time.Second
+	s.MaxBackoff = 10 * time.Second
+
+	expecteds := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, max := range expecteds {
+		for j := 0; j < 10; j++ {
+			backoff := s.backoff(i + 1)
+			if backoff < max/2 || max < backoff {
+				t.Errorf("invalid backoff.  expected:%v-%v backoff:%v", max/2, max, backoff)
+			}
+		}
+	}
+}
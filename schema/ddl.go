@@ -0,0 +1,257 @@
+package schema
+
+import (
+	"strings"
+)
+
+const (
+	DDL_CREATE = "create"
+	DDL_ALTER  = "alter"
+	DDL_DROP   = "drop"
+	DDL_RENAME = "rename"
+)
+
+type TableName struct {
+	Database string
+	Name     string
+}
+
+func (t TableName) String() string {
+	return t.Database + "." + t.Name
+}
+
+// テーブル定義を変更する DDL
+// RENAME では変更前、変更後のテーブルの順に Tables に入る
+type DDL struct {
+	Type   string
+	Tables []TableName
+}
+
+type token struct {
+	value  string
+	quoted bool
+}
+
+// CREATE/ALTER/DROP/RENAME TABLE を解析する (それ以外のクエリは nil)
+// database はテーブル名にデータベースが指定されていない場合に使用する
+func ParseDDL(database string, query string) *DDL {
+	p := &ddlParser{tokens: tokenize(query), database: database}
+
+	switch {
+	case p.keyword("CREATE"):
+		p.keyword("TEMPORARY")
+		if !p.keyword("TABLE") {
+			return nil
+		}
+		p.keywords("IF", "NOT", "EXISTS")
+		return p.tables(DDL_CREATE, false)
+
+	case p.keyword("ALTER"):
+		p.keyword("ONLINE")
+		p.keyword("IGNORE")
+		if !p.keyword("TABLE") {
+			return nil
+		}
+		ddl := p.tables(DDL_ALTER, false)
+		if ddl == nil {
+			return nil
+		}
+
+		// ALTER TABLE ... RENAME [TO|AS] new_name
+		for ; p.pos < len(p.tokens); p.pos++ {
+			if !p.keyword("RENAME") {
+				continue
+			}
+			if p.peek("COLUMN") || p.peek("INDEX") || p.peek("KEY") {
+				continue
+			}
+			if !p.keyword("TO") {
+				p.keyword("AS")
+			}
+			if t, ok := p.tableName(); ok {
+				ddl.Type = DDL_RENAME
+				ddl.Tables = append(ddl.Tables, t)
+			}
+			break
+		}
+		return ddl
+
+	case p.keyword("DROP"):
+		p.keyword("TEMPORARY")
+		if !p.keyword("TABLE") {
+			return nil
+		}
+		p.keywords("IF", "EXISTS")
+		return p.tables(DDL_DROP, true)
+
+	case p.keyword("RENAME"):
+		if !p.keyword("TABLE") {
+			return nil
+		}
+		ddl := &DDL{Type: DDL_RENAME}
+		for {
+			from, ok := p.tableName()
+			if !ok || !p.keyword("TO") {
+				return nil
+			}
+			to, ok := p.tableName()
+			if !ok {
+				return nil
+			}
+			ddl.Tables = append(ddl.Tables, from, to)
+			if !p.symbol(",") {
+				return ddl
+			}
+		}
+	}
+
+	return nil
+}
+
+type ddlParser struct {
+	tokens   []token
+	pos      int
+	database string
+}
+
+func (p *ddlParser) peek(word string) bool {
+	if p.pos < len(p.tokens) {
+		t := p.tokens[p.pos]
+		return !t.quoted && strings.EqualFold(t.value, word)
+	}
+	return false
+}
+
+func (p *ddlParser) keyword(word string) bool {
+	if p.peek(word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// 連続するキーワードを全て読み込めた場合のみ進める
+func (p *ddlParser) keywords(words ...string) bool {
+	start := p.pos
+	for _, word := range words {
+		if !p.keyword(word) {
+			p.pos = start
+			return false
+		}
+	}
+	return true
+}
+
+func (p *ddlParser) symbol(s string) bool {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && p.tokens[p.pos].value == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *ddlParser) identifier() (string, bool) {
+	if p.pos >= len(p.tokens) {
+		return "", false
+	}
+	t := p.tokens[p.pos]
+	if !t.quoted && !isIdentifier(t.value) {
+		return "", false
+	}
+	p.pos++
+	return t.value, true
+}
+
+// [database.]table
+func (p *ddlParser) tableName() (TableName, bool) {
+	name, ok := p.identifier()
+	if !ok {
+		return TableName{}, false
+	}
+	if p.symbol(".") {
+		table, ok := p.identifier()
+		if !ok {
+			return TableName{}, false
+		}
+		return TableName{name, table}, true
+	}
+	return TableName{p.database, name}, true
+}
+
+func (p *ddlParser) tables(ddlType string, multiple bool) *DDL {
+	ddl := &DDL{Type: ddlType}
+	for {
+		t, ok := p.tableName()
+		if !ok {
+			return nil
+		}
+		ddl.Tables = append(ddl.Tables, t)
+		if !multiple || !p.symbol(",") {
+			return ddl
+		}
+	}
+}
+
+func isIdentifier(s string) bool {
+	for _, c := range s {
+		if !(c == '_' || c == '$' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || 0x80 <= c) {
+			return false
+		}
+	}
+	return 0 < len(s)
+}
+
+// クエリをトークンに分割する (コメントは読み飛ばす)
+func tokenize(query string) []token {
+	tokens := []token{}
+	rs := []rune(query)
+	for i := 0; i < len(rs); {
+		c := rs[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+
+		case c == '/' && i+1 < len(rs) && rs[i+1] == '*':
+			for i += 3; i < len(rs) && !(rs[i-1] == '*' && rs[i] == '/'); i++ {
+			}
+			i++
+
+		case c == '#' || c == '-' && i+2 < len(rs) && rs[i+1] == '-' && (rs[i+2] == ' ' || rs[i+2] == '\t'):
+			for i < len(rs) && rs[i] != '\n' {
+				i++
+			}
+
+		case c == '`' || c == '"' || c == '\'':
+			value := []rune{}
+			for i++; i < len(rs); i++ {
+				if rs[i] == c {
+					// 連続する引用符はエスケープ
+					if i+1 < len(rs) && rs[i+1] == c {
+						value = append(value, c)
+						i++
+						continue
+					}
+					break
+				}
+				if rs[i] == '\\' && c != '`' && i+1 < len(rs) {
+					i++
+				}
+				value = append(value, rs[i])
+			}
+			i++
+			tokens = append(tokens, token{string(value), true})
+
+		case isIdentifier(string(c)):
+			start := i
+			for i < len(rs) && isIdentifier(string(rs[i])) {
+				i++
+			}
+			tokens = append(tokens, token{string(rs[start:i]), false})
+
+		default:
+			tokens = append(tokens, token{string(c), false})
+			i++
+		}
+	}
+	return tokens
+}
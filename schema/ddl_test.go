@@ -0,0 +1,35 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDDL(t *testing.T) {
+	expecteds := []struct {
+		query string
+		ddl   *DDL
+	}{
+		{"CREATE TABLE t1 (id int)", &DDL{DDL_CREATE, []TableName{{"testdb", "t1"}}}},
+		{"create table if not exists `other`.`t 1` (id int)", &DDL{DDL_CREATE, []TableName{{"other", "t 1"}}}},
+		{"/* comment */ CREATE TEMPORARY TABLE t1 like t2", &DDL{DDL_CREATE, []TableName{{"testdb", "t1"}}}},
+		{"ALTER TABLE t1 ADD COLUMN name varchar(32)", &DDL{DDL_ALTER, []TableName{{"testdb", "t1"}}}},
+		{"alter table t1 add column `rename` int comment 'rename to t3'", &DDL{DDL_ALTER, []TableName{{"testdb", "t1"}}}},
+		{"ALTER TABLE t1 RENAME COLUMN a TO b", &DDL{DDL_ALTER, []TableName{{"testdb", "t1"}}}},
+		{"ALTER TABLE t1 RENAME TO other.t2", &DDL{DDL_RENAME, []TableName{{"testdb", "t1"}, {"other", "t2"}}}},
+		{"DROP TABLE `t1` /* generated by server */", &DDL{DDL_DROP, []TableName{{"testdb", "t1"}}}},
+		{"DROP TABLE IF EXISTS t1, other.t2", &DDL{DDL_DROP, []TableName{{"testdb", "t1"}, {"other", "t2"}}}},
+		{"RENAME TABLE t1 TO t2, t3 TO other.t4", &DDL{DDL_RENAME, []TableName{{"testdb", "t1"}, {"testdb", "t2"}, {"testdb", "t3"}, {"other", "t4"}}}},
+		{"BEGIN", nil},
+		{"CREATE DATABASE t1", nil},
+		{"DROP INDEX idx ON t1", nil},
+		{"insert into t1 values (1)", nil},
+	}
+
+	for _, s := range expecteds {
+		ddl := ParseDDL("testdb", s.query)
+		if !reflect.DeepEqual(s.ddl, ddl) {
+			t.Errorf("invalid ddl.  expected:%v ddl:%v query:%v", s.ddl, ddl, s.query)
+		}
+	}
+}
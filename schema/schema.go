@@ -0,0 +1,247 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/uwork/bingo/mysql"
+	"github.com/uwork/bingo/mysql/binlog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// mysql.Conn で実装される
+type Querier interface {
+	Query(sql string) (*mysql.ResultSet, error)
+}
+
+// バイナリログの位置
+type Position struct {
+	File string `json:"file"`
+	Pos  uint32 `json:"pos"`
+}
+
+func (p Position) Less(p2 Position) bool {
+	if p.File != p2.File {
+		return p.File < p2.File
+	}
+	return p.Pos < p2.Pos
+}
+
+// Position 以降で有効なテーブル定義
+// Columns が nil の場合は DDL によって変更された後、まだ取得していない事を表す
+type Version struct {
+	Position
+	Columns []string `json:"columns"`
+}
+
+// テーブルごとのカラム名の履歴
+// information_schema からは現在のテーブル定義しか取得できないため、
+// 取得した定義を DDL の位置と共に保存しておき、古い位置から読み直す場合に使用する
+// binlog dump 中のコネクションではクエリを発行できないため、別のコネクションを渡す
+type Cache struct {
+	conn   Querier
+	path   string
+	mutex  sync.Mutex
+	tables map[string][]*Version
+}
+
+func NewCache(conn Querier) *Cache {
+	return &Cache{conn: conn, tables: map[string][]*Version{}}
+}
+
+// 再接続した場合にコネクションを差し替える
+func (c *Cache) SetConn(conn Querier) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.conn = conn
+}
+
+// 履歴をファイルから読み込み、以降の変更をファイルに保存する
+func (c *Cache) Load(path string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.path = path
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	tables := map[string][]*Version{}
+	err = json.Unmarshal(data, &tables)
+	if err != nil {
+		return fmt.Errorf("schema history load failure: %s (%s)", path, err)
+	}
+	c.tables = tables
+	return nil
+}
+
+// TABLE_MAP_EVENT にカラム名を設定する
+// pos にはイベントの位置を渡し、その位置で有効なテーブル定義を使用する
+func (c *Cache) OnTableMap(tm *binlog.BinlogEventTableMap, pos Position) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := TableName{tm.SchemaName, tm.TableName}.String()
+	versions := c.tables[key]
+
+	var v *Version
+	for _, version := range versions {
+		if pos.Less(version.Position) {
+			break
+		}
+		v = version
+	}
+
+	if v == nil || v.Columns == nil {
+		columns, err := c.queryColumns(tm.SchemaName, tm.TableName)
+		if err != nil {
+			return err
+		}
+		if len(columns) != tm.ColumnCount {
+			return fmt.Errorf("column count mismatch: %s (binlog:%d schema:%d)", key, tm.ColumnCount, len(columns))
+		}
+
+		if v != nil {
+			v.Columns = columns
+		} else if len(versions) == 0 {
+			v = &Version{pos, columns}
+			c.tables[key] = []*Version{v}
+		} else {
+			// 既知の履歴より前の位置では、取得した定義を履歴に残さない
+			tm.ColumnNames = columns
+			return nil
+		}
+		if err := c.save(); err != nil {
+			return err
+		}
+	}
+
+	if len(v.Columns) != tm.ColumnCount {
+		return fmt.Errorf("column count mismatch: %s (binlog:%d schema:%d)", key, tm.ColumnCount, len(v.Columns))
+	}
+	tm.ColumnNames = v.Columns
+	return nil
+}
+
+// QUERY_EVENT が DDL の場合、対象テーブルの定義をその位置で無効にする
+// 無効にしたテーブルは次の TABLE_MAP_EVENT で取得し直す
+func (c *Cache) OnQuery(q *binlog.BinlogEventQuery, pos Position) (*DDL, error) {
+	ddl := ParseDDL(q.Schema, q.Query)
+	if ddl == nil {
+		return nil, nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, t := range ddl.Tables {
+		c.invalidate(t.String(), pos)
+	}
+	return ddl, c.save()
+}
+
+// キャッシュ済みの最新のカラム名を返す
+func (c *Cache) Columns(database string, tableName string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	versions := c.tables[TableName{database, tableName}.String()]
+	if 0 < len(versions) {
+		return versions[len(versions)-1].Columns
+	}
+	return nil
+}
+
+// テーブル定義の履歴を返す
+func (c *Cache) Versions(database string, tableName string) []Version {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	versions := []Version{}
+	for _, v := range c.tables[TableName{database, tableName}.String()] {
+		versions = append(versions, *v)
+	}
+	return versions
+}
+
+func (c *Cache) invalidate(key string, pos Position) {
+	versions := c.tables[key]
+
+	// 古い位置から読み直している場合は、記録済みの DDL を再度追加しない
+	for _, v := range versions {
+		if v.Position == pos {
+			return
+		}
+	}
+
+	i := len(versions)
+	for 0 < i && pos.Less(versions[i-1].Position) {
+		i--
+	}
+	versions = append(versions, nil)
+	copy(versions[i+1:], versions[i:])
+	versions[i] = &Version{pos, nil}
+	c.tables[key] = versions
+}
+
+// 一時ファイルに書き込んでから rename する
+func (c *Cache) save() error {
+	if len(c.path) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(c.tables)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("schema history save failure: %s (%s)", c.path, err)
+	}
+	return nil
+}
+
+func (c *Cache) queryColumns(database string, tableName string) ([]string, error) {
+	sql := fmt.Sprintf("select COLUMN_NAME from information_schema.COLUMNS where TABLE_SCHEMA = '%s' and TABLE_NAME = '%s' order by ORDINAL_POSITION",
+		escapeString(database), escapeString(tableName))
+	if c.conn == nil {
+		return nil, fmt.Errorf("schema query failure: %s.%s (not connected)", database, tableName)
+	}
+	rs, err := c.conn.Query(sql)
+	if err != nil {
+		return nil, fmt.Errorf("schema query failure: %s.%s (%s)", database, tableName, err)
+	}
+
+	columns := []string{}
+	if rs != nil {
+		for _, row := range rs.Rows {
+			columns = append(columns, row.Values[0].Value)
+		}
+	}
+	return columns, nil
+}
+
+func escapeString(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	return strings.Replace(s, "'", "\\'", -1)
+}
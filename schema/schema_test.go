@@ -0,0 +1,142 @@
+package schema
+
+import (
+	"fmt"
+	"github.com/uwork/bingo/mysql"
+	"github.com/uwork/bingo/mysql/binlog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type fakeQuerier struct {
+	columns map[string][]string
+	queries []string
+}
+
+func (q *fakeQuerier) Query(sql string) (*mysql.ResultSet, error) {
+	q.queries = append(q.queries, sql)
+
+	columns, ok := q.columns[sql]
+	if !ok {
+		return nil, fmt.Errorf("unexpected query: %s", sql)
+	}
+	rs := &mysql.ResultSet{}
+	for _, c := range columns {
+		rs.Rows = append(rs.Rows, mysql.Row{Values: []mysql.Value{{Value: c}}})
+	}
+	return rs, nil
+}
+
+func columnsQuery(database string, table string) string {
+	return fmt.Sprintf("select COLUMN_NAME from information_schema.COLUMNS where TABLE_SCHEMA = '%s' and TABLE_NAME = '%s' order by ORDINAL_POSITION", database, table)
+}
+
+func TestOnTableMap(t *testing.T) {
+	q := &fakeQuerier{columns: map[string][]string{
+		columnsQuery("testdb", "testtable"): {"id", "name"},
+		columnsQuery("testdb", "it\\'s"):    {"id"},
+	}}
+	cache := NewCache(q)
+
+	expecteds := []struct {
+		tm      binlog.BinlogEventTableMap
+		columns []string
+		queries int
+		err     bool
+	}{
+		{binlog.BinlogEventTableMap{TableId: 1, SchemaName: "testdb", TableName: "testtable", ColumnCount: 2}, []string{"id", "name"}, 1, false},
+		{binlog.BinlogEventTableMap{TableId: 2, SchemaName: "testdb", TableName: "testtable", ColumnCount: 2}, []string{"id", "name"}, 1, false},
+		{binlog.BinlogEventTableMap{TableId: 2, SchemaName: "testdb", TableName: "testtable", ColumnCount: 3}, nil, 1, true},
+		{binlog.BinlogEventTableMap{TableId: 3, SchemaName: "testdb", TableName: "it's", ColumnCount: 1}, []string{"id"}, 2, false},
+		{binlog.BinlogEventTableMap{TableId: 4, SchemaName: "testdb", TableName: "unknown", ColumnCount: 1}, nil, 3, true},
+	}
+
+	for _, s := range expecteds {
+		tm := s.tm
+		err := cache.OnTableMap(&tm, Position{"mysql-bin.000001", 100})
+		if (err != nil) != s.err {
+			t.Errorf("invalid error.  expected:%v err:%v", s.err, err)
+		}
+		if !reflect.DeepEqual(s.columns, tm.ColumnNames) {
+			t.Errorf("invalid column names.  expected:%v columns:%v", s.columns, tm.ColumnNames)
+		}
+		if len(q.queries) != s.queries {
+			t.Errorf("invalid query count.  expected:%v queries:%v", s.queries, q.queries)
+		}
+	}
+}
+
+func TestSchemaHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bingo-schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bingo.schema")
+
+	q := &fakeQuerier{columns: map[string][]string{
+		columnsQuery("testdb", "testtable"): {"id", "name"},
+	}}
+	cache := NewCache(q)
+	if err := cache.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	tableMap := func(cache *Cache, columnCount int, pos Position) ([]string, error) {
+		tm := &binlog.BinlogEventTableMap{SchemaName: "testdb", TableName: "testtable", ColumnCount: columnCount}
+		err := cache.OnTableMap(tm, pos)
+		return tm.ColumnNames, err
+	}
+
+	// (id, name) -> alter -> (id, name, age)
+	tableMap(cache, 2, Position{"mysql-bin.000001", 100})
+	ddl, err := cache.OnQuery(&binlog.BinlogEventQuery{Schema: "testdb", Query: "alter table testtable add column age int"}, Position{"mysql-bin.000001", 200})
+	if err != nil || ddl == nil || ddl.Type != DDL_ALTER {
+		t.Errorf("invalid ddl: %v %v", ddl, err)
+	}
+	if ddl, _ := cache.OnQuery(&binlog.BinlogEventQuery{Schema: "testdb", Query: "BEGIN"}, Position{"mysql-bin.000001", 250}); ddl != nil {
+		t.Errorf("invalid ddl: %v", ddl)
+	}
+	if cache.Columns("testdb", "testtable") != nil {
+		t.Errorf("schema was not invalidated: %v", cache.Columns("testdb", "testtable"))
+	}
+
+	q.columns[columnsQuery("testdb", "testtable")] = []string{"id", "name", "age"}
+	if columns, err := tableMap(cache, 3, Position{"mysql-bin.000002", 300}); err != nil || len(columns) != 3 {
+		t.Errorf("invalid column names: %v %v", columns, err)
+	}
+
+	// 履歴を読み込んで古い位置から読み直す
+	replay := NewCache(&fakeQuerier{})
+	if err := replay.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cache.Versions("testdb", "testtable"), replay.Versions("testdb", "testtable")) {
+		t.Errorf("invalid history.  expected:%v history:%v", cache.Versions("testdb", "testtable"), replay.Versions("testdb", "testtable"))
+	}
+
+	expecteds := []struct {
+		pos     Position
+		count   int
+		columns []string
+	}{
+		{Position{"mysql-bin.000001", 150}, 2, []string{"id", "name"}},
+		{Position{"mysql-bin.000001", 300}, 3, []string{"id", "name", "age"}},
+		{Position{"mysql-bin.000003", 4}, 3, []string{"id", "name", "age"}},
+	}
+	for _, s := range expecteds {
+		columns, err := tableMap(replay, s.count, s.pos)
+		if err != nil || !reflect.DeepEqual(s.columns, columns) {
+			t.Errorf("invalid column names.  expected:%v columns:%v err:%v", s.columns, columns, err)
+		}
+	}
+
+	// 記録済みの DDL は重複させない
+	replay.OnQuery(&binlog.BinlogEventQuery{Schema: "testdb", Query: "alter table testtable add column age int"}, Position{"mysql-bin.000001", 200})
+	if versions := replay.Versions("testdb", "testtable"); len(versions) != 2 {
+		t.Errorf("invalid history: %v", versions)
+	}
+}
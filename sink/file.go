@@ -0,0 +1,85 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/uwork/bingo/filter"
+	"net/url"
+	"os"
+)
+
+func init() {
+	Register("file", NewFileSink)
+}
+
+// 1 行ごとに JSON を追記する (file:///var/log/bingo/archive.json)
+type FileSink struct {
+	path string
+	f    *os.File
+	w    *bufio.Writer
+}
+
+func NewFileSink(u *url.URL, options json.RawMessage) (Sink, error) {
+	path := u.Path
+	if len(u.Host) != 0 {
+		// file://relative/path
+		path = u.Host + u.Path
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("file path is empty: %s", u)
+	}
+	return &FileSink{path: path}, nil
+}
+
+func (s *FileSink) Open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	s.w = bufio.NewWriter(f)
+	return nil
+}
+
+func (s *FileSink) Write(rows []filter.FilteredRow) error {
+	if s.w == nil {
+		return fmt.Errorf("file is not opened: %s", s.path)
+	}
+
+	for _, fr := range rows {
+		data, err := json.Marshal(fr)
+		if err != nil {
+			return err
+		}
+		s.w.Write(data)
+		if err := s.w.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileSink) Flush() error {
+	if s.w == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *FileSink) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.Flush()
+	if closeErr := s.f.Close(); err == nil {
+		err = closeErr
+	}
+	s.f = nil
+	s.w = nil
+	return err
+}
@@ -0,0 +1,47 @@
+package sink
+
+import (
+	"github.com/uwork/bingo/filter"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bingo-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "archive.json")
+	for i := 0; i < 2; i++ {
+		s, err := New("file://"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Open(); err != nil {
+			t.Fatal(err)
+		}
+		s.Write([]filter.FilteredRow{
+			{Database: "testdb", Table: "testtable", Type: filter.OPERATION_INSERT, Columns: map[string]interface{}{"id": "1"}},
+			{Database: "testdb", Table: "testtable", Type: filter.OPERATION_DELETE, Before: map[string]interface{}{"id": "2"}},
+		})
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 追記される
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line1 := `{"database":"testdb","table":"testtable","type":"insert","columns":{"id":"1"},"timestamp":0,"log_pos":0,"server_id":0}`
+	line2 := `{"database":"testdb","table":"testtable","type":"delete","before":{"id":"2"},"timestamp":0,"log_pos":0,"server_id":0}`
+	expected := line1 + "\n" + line2 + "\n" + line1 + "\n" + line2 + "\n"
+	if string(data) != expected {
+		t.Errorf("invalid file.  expected:%v data:%v", expected, string(data))
+	}
+}
@@ -0,0 +1,64 @@
+package sink
+
+import (
+	"encoding/json"
+	"github.com/uwork/bingo/filter"
+	"github.com/uwork/bingo/fluent"
+	"net/url"
+)
+
+func init() {
+	Register("fluent", NewFluentSink)
+}
+
+// テーブルごとのタグにまとめて forward protocol で送る
+type FluentSink struct {
+	client  *fluent.Client
+	tags    []string
+	entries map[string][]fluent.Entry
+}
+
+func NewFluentSink(u *url.URL, options json.RawMessage) (Sink, error) {
+	conf, err := fluent.ParseURL(u.String())
+	if err != nil {
+		return nil, err
+	}
+	return &FluentSink{client: fluent.NewClient(conf), entries: map[string][]fluent.Entry{}}, nil
+}
+
+func (s *FluentSink) Open() error {
+	return nil
+}
+
+func (s *FluentSink) Write(rows []filter.FilteredRow) error {
+	for _, fr := range rows {
+		tag := s.client.Tag(fr.Database, fr.Table)
+		if _, ok := s.entries[tag]; !ok {
+			s.tags = append(s.tags, tag)
+		}
+		s.entries[tag] = append(s.entries[tag], fluent.Entry{Time: fr.Timestamp, Record: fr.Map()})
+	}
+	return nil
+}
+
+// 送れなかったタグは次の Flush で送り直す
+func (s *FluentSink) Flush() error {
+	for 0 < len(s.tags) {
+		tag := s.tags[0]
+		err := s.client.Post(tag, s.entries[tag])
+		if err != nil {
+			return err
+		}
+		delete(s.entries, tag)
+		s.tags = s.tags[1:]
+	}
+	return nil
+}
+
+func (s *FluentSink) Close() error {
+	err := s.Flush()
+	if closeErr := s.client.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
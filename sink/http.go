@@ -0,0 +1,256 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/uwork/bingo/filter"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_HTTP_TIMEOUT     = 10 * time.Second
+	DEFAULT_HTTP_MAX_RETRIES = 5
+	DEFAULT_HTTP_MIN_BACKOFF = 500 * time.Millisecond
+	DEFAULT_HTTP_MAX_BACKOFF = 30 * time.Second
+)
+
+func init() {
+	Register("http", NewHTTPSink)
+	Register("https", NewHTTPSink)
+}
+
+// dests の options (秒の項目は小数も指定できる)
+type HTTPOptions struct {
+	Headers map[string]string `json:"headers"`
+
+	// Authorization: Bearer <token>
+	Token string `json:"token"`
+
+	Timeout float64 `json:"timeout"`
+
+	// いずれかの上限に達するまでまとめて送る (全て 0 の場合はトランザクションごとに送る)
+	BatchRows     int     `json:"batch_rows"`
+	BatchBytes    int     `json:"batch_bytes"`
+	BatchInterval float64 `json:"batch_interval"`
+
+	MaxRetries int     `json:"max_retries"`
+	MinBackoff float64 `json:"min_backoff"`
+	MaxBackoff float64 `json:"max_backoff"`
+}
+
+// 2xx 以外のレスポンス
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("invalid http response: %d (%s)", e.StatusCode, e.URL)
+}
+
+// 接続エラー、5xx、429 の場合は送り直す
+func (e *HTTPStatusError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || 500 <= e.StatusCode
+}
+
+// まとめた行を一つの JSON の配列にして POST する (fluentd の in_http など)
+// 送り直しても失敗した場合は行を残しておき、次の Flush で送り直す
+// 4xx (429 を除く) の場合は送り直しても成功しないため、行を破棄する
+type HTTPSink struct {
+	url     string
+	options HTTPOptions
+	client  *http.Client
+
+	rows  []json.RawMessage
+	size  int
+	first time.Time
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func NewHTTPSink(u *url.URL, options json.RawMessage) (Sink, error) {
+	opts := HTTPOptions{
+		Timeout:    DEFAULT_HTTP_TIMEOUT.Seconds(),
+		MaxRetries: DEFAULT_HTTP_MAX_RETRIES,
+		MinBackoff: DEFAULT_HTTP_MIN_BACKOFF.Seconds(),
+		MaxBackoff: DEFAULT_HTTP_MAX_BACKOFF.Seconds(),
+	}
+	if 0 < len(options) {
+		err := json.Unmarshal(options, &opts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http options: %s (%s)", u, err)
+		}
+	}
+
+	return &HTTPSink{
+		url:     u.String(),
+		options: opts,
+		client:  &http.Client{Timeout: seconds(opts.Timeout)},
+		now:     time.Now,
+		sleep:   time.Sleep,
+	}, nil
+}
+
+func (s *HTTPSink) Open() error {
+	return nil
+}
+
+func (s *HTTPSink) Write(rows []filter.FilteredRow) error {
+	for _, fr := range rows {
+		data, err := json.Marshal(fr)
+		if err != nil {
+			return err
+		}
+		if len(s.rows) == 0 {
+			s.first = s.now()
+		}
+		s.rows = append(s.rows, data)
+		s.size += len(data) + 1
+	}
+	return nil
+}
+
+func (s *HTTPSink) NeedsFlush() bool {
+	if len(s.rows) == 0 {
+		return false
+	}
+
+	o := s.options
+	if o.BatchRows <= 0 && o.BatchBytes <= 0 && o.BatchInterval <= 0 {
+		return true
+	}
+	if 0 < o.BatchRows && o.BatchRows <= len(s.rows) {
+		return true
+	}
+	if 0 < o.BatchBytes && o.BatchBytes <= s.size {
+		return true
+	}
+	return 0 < o.BatchInterval && seconds(o.BatchInterval) <= s.now().Sub(s.first)
+}
+
+func (s *HTTPSink) Buffered() bool {
+	return 0 < len(s.rows)
+}
+
+func (s *HTTPSink) Flush() error {
+	if len(s.rows) == 0 {
+		return nil
+	}
+
+	data := []byte{'['}
+	for i, row := range s.rows {
+		if 0 < i {
+			data = append(data, ',')
+		}
+		data = append(data, row...)
+	}
+	data = append(data, ']')
+
+	var err error
+	for retries := 0; ; retries++ {
+		err = s.post(data)
+		if err == nil {
+			break
+		}
+
+		serr, isStatus := err.(*HTTPStatusError)
+		if isStatus && !serr.Temporary() {
+			s.clear()
+			return err
+		}
+		if s.options.MaxRetries <= retries {
+			return err
+		}
+
+		wait := s.backoff(retries + 1)
+		if isStatus && 0 < serr.RetryAfter {
+			wait = serr.RetryAfter
+		}
+		s.sleep(wait)
+	}
+
+	s.clear()
+	return nil
+}
+
+func (s *HTTPSink) Close() error {
+	return s.Flush()
+}
+
+func (s *HTTPSink) clear() {
+	s.rows = nil
+	s.size = 0
+}
+
+func (s *HTTPSink) post(data []byte) error {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.options.Headers {
+		req.Header.Set(k, v)
+	}
+	if 0 < len(s.options.Token) {
+		req.Header.Set("Authorization", "Bearer "+s.options.Token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// コネクションを再利用するため読み切ってから閉じる
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if 200 <= resp.StatusCode && resp.StatusCode < 300 {
+		return nil
+	}
+	return &HTTPStatusError{s.url, resp.StatusCode, retryAfter(resp.Header.Get("Retry-After"), s.now(), seconds(s.options.MaxBackoff))}
+}
+
+// retries 回目の送り直しの前に待つ時間 (MinBackoff から倍々に MaxBackoff まで、半分から全体の範囲でばらつかせる)
+func (s *HTTPSink) backoff(retries int) time.Duration {
+	backoff := seconds(s.options.MinBackoff)
+	max := seconds(s.options.MaxBackoff)
+	for i := 1; i < retries && backoff < max; i++ {
+		backoff *= 2
+	}
+	if max < backoff {
+		backoff = max
+	}
+
+	half := int64(backoff / 2)
+	if half <= 0 {
+		return backoff
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// 秒数か HTTP の日付
+// 待っている間はバイナリログを読み込めないため、max (max_backoff) を上限にする
+func retryAfter(value string, now time.Time, max time.Duration) time.Duration {
+	var wait time.Duration
+	if sec, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(sec) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil && now.Before(t) {
+		wait = t.Sub(now)
+	}
+	if max < wait {
+		return max
+	}
+	return wait
+}
+
+func seconds(sec float64) time.Duration {
+	return time.Duration(sec * float64(time.Second))
+}
@@ -0,0 +1,208 @@
+package sink
+
+import (
+	"encoding/json"
+	"github.com/uwork/bingo/filter"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// 受信した行と、返すステータスの一覧
+type testHTTPServer struct {
+	*httptest.Server
+	received [][]filter.FilteredRow
+	headers  []http.Header
+	statuses []int
+}
+
+func newTestHTTPServer(t *testing.T, statuses ...int) *testHTTPServer {
+	s := &testHTTPServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rows := []filter.FilteredRow{}
+		if err := json.NewDecoder(r.Body).Decode(&rows); err != nil {
+			t.Error(err)
+		}
+		s.received = append(s.received, rows)
+		s.headers = append(s.headers, r.Header)
+
+		status := http.StatusOK
+		if 0 < len(s.statuses) {
+			status = s.statuses[0]
+			s.statuses = s.statuses[1:]
+		}
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "7")
+		}
+		w.WriteHeader(status)
+	}))
+	return s
+}
+
+func newTestHTTPSink(t *testing.T, url string, options string) (*HTTPSink, *[]time.Duration) {
+	s, err := New(url, json.RawMessage(options))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	waits := []time.Duration{}
+	hs := s.(*HTTPSink)
+	hs.sleep = func(d time.Duration) {
+		waits = append(waits, d)
+	}
+	return hs, &waits
+}
+
+func TestHTTPSink(t *testing.T) {
+	server := newTestHTTPServer(t)
+	defer server.Close()
+
+	s, _ := newTestHTTPSink(t, server.URL+"/bingo.data", `{"headers": {"X-Bingo": "1"}, "token": "secret"}`)
+
+	// Flush までの行を一度に送る
+	s.Write([]filter.FilteredRow{{Database: "testdb", Table: "t1"}})
+	s.Write([]filter.FilteredRow{{Database: "testdb", Table: "t2"}})
+	if !s.NeedsFlush() || !s.Buffered() {
+		t.Errorf("invalid batch state.  needs flush:%v buffered:%v", s.NeedsFlush(), s.Buffered())
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// 行が無い場合は送らない
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.received) != 1 || len(server.received[0]) != 2 || server.received[0][1].Table != "t2" {
+		t.Errorf("invalid received rows: %v", server.received)
+	}
+	if s.Buffered() {
+		t.Errorf("rows remain after flush")
+	}
+
+	h := server.headers[0]
+	if h.Get("X-Bingo") != "1" || h.Get("Authorization") != "Bearer secret" || h.Get("Content-Type") != "application/json" {
+		t.Errorf("invalid headers: %v", h)
+	}
+}
+
+func TestHTTPSinkBatch(t *testing.T) {
+	s, _ := newTestHTTPSink(t, "http://localhost:8888/bingo.data", `{"batch_rows": 3, "batch_bytes": 1000, "batch_interval": 5}`)
+	now := time.Unix(1473000000, 0)
+	s.now = func() time.Time { return now }
+
+	row := filter.FilteredRow{Database: "testdb", Table: "testtable"}
+	s.Write([]filter.FilteredRow{row})
+	if s.NeedsFlush() {
+		t.Errorf("invalid pattern. flush before limit")
+	}
+
+	// 件数
+	s.Write([]filter.FilteredRow{row, row})
+	if !s.NeedsFlush() {
+		t.Errorf("invalid pattern. batch_rows was ignored")
+	}
+
+	// 時間
+	s.clear()
+	s.Write([]filter.FilteredRow{row})
+	now = now.Add(4 * time.Second)
+	if s.NeedsFlush() {
+		t.Errorf("invalid pattern. flush before interval")
+	}
+	now = now.Add(time.Second)
+	if !s.NeedsFlush() {
+		t.Errorf("invalid pattern. batch_interval was ignored")
+	}
+
+	// サイズ
+	s.clear()
+	s.Write([]filter.FilteredRow{{Database: "testdb", Table: "testtable", Columns: map[string]interface{}{"text": string(make([]byte, 1000))}}})
+	if !s.NeedsFlush() {
+		t.Errorf("invalid pattern. batch_bytes was ignored")
+	}
+}
+
+func TestHTTPSinkRetry(t *testing.T) {
+	row := filter.FilteredRow{Database: "testdb", Table: "testtable"}
+
+	expecteds := []struct {
+		statuses []int
+		requests int
+		waits    int
+		retryAt  time.Duration
+		ok       bool
+		buffered bool
+	}{
+		// 5xx, 429 は送り直す (Retry-After を優先するが、max_backoff を上限にする)
+		{[]int{500, 503, 200}, 3, 2, 0, true, false},
+		{[]int{429, 201}, 2, 1, 2 * time.Second, true, false},
+		// 送り直しても失敗した場合は次の Flush まで残す
+		{[]int{500, 500, 500, 500}, 3, 2, 0, false, true},
+		// 4xx は破棄する
+		{[]int{400}, 1, 0, 0, false, false},
+	}
+
+	for _, e := range expecteds {
+		server := newTestHTTPServer(t, e.statuses...)
+		s, waits := newTestHTTPSink(t, server.URL, `{"max_retries": 2, "min_backoff": 1, "max_backoff": 2}`)
+
+		s.Write([]filter.FilteredRow{row})
+		err := s.Flush()
+		if e.ok != (err == nil) {
+			t.Errorf("invalid flush result.  statuses:%v error:%v", e.statuses, err)
+		}
+		if len(server.received) != e.requests || len(*waits) != e.waits {
+			t.Errorf("invalid retries.  statuses:%v requests:%v waits:%v", e.statuses, len(server.received), *waits)
+		}
+		for i, wait := range *waits {
+			if 0 < e.retryAt {
+				if wait != e.retryAt {
+					t.Errorf("invalid retry after.  expected:%v wait:%v", e.retryAt, wait)
+				}
+			} else if max := time.Duration(1<<uint(i)) * time.Second; wait < max/2 || max < wait {
+				t.Errorf("invalid backoff.  max:%v wait:%v", max, wait)
+			}
+		}
+		if s.Buffered() != e.buffered {
+			t.Errorf("invalid buffered.  statuses:%v expected:%v", e.statuses, e.buffered)
+		}
+		server.Close()
+	}
+
+	// 接続できない場合も送り直す
+	server := newTestHTTPServer(t)
+	url := server.URL
+	server.Close()
+	s, waits := newTestHTTPSink(t, url, `{"max_retries": 1, "timeout": 1}`)
+	s.Write([]filter.FilteredRow{row})
+	if err := s.Flush(); err == nil || len(*waits) != 1 || !s.Buffered() {
+		t.Errorf("invalid pattern. network error was not retried: %v %v", err, *waits)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2016, 9, 2, 1, 23, 0, 0, time.UTC)
+	expecteds := []struct {
+		value  string
+		result time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"Fri, 02 Sep 2016 01:23:30 GMT", 30 * time.Second},
+		{"Fri, 02 Sep 2016 01:22:00 GMT", 0},
+		{"soon", 0},
+		// max_backoff を上限にする
+		{"86400", 5 * time.Minute},
+		{"Sat, 03 Sep 2016 01:23:00 GMT", 5 * time.Minute},
+	}
+
+	for _, s := range expecteds {
+		if result := retryAfter(s.value, now, 5*time.Minute); result != s.result {
+			t.Errorf("invalid retry after.  value:%v expected:%v result:%v", s.value, s.result, result)
+		}
+	}
+}
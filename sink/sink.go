@@ -0,0 +1,62 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/uwork/bingo/filter"
+	"net/url"
+	"sync"
+)
+
+// 転送先
+// Write で渡された行は Flush を呼ぶまでに転送する
+type Sink interface {
+	Open() error
+	Write(rows []filter.FilteredRow) error
+	Flush() error
+	Close() error
+}
+
+// 件数や時間の上限までまとめて転送する Sink
+// Flush は上限に達した場合 (NeedsFlush) と終了時にのみ呼ぶ
+type Batcher interface {
+	Sink
+
+	NeedsFlush() bool
+
+	// Flush されていない行があるか
+	Buffered() bool
+}
+
+// URL と転送先ごとの設定 (無い場合は nil) から Sink を作る
+type Factory func(u *url.URL, options json.RawMessage) (Sink, error)
+
+var (
+	mutex     sync.Mutex
+	factories = map[string]Factory{}
+)
+
+// URL の scheme に対応する Sink を登録する
+func Register(scheme string, factory Factory) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	factories[scheme] = factory
+}
+
+// dest の scheme に対応する Sink を作る (Open は呼ばない)
+func New(dest string, options json.RawMessage) (Sink, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	mutex.Lock()
+	factory, ok := factories[u.Scheme]
+	mutex.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown destination scheme: %s", dest)
+	}
+	return factory(u, options)
+}
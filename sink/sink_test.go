@@ -0,0 +1,56 @@
+package sink
+
+import (
+	"encoding/json"
+	"github.com/uwork/bingo/filter"
+	"net/url"
+	"testing"
+)
+
+type testSink struct {
+	rows []filter.FilteredRow
+}
+
+func (s *testSink) Open() error { return nil }
+func (s *testSink) Write(rows []filter.FilteredRow) error {
+	s.rows = append(s.rows, rows...)
+	return nil
+}
+func (s *testSink) Flush() error { return nil }
+func (s *testSink) Close() error { return nil }
+
+func TestNew(t *testing.T) {
+	Register("test", func(u *url.URL, options json.RawMessage) (Sink, error) {
+		return &testSink{}, nil
+	})
+
+	expecteds := []struct {
+		dest    string
+		options string
+		ok      bool
+	}{
+		{"http://localhost:8888/bingo.data", "", true},
+		{"https://localhost/bingo.data", "", true},
+		{"fluent://localhost:24224?tag=bingo", "", true},
+		{"file:///tmp/bingo.json", "", true},
+		{"test://", "", true},
+		{"fluent://localhost?mode=unknown", "", false},
+		{"unknown://localhost", "", false},
+		{"http://localhost:8888/bingo.data", `{"batch_rows": "many"}`, false},
+		{"/tmp/bingo.json", "", false},
+	}
+
+	for _, s := range expecteds {
+		var options json.RawMessage
+		if 0 < len(s.options) {
+			options = json.RawMessage(s.options)
+		}
+		_, err := New(s.dest, options)
+		if s.ok && err != nil {
+			t.Errorf("invalid sink.  dest:%v error:%v", s.dest, err)
+		}
+		if !s.ok && err == nil {
+			t.Errorf("invalid pattern. sink was created: %v", s.dest)
+		}
+	}
+}